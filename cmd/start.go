@@ -13,6 +13,8 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var configPath string
+
 var startCmd = &cobra.Command{
 	Use: "start",
 	Run: func(cmd *cobra.Command, args []string) {
@@ -20,8 +22,12 @@ var startCmd = &cobra.Command{
 	},
 }
 
+func init() {
+	startCmd.Flags().StringVarP(&configPath, "config", "c", "./config.json", "config file, .json, .yaml, .yml or .toml")
+}
+
 func waitExitSignal(ctxStop context.CancelFunc) {
-	var exitSignal = make(chan os.Signal)
+	var exitSignal = make(chan os.Signal, 1)
 	signal.Notify(exitSignal, syscall.SIGTERM)
 	signal.Notify(exitSignal, syscall.SIGINT)
 
@@ -37,9 +43,10 @@ func Run() int {
 	go waitExitSignal(stop)
 
 	quitLoopConfig := make(chan bool)
-	core.LoadConfig(ctx, quitLoopConfig)
+	core.LoadConfig(ctx, configPath, quitLoopConfig)
 
 	go core.StartMonitorHttpServer(ctx)
+	go core.StartAdminHttpServer(ctx)
 	httpServer := &http.Server{Addr: ":3005", Handler: &core.Server{}}
 
 	// http server graceful shutdown
@@ -0,0 +1,525 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var UpstreamNotFoundError = fmt.Errorf("upstream not found")
+var LastEnabledUpstreamError = fmt.Errorf("the last enabled upstream of a route can't be disabled")
+var AdminNotFoundError = fmt.Errorf("not found")
+var AdminMethodError = fmt.Errorf("method not allowed")
+
+var adminErrorStatuses = map[error]int{
+	UnauthorizedError:        http.StatusUnauthorized,
+	ChainNotSupportedError:   http.StatusNotFound,
+	UpstreamNotFoundError:    http.StatusNotFound,
+	AdminNotFoundError:       http.StatusNotFound,
+	AdminMethodError:         http.StatusMethodNotAllowed,
+	LastEnabledUpstreamError: http.StatusConflict,
+}
+
+// AdminConfig enables the admin api, which changes the upstreams at runtime
+type AdminConfig struct {
+	// Listen is the address of the admin api, it's kept apart from the rpc listener
+	Listen string `json:"listen"`
+	// Token is required as a bearer token in the Authorization header
+	Token string `json:"token"`
+	// WriteConfig writes the changes back to the config file, otherwise they last until the file changes.
+	// yaml and toml files are rewritten without their comments and key order.
+	WriteConfig bool `json:"writeConfig"`
+}
+
+func (c *AdminConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+
+	if c.Listen == "" || c.Token == "" {
+		return fmt.Errorf("admin: listen and token are required")
+	}
+
+	return nil
+}
+
+func (c *AdminConfig) authorize(r *http.Request) error {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return UnauthorizedError
+	}
+
+	if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(c.Token)) != 1 {
+		return UnauthorizedError
+	}
+
+	return nil
+}
+
+// AdminChainInfo is the live state of a chain
+type AdminChainInfo struct {
+	Strategy  string     `json:"strategy"`
+	Upstreams []NodeInfo `json:"upstreams"`
+}
+
+func newAdminChainInfo(cfg *RunningChainConfig) AdminChainInfo {
+	cfg.updateLocker.RLock()
+	defer cfg.updateLocker.RUnlock()
+
+	info := AdminChainInfo{Strategy: cfg.strategyName, Upstreams: []NodeInfo{}}
+
+	for _, up := range cfg.Upstreams {
+		info.Upstreams = append(info.Upstreams, newNodeInfo(up))
+	}
+
+	return info
+}
+
+// setDisabled takes an upstream out of its routes or puts it back, the requests sent to it are finished.
+// The last enabled upstream of a route can't be disabled.
+func (c *RunningChainConfig) setDisabled(name string, disabled bool) error {
+	return c.changeDisabled(name, disabled, true)
+}
+
+// checkDisabled returns the error setDisabled would return, without changing the upstream
+func (c *RunningChainConfig) checkDisabled(name string, disabled bool) error {
+	return c.changeDisabled(name, disabled, false)
+}
+
+func (c *RunningChainConfig) changeDisabled(name string, disabled bool, keep bool) error {
+	c.updateLocker.Lock()
+	defer c.updateLocker.Unlock()
+
+	up := c.getUpstream(name)
+	if up == nil {
+		return UpstreamNotFoundError
+	}
+
+	was := up.getInfo().disabled
+	up.getInfo().disabled = disabled
+	c.updateRoutes()
+
+	err := c.emptyRoute()
+	if err != nil || !keep {
+		up.getInfo().disabled = was
+		c.updateRoutes()
+	}
+
+	if err != nil {
+		return LastEnabledUpstreamError
+	}
+
+	return nil
+}
+
+// configDocument is the running config as raw json, the admin api only rewrites the keys it changes
+type configDocument map[string]json.RawMessage
+
+func (d configDocument) getChain(chainId uint64) (map[string]json.RawMessage, error) {
+	raw, ok := d[strconv.FormatUint(chainId, 10)]
+	if !ok {
+		return nil, ChainNotSupportedError
+	}
+
+	var chain map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &chain); err != nil {
+		return nil, err
+	}
+
+	return chain, nil
+}
+
+func (d configDocument) setChainKey(chainId uint64, key string, value interface{}) error {
+	chain, err := d.getChain(chainId)
+	if err != nil {
+		return err
+	}
+
+	if chain[key], err = json.Marshal(value); err != nil {
+		return err
+	}
+
+	d[strconv.FormatUint(chainId, 10)], err = json.Marshal(chain)
+
+	return err
+}
+
+// editUpstreams replaces the upstreams of a chain by the result of edit
+func (d configDocument) editUpstreams(chainId uint64, edit func(upstreams []json.RawMessage) ([]json.RawMessage, error)) error {
+	chain, err := d.getChain(chainId)
+	if err != nil {
+		return err
+	}
+
+	var upstreams []json.RawMessage
+	if raw, ok := chain["upstreams"]; ok {
+		if err := json.Unmarshal(raw, &upstreams); err != nil {
+			return err
+		}
+	}
+
+	upstreams, err = edit(upstreams)
+	if err != nil {
+		return err
+	}
+
+	return d.setChainKey(chainId, "upstreams", upstreams)
+}
+
+// upstreamIndex finds an upstream by the name the gateway gives it
+func upstreamIndex(upstreams []json.RawMessage, name string) (int, error) {
+	names := make(map[string]bool)
+
+	for i, raw := range upstreams {
+		var cfg UpstreamConfig
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return -1, err
+		}
+
+		upName, err := upstreamName(cfg, i, names)
+		if err != nil {
+			return -1, err
+		}
+
+		if upName == name {
+			return i, nil
+		}
+
+		names[upName] = true
+	}
+
+	return -1, UpstreamNotFoundError
+}
+
+// withDisabled sets the disabled key of an upstream, a plain url becomes an object
+func withDisabled(raw json.RawMessage, disabled bool) (json.RawMessage, error) {
+	var urlString string
+	if err := json.Unmarshal(raw, &urlString); err == nil {
+		return json.Marshal(UpstreamConfig{Url: urlString, Disabled: disabled})
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+
+	if disabled {
+		fields["disabled"] = json.RawMessage("true")
+	} else {
+		delete(fields, "disabled")
+	}
+
+	return json.Marshal(fields)
+}
+
+// changeConfig edits the document of the running config and writes it back to the config file if configured.
+// Without apply, the chain is rebuilt from the document before the write and rebuilt from the old one if the write
+// fails. apply changes the running chain in place instead, once the document is written. The other chains keep running.
+func changeConfig(chainId uint64, edit func(doc configDocument) error, apply func() error) error {
+	configLocker.Lock()
+	defer configLocker.Unlock()
+
+	var doc configDocument
+	if err := json.Unmarshal([]byte(currentConfigString), &doc); err != nil {
+		return err
+	}
+
+	if err := edit(doc); err != nil {
+		return err
+	}
+
+	bts, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	admin := getRunningConfig().admin
+
+	var file []byte
+	if admin.WriteConfig {
+		format, err := getConfigFormat(configPath)
+		if err != nil {
+			return err
+		}
+
+		if file, err = encodeConfigFile(format, bts); err != nil {
+			return err
+		}
+	}
+
+	old := currentConfigString
+
+	if apply == nil {
+		if err := applyChainConfig(chainId, bts); err != nil {
+			return err
+		}
+	}
+
+	if admin.WriteConfig {
+		if err := ioutil.WriteFile(configPath, file, 0644); err != nil {
+			if apply == nil {
+				if rerr := applyChainConfig(chainId, []byte(old)); rerr != nil {
+					logrus.Errorf("admin: rebuilding chain %d from the old config failed: %v", chainId, rerr)
+				}
+			}
+
+			return err
+		}
+
+		currentFileString = string(file)
+	}
+
+	if apply != nil {
+		if err := apply(); err != nil {
+			return err
+		}
+
+		currentConfigString = string(bts)
+	}
+
+	return nil
+}
+
+// adminMethods are the http methods of the admin actions
+var adminMethods = map[string]string{
+	"chains":      http.MethodGet,
+	"chain":       http.MethodGet,
+	"strategy":    http.MethodPut,
+	"healthcheck": http.MethodPost,
+	"upstreams":   http.MethodPost,
+	"upstream":    http.MethodDelete,
+	"disable":     http.MethodPost,
+	"enable":      http.MethodPost,
+}
+
+// adminAction parses the paths /chains, /chains/{chainId}, /chains/{chainId}/{strategy|healthcheck|upstreams},
+// /chains/{chainId}/upstreams/{name} and /chains/{chainId}/upstreams/{name}/{disable|enable}
+func adminAction(path []string) (action string, chainId uint64, name string, err error) {
+	if path[0] != "chains" {
+		return "", 0, "", AdminNotFoundError
+	}
+
+	if len(path) == 1 {
+		return "chains", 0, "", nil
+	}
+
+	chainId, err = strconv.ParseUint(path[1], 10, 64)
+	if err != nil || getRunningConfig().Configs[chainId] == nil {
+		return "", 0, "", ChainNotSupportedError
+	}
+
+	switch {
+	case len(path) == 2:
+		action = "chain"
+	case len(path) == 3 && (path[2] == "strategy" || path[2] == "healthcheck" || path[2] == "upstreams"):
+		action = path[2]
+	case len(path) == 4 && path[2] == "upstreams":
+		action, name = "upstream", path[3]
+	case len(path) == 5 && path[2] == "upstreams" && (path[4] == "disable" || path[4] == "enable"):
+		action, name = path[4], path[3]
+	}
+
+	if _, ok := adminMethods[action]; !ok {
+		return "", 0, "", AdminNotFoundError
+	}
+
+	return action, chainId, name, nil
+}
+
+type AdminServer struct{}
+
+func (s *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	admin := getRunningConfig().admin
+	if admin == nil {
+		writeAdminError(w, AdminNotFoundError)
+		return
+	}
+
+	if err := admin.authorize(r); err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	action, chainId, name, err := adminAction(strings.Split(strings.Trim(r.URL.Path, "/"), "/"))
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	if r.Method != adminMethods[action] {
+		writeAdminError(w, AdminMethodError)
+		return
+	}
+
+	status := http.StatusOK
+
+	switch action {
+	case "chains":
+		chains := make(map[uint64]AdminChainInfo)
+		for chainId, cfg := range getRunningConfig().Configs {
+			chains[chainId] = newAdminChainInfo(cfg)
+		}
+
+		writeAdminResponse(w, status, chains)
+		return
+	case "strategy":
+		err = s.setStrategy(r, chainId)
+	case "healthcheck":
+		getRunningConfig().Configs[chainId].healthCheck()
+		invalidateHealthInfo()
+	case "upstreams":
+		err = s.addUpstream(r, chainId)
+		status = http.StatusCreated
+	case "upstream":
+		err = s.removeUpstream(chainId, name)
+	case "disable", "enable":
+		err = s.setDisabled(chainId, name, action == "disable")
+	}
+
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	// some changes rebuild the chain, it's read again
+	writeAdminResponse(w, status, newAdminChainInfo(getRunningConfig().Configs[chainId]))
+}
+
+func (s *AdminServer) setStrategy(r *http.Request, chainId uint64) error {
+	var body struct {
+		Strategy string `json:"strategy"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return err
+	}
+
+	logrus.Infof("admin: chain %d strategy set to %s", chainId, body.Strategy)
+
+	return changeConfig(chainId, func(doc configDocument) error {
+		return doc.setChainKey(chainId, "strategy", body.Strategy)
+	}, nil)
+}
+
+func (s *AdminServer) addUpstream(r *http.Request, chainId uint64) error {
+	var cfg UpstreamConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		return err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	logrus.Infof("admin: chain %d upstream %s added", chainId, cfg.Name)
+
+	return changeConfig(chainId, func(doc configDocument) error {
+		return doc.editUpstreams(chainId, func(upstreams []json.RawMessage) ([]json.RawMessage, error) {
+			raw, err := json.Marshal(cfg)
+			return append(upstreams, raw), err
+		})
+	}, nil)
+}
+
+func (s *AdminServer) removeUpstream(chainId uint64, name string) error {
+	logrus.Infof("admin: chain %d upstream %s removed", chainId, name)
+
+	return changeConfig(chainId, func(doc configDocument) error {
+		return doc.editUpstreams(chainId, func(upstreams []json.RawMessage) ([]json.RawMessage, error) {
+			i, err := upstreamIndex(upstreams, name)
+			if err != nil {
+				return nil, err
+			}
+
+			return append(upstreams[:i:i], upstreams[i+1:]...), nil
+		})
+	}, nil)
+}
+
+// setDisabled changes the running upstream in place, its in-flight requests are finished
+func (s *AdminServer) setDisabled(chainId uint64, name string, disabled bool) error {
+	logrus.Infof("admin: chain %d upstream %s disabled: %v", chainId, name, disabled)
+
+	return changeConfig(chainId, func(doc configDocument) error {
+		err := doc.editUpstreams(chainId, func(upstreams []json.RawMessage) ([]json.RawMessage, error) {
+			i, err := upstreamIndex(upstreams, name)
+			if err != nil {
+				return nil, err
+			}
+
+			upstreams[i], err = withDisabled(upstreams[i], disabled)
+			return upstreams, err
+		})
+		if err != nil {
+			return err
+		}
+
+		return getRunningConfig().Configs[chainId].checkDisabled(name, disabled)
+	}, func() error {
+		return getRunningConfig().Configs[chainId].setDisabled(name, disabled)
+	})
+}
+
+func writeAdminResponse(w http.ResponseWriter, status int, body interface{}) {
+	bts, err := json.Marshal(body)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bts)
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	status, ok := adminErrorStatuses[err]
+	if !ok {
+		status = http.StatusBadRequest
+	}
+
+	bts, _ := json.Marshal(map[string]string{"error": err.Error()})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bts)
+}
+
+func StartAdminHttpServer(ctx context.Context) {
+	admin := getRunningConfig().admin
+	if admin == nil {
+		return
+	}
+
+	hs := &http.Server{
+		Addr:    admin.Listen,
+		Handler: &AdminServer{},
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := hs.Shutdown(shutdownCtx); err != nil {
+			logrus.Fatalf("Could not gracefully shutdown admin server: %v\n", err)
+		}
+	}()
+
+	logrus.Infof("admin server listen on %s", admin.Listen)
+
+	if err := hs.ListenAndServe(); err != nil {
+		if err != http.ErrServerClosed {
+			logrus.Errorf("Listen failed %v", err)
+		}
+	}
+}
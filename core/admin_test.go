@@ -0,0 +1,269 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func doAdminRequest(method string, path string, token string, body string) (int, map[string]interface{}) {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+
+	(&AdminServer{}).ServeHTTP(w, r)
+
+	var resp map[string]interface{}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+
+	return w.Code, resp
+}
+
+func adminUpstreamStates(resp map[string]interface{}) map[string]string {
+	states := make(map[string]string)
+
+	upstreams, _ := resp["upstreams"].([]interface{})
+	for _, up := range upstreams {
+		info := up.(map[string]interface{})
+		states[info["name"].(string)] = info["state"].(string)
+	}
+
+	return states
+}
+
+func TestAdminServer(t *testing.T) {
+	first := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return "first"
+	})
+	defer first.Close()
+	second := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return "second"
+	})
+	defer second.Close()
+
+	defer closeTestConfig()
+	configLocker.Lock()
+	err := applyConfig(context.Background(), []byte(fmt.Sprintf(`{
+		"admin": {"listen": "127.0.0.1:0", "token": "secret"},
+		"1337": {
+			"_upstreams": "kept as written",
+			"upstreams": ["%s", {"url": "%s", "name": "second"}],
+			"strategy": "FALLBACK"
+		}
+	}`, first.URL, second.URL)))
+	configLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstName := strings.TrimPrefix(first.URL, "http://")
+
+	code, _ := doAdminRequest(http.MethodGet, "/chains", "wrong", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, resp := doAdminRequest(http.MethodGet, "/chains/1337", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "FALLBACK", resp["strategy"])
+	assert.Equal(t, map[string]string{firstName: "enabled", "second": "enabled"}, adminUpstreamStates(resp))
+
+	code, _ = doAdminRequest(http.MethodGet, "/chains/1", "secret", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = doAdminRequest(http.MethodGet, "/chains/1337/strategy", "secret", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// the disabled upstream gets no traffic, the running upstreams are kept
+	upstreams := getRunningConfig().Configs[1337].Upstreams
+
+	code, resp = doAdminRequest(http.MethodPost, "/chains/1337/upstreams/"+firstName+"/disable", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "disabled", adminUpstreamStates(resp)[firstName])
+	assert.Equal(t, upstreams, getRunningConfig().Configs[1337].Upstreams)
+	assert.Equal(t, []Upstream{getRunningConfig().Configs[1337].getUpstream("second")}, getRunningConfig().Configs[1337].defaultRoute.upstreams)
+	assert.Contains(t, currentConfigString, `"disabled": true`)
+	assert.Contains(t, currentConfigString, `"_upstreams": "kept as written"`)
+
+	code, resp = doAdminRequest(http.MethodPost, "/chains/1337/upstreams/second/disable", "secret", "")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, LastEnabledUpstreamError.Error(), resp["error"])
+
+	code, _ = doAdminRequest(http.MethodPost, "/chains/1337/upstreams/unknown/disable", "secret", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// a rebuild keeps the upstream disabled
+	code, resp = doAdminRequest(http.MethodPut, "/chains/1337/strategy", "secret", `{"strategy": "WEIGHTED"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "WEIGHTED", resp["strategy"])
+	assert.IsType(t, &WeightedProxy{}, getRunningConfig().Configs[1337].Strategy)
+	assert.Equal(t, "disabled", adminUpstreamStates(resp)[firstName])
+
+	code, resp = doAdminRequest(http.MethodPost, "/chains/1337/upstreams/"+firstName+"/enable", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "enabled", adminUpstreamStates(resp)[firstName])
+	assert.Len(t, getRunningConfig().Configs[1337].defaultRoute.upstreams, 2)
+
+	// a refused strategy keeps the running config
+	running := getRunningConfig()
+	code, _ = doAdminRequest(http.MethodPut, "/chains/1337/strategy", "secret", `{"strategy": "NAIVE"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, running, getRunningConfig())
+
+	code, resp = doAdminRequest(http.MethodPost, "/chains/1337/upstreams", "secret", fmt.Sprintf(`{"url": "%s", "name": "third", "weight": 2}`, second.URL))
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Len(t, adminUpstreamStates(resp), 3)
+
+	code, _ = doAdminRequest(http.MethodPost, "/chains/1337/upstreams", "secret", fmt.Sprintf(`{"url": "%s", "name": "third"}`, second.URL))
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, resp = doAdminRequest(http.MethodDelete, "/chains/1337/upstreams/third", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]string{firstName: "enabled", "second": "enabled"}, adminUpstreamStates(resp))
+
+	code, _ = doAdminRequest(http.MethodPost, "/chains/1337/healthcheck", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestAdminServerWriteConfig(t *testing.T) {
+	upstream := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return "ok"
+	})
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	defer func(old string) { configPath = old }(configPath)
+	configPath = path
+
+	defer closeTestConfig()
+	configLocker.Lock()
+	err = applyConfig(context.Background(), []byte(fmt.Sprintf(`{
+		"admin": {"listen": "127.0.0.1:0", "token": "secret", "writeConfig": true},
+		"1337": {"upstreams": [{"url": "%s", "name": "first"}, {"url": "%s", "name": "second"}], "strategy": "FALLBACK"}
+	}`, upstream.URL, upstream.URL)))
+	configLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is written when the change is refused
+	code, _ := doAdminRequest(http.MethodPut, "/chains/1337/strategy", "secret", `{"strategy": "UNKNOWN"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, err = ioutil.ReadFile(path)
+	assert.NotNil(t, err)
+
+	code, _ = doAdminRequest(http.MethodPost, "/chains/1337/upstreams/second/disable", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	bts, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, currentConfigString, string(bts))
+	assert.Equal(t, currentFileString, string(bts))
+
+	// the written file builds the same config
+	config := NewConfig()
+	assert.Nil(t, json.Unmarshal(bts, config))
+	assert.Equal(t, "FALLBACK", (*config)[1337].Strategy)
+	assert.False(t, (*config)[1337].Upstreams[0].Disabled)
+	assert.True(t, (*config)[1337].Upstreams[1].Disabled)
+
+	globalConfig := NewGlobalConfig()
+	assert.Nil(t, json.Unmarshal(bts, globalConfig))
+	assert.True(t, globalConfig.Admin.WriteConfig)
+
+	// the running chain is left as it was when the file can't be written
+	assert.Nil(t, os.Remove(path))
+	assert.Nil(t, os.Mkdir(path, 0755))
+	written := currentConfigString
+
+	code, _ = doAdminRequest(http.MethodPost, "/chains/1337/upstreams/second/enable", "secret", "")
+	assert.NotEqual(t, http.StatusOK, code)
+	assert.True(t, getRunningConfig().Configs[1337].getUpstream("second").getInfo().disabled)
+	assert.Len(t, getRunningConfig().Configs[1337].defaultRoute.upstreams, 1)
+
+	code, _ = doAdminRequest(http.MethodPut, "/chains/1337/strategy", "secret", `{"strategy": "NAIVE"}`)
+	assert.NotEqual(t, http.StatusOK, code)
+	assert.IsType(t, &FallbackProxy{}, getRunningConfig().Configs[1337].Strategy)
+	assert.Equal(t, written, currentConfigString)
+}
+
+func TestBuildRunningConfigDisabledUpstreams(t *testing.T) {
+	upstream := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return "ok"
+	})
+	defer upstream.Close()
+
+	defer closeTestConfig()
+	build := func(upstreams string) error {
+		config := NewConfig()
+		if err := json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {"upstreams": %s, "strategy": "FALLBACK"}}`, upstreams)), config); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := BuildRunningConfigFromConfig(context.Background(), config)
+		return err
+	}
+
+	// the strategy counts the disabled upstreams, they can be enabled later
+	assert.Nil(t, build(fmt.Sprintf(`[{"url": "%s", "name": "a"}, {"url": "%s", "name": "b", "disabled": true}]`, upstream.URL, upstream.URL)))
+	assert.Len(t, getRunningConfig().Configs[1337].Upstreams, 2)
+	assert.Len(t, getRunningConfig().Configs[1337].defaultRoute.upstreams, 1)
+
+	assert.NotNil(t, build(fmt.Sprintf(`[{"url": "%s", "name": "a", "disabled": true}, {"url": "%s", "name": "b", "disabled": true}]`, upstream.URL, upstream.URL)))
+}
+
+func TestAdminServerRebuildsOneChain(t *testing.T) {
+	upstream := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return "ok"
+	})
+	defer upstream.Close()
+
+	defer closeTestConfig()
+	configLocker.Lock()
+	err := applyConfig(context.Background(), []byte(fmt.Sprintf(`{
+		"admin": {"listen": "127.0.0.1:0", "token": "secret"},
+		"1337": {"upstreams": [{"url": "%s", "name": "first"}, {"url": "%s", "name": "second"}, {"url": "%s", "name": "third"}], "strategy": "FALLBACK"},
+		"1338": {"upstreams": [{"url": "%s", "name": "other"}], "strategy": "NAIVE"}
+	}`, upstream.URL, upstream.URL, upstream.URL, upstream.URL)))
+	configLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	running := getRunningConfig()
+	chain := running.Configs[1337]
+	other := running.Configs[1338]
+	first := chain.getUpstream("first")
+	second := chain.getUpstream("second")
+
+	code, _ := doAdminRequest(http.MethodPut, "/chains/1337/strategy", "secret", `{"strategy": "WEIGHTED"}`)
+	assert.Equal(t, http.StatusOK, code)
+
+	// the chain is replaced, its upstreams keep their state and the other chain keeps running
+	assert.NotEqual(t, chain, getRunningConfig().Configs[1337])
+	assert.True(t, first == getRunningConfig().Configs[1337].getUpstream("first"))
+	assert.True(t, second == getRunningConfig().Configs[1337].getUpstream("second"))
+	assert.True(t, other == getRunningConfig().Configs[1338])
+	assert.NotNil(t, chain.ctx.Err())
+	assert.Nil(t, other.ctx.Err())
+
+	code, _ = doAdminRequest(http.MethodDelete, "/chains/1337/upstreams/second", "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, first == getRunningConfig().Configs[1337].getUpstream("first"))
+	assert.Nil(t, getRunningConfig().Configs[1337].getUpstream("second"))
+	assert.NotNil(t, second.(*HttpUpstream).ctx.Err())
+	assert.Nil(t, running.ctx.Err())
+}
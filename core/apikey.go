@@ -0,0 +1,166 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+const ApiKeyHeader = "X-Api-Key"
+
+var UnauthorizedError = fmt.Errorf("invalid or missing api key")
+var DeniedChain = fmt.Errorf("not allowed chain")
+
+// ApiKeyConfig limits a key on top of the chain's own limitation,
+// an empty list means no extra limit.
+type ApiKeyConfig struct {
+	Key               string   `json:"key"`
+	Name              string   `json:"name"`
+	AllowedChains     []uint64 `json:"allowedChains"`
+	AllowedMethods    []string `json:"allowedMethods"`
+	ContractWhitelist []string `json:"contractWhitelist"`
+
+	// RateLimit overrides the perKey limit of the global rate limit
+	RateLimit *TokenBucketConfig `json:"rateLimit"`
+}
+
+type RunningApiKey struct {
+	Name                 string
+	allowedChains        map[uint64]bool
+	allowedMethods       map[string]bool
+	allowedCallContracts map[string]bool
+	rateLimit            *TokenBucketConfig
+}
+
+func buildApiKeys(cfgs []ApiKeyConfig) (map[string]*RunningApiKey, error) {
+	keys := make(map[string]*RunningApiKey)
+
+	for i, cfg := range cfgs {
+		if cfg.Key == "" {
+			return nil, fmt.Errorf("api key %s: blank key", cfg.Name)
+		}
+
+		if _, exist := keys[cfg.Key]; exist {
+			return nil, fmt.Errorf("api key %s: duplicated key", cfg.Name)
+		}
+
+		key := &RunningApiKey{
+			Name:                 cfg.Name,
+			allowedChains:        make(map[uint64]bool),
+			allowedMethods:       make(map[string]bool),
+			allowedCallContracts: make(map[string]bool),
+		}
+
+		if key.Name == "" {
+			key.Name = fmt.Sprintf("key#%d", i)
+		}
+
+		if err := cfg.RateLimit.validate(); err != nil {
+			return nil, fmt.Errorf("api key %s: %v", key.Name, err)
+		}
+		key.rateLimit = cfg.RateLimit
+
+		for _, chainId := range cfg.AllowedChains {
+			key.allowedChains[chainId] = true
+		}
+
+		for _, method := range cfg.AllowedMethods {
+			key.allowedMethods[method] = true
+		}
+
+		for _, contract := range cfg.ContractWhitelist {
+			key.allowedCallContracts[strings.ToLower(contract)] = true
+		}
+
+		keys[cfg.Key] = key
+	}
+
+	return keys, nil
+}
+
+// getApiKeyFromRequest reads the key from the X-Api-Key header, or from the path segment
+// following the chain id, e.g. /http/{chainId}/{key}.
+func getApiKeyFromRequest(req *http.Request, pathKey string) string {
+	if key := req.Header.Get(ApiKeyHeader); key != "" {
+		return key
+	}
+
+	return pathKey
+}
+
+// authenticate returns nil for anonymous access when it is allowed.
+func authenticate(key string) (*RunningApiKey, error) {
+	if key == "" {
+		if getRunningConfig().allowAnonymous {
+			return nil, nil
+		}
+
+		return nil, UnauthorizedError
+	}
+
+	apiKey, ok := getRunningConfig().apiKeys[key]
+	if !ok {
+		return nil, UnauthorizedError
+	}
+
+	return apiKey, nil
+}
+
+func (k *RunningApiKey) isValidCall(chainId uint64, req *RequestData) error {
+	if len(k.allowedChains) > 0 && !k.allowedChains[chainId] {
+		return DeniedChain
+	}
+
+	if len(k.allowedMethods) > 0 && !k.allowedMethods[req.Method] {
+		return DeniedMethod
+	}
+
+	if len(k.allowedCallContracts) == 0 {
+		return nil
+	}
+
+	contracts, err := getCallContracts(req)
+	if err != nil {
+		return err
+	}
+
+	for _, contract := range contracts {
+		if !k.allowedCallContracts[strings.ToLower(contract)] {
+			return DeniedContract
+		}
+	}
+
+	return nil
+}
+
+// getCallContracts returns the contracts that a call or transaction runs.
+func getCallContracts(req *RequestData) (contracts []string, err error) {
+	defer func() {
+		if er := recover(); er != nil {
+			err = DecodeError
+		}
+	}()
+
+	switch req.Method {
+	case "eth_call", "eth_estimateGas", "eth_createAccessList":
+		to, _ := req.Params[0].(map[string]interface{})["to"].(string)
+		contracts = append(contracts, to)
+	case "eth_sendRawTransaction":
+		tx, err := decodeRawTransaction(req.Params[0].(string))
+		if err != nil {
+			return nil, err
+		}
+
+		contracts = append(contracts, hexutil.Encode(tx.To))
+
+		for _, address := range tx.Authorizations {
+			if !isZeroAddress(address) {
+				contracts = append(contracts, hexutil.Encode(address))
+			}
+		}
+	}
+
+	return contracts, nil
+}
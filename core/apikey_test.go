@@ -0,0 +1,118 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildApiKeys(t *testing.T) {
+	keys, err := buildApiKeys([]ApiKeyConfig{
+		{Key: "key1", Name: "team-a", AllowedChains: []uint64{1}},
+		{Key: "key2"},
+	})
+
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "team-a", keys["key1"].Name)
+	assert.Equal(t, true, keys["key1"].allowedChains[1])
+	assert.Equal(t, "key#1", keys["key2"].Name)
+
+	_, err = buildApiKeys([]ApiKeyConfig{{Key: "key1"}, {Key: "key1"}})
+	assert.NotEqual(t, nil, err)
+
+	_, err = buildApiKeys([]ApiKeyConfig{{Name: "blank"}})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestServeHTTPApiKey(t *testing.T) {
+	upstream := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return data.Method
+	})
+	defer upstream.Close()
+
+	var testConfigStr = fmt.Sprintf(`{
+		"apiKeys": [
+			{"key": "full", "name": "full"},
+			{"key": "limited", "name": "limited", "allowedChains": [1337], "allowedMethods": ["eth_call"],
+				"contractWhitelist": ["0x06898143df04616a8a8f9614deb3b99ba12b3096"]},
+			{"key": "other-chain", "allowedChains": [1]}
+		],
+		"1337": {
+			"upstreams": ["%s"],
+			"strategy": "NAIVE",
+			"methodLimitationEnabled": false
+		}
+	}`, upstream.URL)
+
+	config := NewConfig()
+	globalConfig := NewGlobalConfig()
+
+	err := json.Unmarshal([]byte(testConfigStr), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = json.Unmarshal([]byte(testConfigStr), globalConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfigs(context.Background(), config, globalConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &Server{}
+
+	post := func(path string, header string, body string) (*httptest.ResponseRecorder, *JsonRpcResponse) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if header != "" {
+			req.Header.Set(ApiKeyHeader, header)
+		}
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+
+		resp := &JsonRpcResponse{}
+		_ = json.Unmarshal(recorder.Body.Bytes(), resp)
+
+		return recorder, resp
+	}
+
+	blockNumber := `{"jsonrpc": "2.0", "id": 1, "method": "eth_blockNumber", "params": []}`
+	call := func(to string) string {
+		return fmt.Sprintf(`{"jsonrpc": "2.0", "id": 1, "method": "eth_call", "params": [{"to": "%s"}, "latest"]}`, to)
+	}
+
+	recorder, resp := post("/http/1337", "", blockNumber)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, UnauthorizedError.Error(), resp.Err.Message)
+
+	recorder, _ = post("/http/1337/unknown", "", blockNumber)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	_, resp = post("/http/1337", "full", blockNumber)
+	assert.Equal(t, "eth_blockNumber", resp.Result)
+
+	_, resp = post("/http/1337/full", "", blockNumber)
+	assert.Equal(t, "eth_blockNumber", resp.Result)
+
+	_, resp = post("/http/1337/limited", "", blockNumber)
+	assert.Equal(t, DeniedMethod.Error(), resp.Err.Message)
+
+	_, resp = post("/http/1337/limited", "", call("0x06898143df04616a8a8f9614deb3b99ba12b3096"))
+	assert.Equal(t, "eth_call", resp.Result)
+
+	_, resp = post("/http/1337/limited", "", call("0xc2c57336e01695D34F8012f6c0d250baB2Dd38Dd"))
+	assert.Equal(t, DeniedContract.Error(), resp.Err.Message)
+
+	_, resp = post("/http/1337/other-chain", "", blockNumber)
+	assert.Equal(t, DeniedChain.Error(), resp.Err.Message)
+}
@@ -0,0 +1,269 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var CircuitOpenError = fmt.Errorf("upstream circuit breaker is open")
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// CircuitBreakerConfig sets when the breakers of the upstreams of a chain trip and recover
+type CircuitBreakerConfig struct {
+	// Disabled turns the breakers off
+	Disabled bool `json:"disabled"`
+	// ConsecutiveFailures trips the breaker, default 5
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	// ErrorRate trips the breaker when the failed share of the last Window requests reaches it, default 0.5
+	ErrorRate float64 `json:"errorRate"`
+	// Window is how many recent requests the error rate is computed on, default 20
+	Window int `json:"window"`
+	// Cooldown is how long the breaker stays open before the trial requests, default 30s
+	Cooldown *Duration `json:"cooldown"`
+	// TrialRequests is how many requests are let through at once when half-open, default 1
+	TrialRequests int `json:"trialRequests"`
+}
+
+type circuitBreakerSettings struct {
+	consecutiveFailures int
+	errorRate           float64
+	window              int
+	cooldown            time.Duration
+	trialRequests       int
+}
+
+var defaultCircuitBreakerSettings = circuitBreakerSettings{
+	consecutiveFailures: 5,
+	errorRate:           0.5,
+	window:              20,
+	cooldown:            30 * time.Second,
+	trialRequests:       1,
+}
+
+// resolve applies the defaults, nil settings mean the breakers are disabled
+func (c *CircuitBreakerConfig) resolve() (*circuitBreakerSettings, error) {
+	settings := defaultCircuitBreakerSettings
+
+	if c == nil {
+		return &settings, nil
+	}
+
+	if c.Disabled {
+		return nil, nil
+	}
+
+	if c.ConsecutiveFailures < 0 || c.Window < 0 || c.TrialRequests < 0 || c.ErrorRate < 0 || c.ErrorRate > 1 {
+		return nil, fmt.Errorf("circuit breaker: invalid config %+v", *c)
+	}
+
+	if c.ConsecutiveFailures > 0 {
+		settings.consecutiveFailures = c.ConsecutiveFailures
+	}
+
+	if c.ErrorRate > 0 {
+		settings.errorRate = c.ErrorRate
+	}
+
+	if c.Window > 0 {
+		settings.window = c.Window
+	}
+
+	if c.Cooldown != nil {
+		if *c.Cooldown <= 0 {
+			return nil, fmt.Errorf("circuit breaker: cooldown should be positive")
+		}
+		settings.cooldown = time.Duration(*c.Cooldown)
+	}
+
+	if c.TrialRequests > 0 {
+		settings.trialRequests = c.TrialRequests
+	}
+
+	return &settings, nil
+}
+
+// circuitBreaker stops the requests to a failing upstream. It opens on consecutive
+// failures or on a high error rate, and after the cooldown lets trial requests
+// through in the half-open state, the first trial closes or opens it again.
+type circuitBreaker struct {
+	sync.Mutex
+	chainId  uint64
+	name     string
+	settings circuitBreakerSettings
+
+	state               string
+	openedAt            time.Time
+	consecutiveFailures int
+	outcomes            []bool // recent requests, true for failures
+	next                int
+	failures            int
+	trials              int
+}
+
+func newCircuitBreaker(chainId uint64, name string, settings *circuitBreakerSettings) *circuitBreaker {
+	if settings == nil {
+		return nil
+	}
+
+	return &circuitBreaker{
+		chainId:  chainId,
+		name:     name,
+		settings: *settings,
+		state:    breakerClosed,
+	}
+}
+
+// getState is the state shown in /health, an open breaker past its cooldown is half-open
+func (b *circuitBreaker) getState() string {
+	if b == nil {
+		return breakerClosed
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.settings.cooldown {
+		return breakerHalfOpen
+	}
+
+	return b.state
+}
+
+func (b *circuitBreaker) isOpen() bool {
+	return b.getState() == breakerOpen
+}
+
+// isAvailable tells the strategies which upstreams to prefer, the ones that passed
+// the health check and whose breaker is not open
+func isAvailable(up Upstream) bool {
+	return up.isAlive() && !up.getInfo().breaker.isOpen()
+}
+
+// allow is called before every request, a true return must be followed by record
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == breakerOpen {
+		if time.Since(b.openedAt) < b.settings.cooldown {
+			return false
+		}
+
+		b.setState(breakerHalfOpen)
+	}
+
+	if b.state == breakerHalfOpen {
+		if b.trials >= b.settings.trialRequests {
+			return false
+		}
+
+		b.trials++
+	}
+
+	return true
+}
+
+func (b *circuitBreaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.releaseTrial()
+
+		if failed {
+			b.trip()
+		} else {
+			b.reset()
+		}
+
+		return
+	}
+
+	if b.state == breakerOpen {
+		// the request was let through before the breaker opened
+		return
+	}
+
+	if failed {
+		b.consecutiveFailures++
+	} else {
+		b.consecutiveFailures = 0
+	}
+
+	if len(b.outcomes) < b.settings.window {
+		b.outcomes = append(b.outcomes, failed)
+	} else {
+		if b.outcomes[b.next] {
+			b.failures--
+		}
+		b.outcomes[b.next] = failed
+		b.next = (b.next + 1) % b.settings.window
+	}
+
+	if failed {
+		b.failures++
+	}
+
+	if b.consecutiveFailures >= b.settings.consecutiveFailures ||
+		(len(b.outcomes) == b.settings.window && float64(b.failures) >= b.settings.errorRate*float64(b.settings.window)) {
+		b.trip()
+	}
+}
+
+// release is called instead of record when the request was cancelled
+func (b *circuitBreaker) release() {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.releaseTrial()
+}
+
+func (b *circuitBreaker) releaseTrial() {
+	if b.trials > 0 {
+		b.trials--
+	}
+}
+
+func (b *circuitBreaker) trip() {
+	b.setState(breakerOpen)
+	b.openedAt = time.Now()
+	b.trials = 0
+	CountUpstream(b.chainId, b.name, "breaker_open")
+}
+
+func (b *circuitBreaker) reset() {
+	b.setState(breakerClosed)
+	b.consecutiveFailures = 0
+	b.outcomes = nil
+	b.next = 0
+	b.failures = 0
+	b.trials = 0
+}
+
+func (b *circuitBreaker) setState(state string) {
+	if b.state != state {
+		logrus.Warnf("upstream %s circuit breaker %s => %s", b.name, b.state, state)
+	}
+
+	b.state = state
+}
@@ -0,0 +1,221 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerConfig(t *testing.T) {
+	settings, err := (*CircuitBreakerConfig)(nil).resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, defaultCircuitBreakerSettings, *settings)
+
+	cooldown := Duration(time.Second)
+	settings, err = (&CircuitBreakerConfig{ConsecutiveFailures: 3, Cooldown: &cooldown}).resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, settings.consecutiveFailures)
+	assert.Equal(t, time.Second, settings.cooldown)
+	assert.Equal(t, defaultCircuitBreakerSettings.window, settings.window)
+
+	settings, err = (&CircuitBreakerConfig{Disabled: true}).resolve()
+	assert.Nil(t, err)
+	assert.Nil(t, settings)
+	assert.Nil(t, newCircuitBreaker(1337, "test", settings))
+
+	_, err = (&CircuitBreakerConfig{ErrorRate: 2}).resolve()
+	assert.NotNil(t, err)
+
+	cooldown = 0
+	_, err = (&CircuitBreakerConfig{Cooldown: &cooldown}).resolve()
+	assert.NotNil(t, err)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := newCircuitBreaker(1337, "test", &circuitBreakerSettings{
+		consecutiveFailures: 3,
+		errorRate:           0.5,
+		window:              10,
+		cooldown:            50 * time.Millisecond,
+		trialRequests:       1,
+	})
+
+	// consecutive failures
+	for i := 0; i < 3; i++ {
+		assert.True(t, breaker.allow())
+		breaker.record(true)
+	}
+
+	assert.Equal(t, breakerOpen, breaker.getState())
+	assert.False(t, breaker.allow())
+
+	// a single trial after the cooldown, a failed one opens it again
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, breakerHalfOpen, breaker.getState())
+	assert.True(t, breaker.allow())
+	assert.False(t, breaker.allow())
+	breaker.record(true)
+	assert.Equal(t, breakerOpen, breaker.getState())
+
+	// a cancelled trial doesn't count
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, breaker.allow())
+	breaker.release()
+	assert.True(t, breaker.allow())
+	breaker.record(false)
+	assert.Equal(t, breakerClosed, breaker.getState())
+
+	// error rate, never more than 2 failures in a row
+	for i := 0; i < 9; i++ {
+		assert.True(t, breaker.allow())
+		breaker.record(i%2 == 0)
+	}
+
+	assert.Equal(t, breakerClosed, breaker.getState())
+
+	// the window is full, half of it failed
+	breaker.record(false)
+	assert.Equal(t, breakerOpen, breaker.getState())
+
+	// disabled
+	var disabled *circuitBreaker
+	assert.True(t, disabled.allow())
+	disabled.record(true)
+	assert.Equal(t, breakerClosed, disabled.getState())
+}
+
+func TestCircuitBreakerProxyHandle(t *testing.T) {
+	var badHits int64
+	var recovered int32
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data RequestData
+		_ = json.NewDecoder(r.Body).Decode(&data)
+
+		if data.Method == "eth_gasPrice" {
+			atomic.AddInt64(&badHits, 1)
+
+			if atomic.LoadInt32(&recovered) == 0 {
+				w.WriteHeader(http.StatusBadGateway)
+				_, _ = w.Write([]byte("bad gateway"))
+				return
+			}
+		}
+
+		bts, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": data.ID, "result": "0x1"})
+		_, _ = w.Write(bts)
+	}))
+	defer bad.Close()
+
+	good := newTestUpstreamServer(func(data *RequestData) interface{} { return "0x1" })
+	defer good.Close()
+
+	config := NewConfig()
+	err := json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {
+		"upstreams": [{"url": "%s", "name": "bad"}, {"url": "%s", "name": "good"}],
+		"strategy": "BALANCING",
+		"circuitBreaker": {"consecutiveFailures": 2, "cooldown": "300ms"}
+	}}`, bad.URL, good.URL)), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Eventually(t, func() bool {
+		cfg := getRunningConfig().Configs[1337]
+		cfg.updateLocker.RLock()
+		defer cfg.updateLocker.RUnlock()
+
+		for _, up := range cfg.Upstreams {
+			if !up.isAlive() {
+				return false
+			}
+		}
+
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			req, err := newRequest(1337, []byte(`{"params": [], "method": "eth_gasPrice", "id": 1, "jsonrpc": "2.0"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = getRunningConfig().Configs[1337].handle(req)
+			assert.Nil(t, err)
+		}
+	}
+
+	breakerState := func() string {
+		invalidateHealthInfo()
+
+		for _, node := range getHealthInfo()[1337] {
+			if node.Name == "bad" {
+				return node.Breaker
+			}
+		}
+
+		return ""
+	}
+
+	// the breaker opens after 2 failures, then bad is skipped
+	send(20)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&badHits))
+	assert.Equal(t, breakerOpen, breakerState())
+
+	// the failed trial opens it again
+	time.Sleep(350 * time.Millisecond)
+	assert.Equal(t, breakerHalfOpen, breakerState())
+	send(10)
+	assert.Equal(t, int64(3), atomic.LoadInt64(&badHits))
+	assert.Equal(t, breakerOpen, breakerState())
+
+	// the successful trial closes it
+	atomic.StoreInt32(&recovered, 1)
+	time.Sleep(350 * time.Millisecond)
+	send(10)
+	assert.Equal(t, breakerClosed, breakerState())
+	assert.True(t, atomic.LoadInt64(&badHits) > 5)
+}
+
+func TestCircuitBreakerNodeErrors(t *testing.T) {
+	info := &upstreamInfo{name: "node", breaker: newCircuitBreaker(1337, "node", &circuitBreakerSettings{
+		consecutiveFailures: 3,
+		errorRate:           1,
+		window:              10,
+		cooldown:            time.Minute,
+		trialRequests:       1,
+	})}
+	req := &Request{chainId: 1337, data: &RequestData{Method: "eth_call"}}
+
+	answer := func(bts string) func(*Request) ([]byte, error) {
+		return func(*Request) ([]byte, error) {
+			return []byte(bts), nil
+		}
+	}
+
+	// reverts are answers
+	for i := 0; i < 3; i++ {
+		_, _ = info.serve(req, answer(`{"jsonrpc": "2.0", "id": 1, "error": {"code": 3, "message": "execution reverted"}}`))
+	}
+	assert.Equal(t, breakerClosed, info.breaker.getState())
+
+	// an upstream answering node errors only is taken out
+	for i := 0; i < 3; i++ {
+		_, _ = info.serve(req, answer(`{"jsonrpc": "2.0", "id": 1, "error": {"code": -32603, "message": "header not found"}}`))
+	}
+	assert.Equal(t, breakerOpen, info.breaker.getState())
+}
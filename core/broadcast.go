@@ -0,0 +1,187 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/sirupsen/logrus"
+)
+
+// alreadyKnownErrors are the messages of nodes which have the transaction already
+var alreadyKnownErrors = []string{"already known", "known transaction", "already imported", "already exists"}
+
+// BroadcastConfig sends eth_sendRawTransaction to many upstreams in parallel
+type BroadcastConfig struct {
+	Enabled bool `json:"enabled"`
+	// Upstreams are the names of the upstreams getting the transactions, default the healthy upstreams of their route
+	Upstreams []string `json:"upstreams"`
+}
+
+// BroadcastProxy sends the transactions to all the upstreams, and returns the
+// transaction hash once one of them accepted it.
+type BroadcastProxy struct {
+	names map[string]bool // empty means all upstreams
+}
+
+func newBroadcastProxy(cfg *BroadcastConfig, upstreamNames map[string]bool) (*BroadcastProxy, error) {
+	p := &BroadcastProxy{names: make(map[string]bool)}
+
+	for _, name := range cfg.Upstreams {
+		if !upstreamNames[name] {
+			return nil, fmt.Errorf("broadcast: unknown upstream %s", name)
+		}
+		p.names[name] = true
+	}
+
+	logrus.Infof("broadcasting transactions of chain")
+
+	return p, nil
+}
+
+// pick returns the configured upstreams, or the alive ones of the route of the transactions,
+// the disabled ones are left out. The caller holds the updateLocker of the chain.
+func (p *BroadcastProxy) pick(cfg *RunningChainConfig, method string) []Upstream {
+	var picked []Upstream
+
+	routed := cfg.route(method).upstreams
+
+	if len(p.names) > 0 {
+		for _, up := range withoutDisabled(cfg.Upstreams) {
+			if p.names[up.getName()] {
+				picked = append(picked, up)
+			}
+		}
+	} else {
+		for _, up := range routed {
+			if isAvailable(up) {
+				picked = append(picked, up)
+			}
+		}
+	}
+
+	if len(picked) == 0 {
+		return routed
+	}
+
+	return picked
+}
+
+func isAlreadyKnownError(message string) bool {
+	message = strings.ToLower(message)
+
+	for _, known := range alreadyKnownErrors {
+		if strings.Contains(message, known) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type broadcastResult struct {
+	bts      []byte
+	accepted bool
+	err      error
+}
+
+func (p *BroadcastProxy) handle(req *Request) ([]byte, error) {
+	if len(req.data.Params) == 0 {
+		return nil, InvalidRequestError
+	}
+
+	data, ok := req.data.Params[0].(string)
+	if !ok {
+		return nil, InvalidRequestError
+	}
+
+	tx, err := decodeRawTransaction(data)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := tx.hash()
+	if err != nil {
+		return nil, err
+	}
+
+	txHash := hexutil.Encode(hash)
+
+	cfg := req.getChain()
+
+	cfg.updateLocker.RLock()
+	upstreams := p.pick(cfg, req.data.Method)
+	cfg.updateLocker.RUnlock()
+
+	results := make(chan *broadcastResult, len(upstreams))
+
+	for _, upstream := range upstreams {
+		go func(upstream Upstream) {
+			res := &broadcastResult{}
+
+			defer func() {
+				if err := recover(); err != nil {
+					res.err = fmt.Errorf("%v", err)
+				}
+
+				p.log(req, txHash, upstream, res)
+				results <- res
+			}()
+
+			res.bts, res.err = upstream.handle(req)
+			if res.err != nil {
+				return
+			}
+
+			var resp jsonRpcRawResponse
+			if res.err = json.Unmarshal(res.bts, &resp); res.err != nil {
+				return
+			}
+
+			res.accepted = resp.Error == nil || isAlreadyKnownError(resp.Error.Message)
+		}(upstream)
+	}
+
+	var rejected []byte
+
+	for i := 0; i < len(upstreams); i++ {
+		res := <-results
+
+		if res.accepted {
+			// the nodes which knew the transaction don't return the hash
+			return getResultResponseBytes(req.data.ID, json.RawMessage(strconv.Quote(txHash))), nil
+		}
+
+		if res.err == nil && rejected == nil {
+			rejected = res.bts
+		}
+	}
+
+	// every upstream refused it, e.g. for a too low nonce
+	if rejected != nil {
+		return rejected, nil
+	}
+
+	return nil, AllUpstreamsFailedError
+}
+
+// log records the answer of every upstream for auditing
+func (p *BroadcastProxy) log(req *Request, txHash string, upstream Upstream, res *broadcastResult) {
+	entry := logrus.WithFields(logrus.Fields{
+		"chain_id": req.chainId,
+		"tx_hash":  txHash,
+		"upstream": upstream.getName(),
+		"accepted": res.accepted,
+	})
+
+	switch {
+	case res.err != nil:
+		entry.Warnf("transaction %s broadcast to %s failed: %v", txHash, upstream.getName(), res.err)
+	case res.accepted:
+		entry.Infof("transaction %s accepted by %s", txHash, upstream.getName())
+	default:
+		entry.Warnf("transaction %s rejected by %s: %s", txHash, upstream.getName(), string(res.bts))
+	}
+}
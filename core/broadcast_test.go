@@ -0,0 +1,119 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestBroadcastUpstream answers eth_sendRawTransaction with the error message, or the hash if it's empty
+func newTestBroadcastUpstream(message string, delay time.Duration, hits *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data RequestData
+		_ = json.NewDecoder(r.Body).Decode(&data)
+
+		res := map[string]interface{}{"jsonrpc": "2.0", "id": data.ID, "result": "0x1"}
+
+		if data.Method == "eth_sendRawTransaction" {
+			atomic.AddInt64(hits, 1)
+			time.Sleep(delay)
+
+			if message != "" {
+				delete(res, "result")
+				res["error"] = map[string]interface{}{"code": -32000, "message": message}
+			} else {
+				res["result"] = hexutil.Encode(crypto.Keccak256(hexutil.MustDecode(data.Params[0].(string))))
+			}
+		}
+
+		bts, _ := json.Marshal(res)
+		_, _ = w.Write(bts)
+	}))
+}
+
+func TestBroadcastProxyHandle(t *testing.T) {
+	var acceptedHits, knownHits, rejectedHits int64
+
+	accepted := newTestBroadcastUpstream("", 200*time.Millisecond, &acceptedHits)
+	defer accepted.Close()
+	known := newTestBroadcastUpstream("already known", 0, &knownHits)
+	defer known.Close()
+	rejected := newTestBroadcastUpstream("nonce too low", 0, &rejectedHits)
+	defer rejected.Close()
+
+	defer closeTestConfig()
+	build := func(broadcast string, routes string) {
+		config := NewConfig()
+		err := json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {
+			"upstreams": [{"url": "%s", "name": "accepted"}, {"url": "%s", "name": "known"}, {"url": "%s", "name": "rejected"}],
+			"strategy": "FALLBACK",
+			"broadcast": %s,
+			"routes": %s
+		}}`, accepted.URL, known.URL, rejected.URL, broadcast, routes)), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = BuildRunningConfigFromConfig(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	raw := encodeTestTransaction(t, DynamicFeeTxType, testTxTo)
+	txHash := hexutil.Encode(crypto.Keccak256(hexutil.MustDecode(raw)))
+
+	send := func() []byte {
+		req, err := newRequest(1337, []byte(fmt.Sprintf(`{"params": ["%s"], "method": "eth_sendRawTransaction", "id": 7, "jsonrpc": "2.0"}`, raw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bts, err := getRunningConfig().Configs[1337].handle(req)
+		assert.Nil(t, err)
+		return bts
+	}
+
+	build(`{"enabled": true, "upstreams": ["accepted", "known", "rejected"]}`, `[]`)
+
+	// the node knowing the transaction answers first
+	startTime := time.Now()
+	bts := send()
+	assert.True(t, time.Since(startTime) < 200*time.Millisecond)
+	assert.JSONEq(t, fmt.Sprintf(`{"jsonrpc": "2.0", "id": 7, "result": "%s"}`, txHash), string(bts))
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&acceptedHits) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&knownHits))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&rejectedHits))
+
+	// the rejection is returned when no upstream accepts it
+	build(`{"enabled": true, "upstreams": ["rejected"]}`, `[]`)
+	assert.Contains(t, string(send()), "nonce too low")
+	assert.Equal(t, int64(1), atomic.LoadInt64(&acceptedHits))
+
+	// without a list the transactions go to the upstreams of their route, dedicated ones are left out
+	build(`{"enabled": true}`, `[{"methods": ["trace_*"], "upstreams": ["rejected"], "strategy": "NAIVE", "dedicated": true}]`)
+	assert.Contains(t, string(send()), txHash)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&rejectedHits))
+
+	build(`{"enabled": true}`, `[{"methods": ["eth_sendRawTransaction"], "upstreams": ["known"], "strategy": "NAIVE"}]`)
+	assert.Contains(t, string(send()), txHash)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&rejectedHits))
+	assert.Equal(t, int64(3), atomic.LoadInt64(&knownHits))
+
+	config := NewConfig()
+	_ = json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {"upstreams": ["%s", "%s"], "strategy": "FALLBACK", "broadcast": {"enabled": true, "upstreams": ["unknown"]}}}`, accepted.URL, known.URL)), config)
+	_, err := BuildRunningConfigFromConfig(context.Background(), config)
+	assert.NotNil(t, err)
+}
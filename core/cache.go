@@ -1,9 +1,12 @@
 package core
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	lru "github.com/hashicorp/golang-lru"
 )
 
@@ -33,3 +36,302 @@ type ReqCacheKey struct {
 	ChainId uint64 `json:"chainId"`
 	RequestData
 }
+
+const defaultFinalityDepth = 64
+
+// the position of the block param, for the methods reading a block or the state at a block
+var cacheBlockParamIndex = map[string]int{
+	"eth_getBlockByNumber":                    0,
+	"eth_getBlockReceipts":                    0,
+	"eth_getBlockTransactionCountByNumber":    0,
+	"eth_getUncleByBlockNumberAndIndex":       0,
+	"eth_getUncleCountByBlockNumber":          0,
+	"eth_getTransactionByBlockNumberAndIndex": 0,
+	"eth_call":                1,
+	"eth_getBalance":          1,
+	"eth_getCode":             1,
+	"eth_getTransactionCount": 1,
+	"eth_getStorageAt":        2,
+	"eth_getProof":            2,
+}
+
+// blocks looked up by hash never change
+var cacheBlockHashMethods = map[string]bool{
+	"eth_getBlockByHash":                    true,
+	"eth_getBlockTransactionCountByHash":    true,
+	"eth_getUncleByBlockHashAndIndex":       true,
+	"eth_getUncleCountByBlockHash":          true,
+	"eth_getTransactionByBlockHashAndIndex": true,
+}
+
+// transactions looked up by hash can be moved to another block by a reorg,
+// so they are cached once their block is finalized
+var cacheTxHashMethods = map[string]bool{
+	"eth_getTransactionByHash":  true,
+	"eth_getTransactionReceipt": true,
+}
+
+var cacheConstantMethods = map[string]bool{
+	"eth_chainId": true,
+	"net_version": true,
+}
+
+// finalizedBlock is the highest block which is deeper than the finality depth,
+// ok is false while the chain head is unknown.
+type finalizedBlock struct {
+	number uint64
+	ok     bool
+}
+
+func newFinalizedBlock(head uint64, depth uint64) finalizedBlock {
+	if head == 0 || head < depth {
+		return finalizedBlock{}
+	}
+
+	return finalizedBlock{number: head - depth, ok: true}
+}
+
+func (f finalizedBlock) includes(number uint64) bool {
+	return f.ok && number <= f.number
+}
+
+// isFinalizedBlockParam accepts a block number, a block tag, a block hash, or an
+// EIP-1898 object of blockHash or blockNumber.
+func (f finalizedBlock) isFinalizedBlockParam(param interface{}) bool {
+	switch v := param.(type) {
+	case string:
+		if v == "earliest" {
+			return true
+		}
+
+		if len(v) == 66 {
+			// block hash
+			return true
+		}
+
+		n, err := hexutil.DecodeUint64(v)
+		if err != nil {
+			// latest, pending, safe, finalized and bad params
+			return false
+		}
+
+		return f.includes(n)
+	case float64:
+		return v >= 0 && f.includes(uint64(v))
+	case map[string]interface{}:
+		if _, ok := v["blockHash"]; ok {
+			return true
+		}
+
+		if number, ok := v["blockNumber"]; ok {
+			return f.isFinalizedBlockParam(number)
+		}
+	}
+
+	return false
+}
+
+// isCacheableRequest reports whether the response of the request may be cached.
+// checkResult is true when the result has to be checked by isCacheableResult as well.
+func isCacheableRequest(data *RequestData, finalized finalizedBlock) (cacheable bool, checkResult bool) {
+	method := data.Method
+
+	if cacheConstantMethods[method] {
+		return true, false
+	}
+
+	if cacheBlockHashMethods[method] {
+		return true, false
+	}
+
+	if cacheTxHashMethods[method] {
+		return true, true
+	}
+
+	if index, ok := cacheBlockParamIndex[method]; ok {
+		if len(data.Params) <= index {
+			// the block param defaults to latest
+			return false, false
+		}
+
+		return finalized.isFinalizedBlockParam(data.Params[index]), false
+	}
+
+	if method == "eth_getLogs" {
+		if len(data.Params) == 0 {
+			return false, false
+		}
+
+		filter, ok := data.Params[0].(map[string]interface{})
+		if !ok {
+			return false, false
+		}
+
+		if _, ok := filter["blockHash"]; ok {
+			return true, false
+		}
+
+		// fromBlock and toBlock default to latest
+		fromBlock, ok1 := filter["fromBlock"]
+		toBlock, ok2 := filter["toBlock"]
+
+		return ok1 && ok2 && finalized.isFinalizedBlockParam(fromBlock) && finalized.isFinalizedBlockParam(toBlock), false
+	}
+
+	return false, false
+}
+
+// isCacheableResult rejects null results, and transactions which are pending or
+// in blocks not finalized yet.
+func isCacheableResult(result json.RawMessage, finalized finalizedBlock, checkResult bool) bool {
+	if len(result) == 0 || string(result) == "null" {
+		return false
+	}
+
+	if !checkResult {
+		return true
+	}
+
+	var tx struct {
+		BlockNumber *string `json:"blockNumber"`
+	}
+
+	if err := json.Unmarshal(result, &tx); err != nil || tx.BlockNumber == nil {
+		return false
+	}
+
+	n, err := hexutil.DecodeUint64(*tx.BlockNumber)
+
+	return err == nil && finalized.includes(n)
+}
+
+// cacheEntry is a cached result with the blocks it comes from, so that it can be
+// evicted when the blocks are orphaned by a reorg.
+type cacheEntry struct {
+	result    json.RawMessage
+	chainId   uint64
+	hasBlocks bool
+	fromBlock uint64
+	toBlock   uint64
+	blockHash string
+}
+
+func parseBlockNumberParam(param interface{}) (uint64, bool) {
+	switch v := param.(type) {
+	case string:
+		if v == "earliest" {
+			return 0, true
+		}
+
+		n, err := hexutil.DecodeUint64(v)
+		return n, err == nil
+	case float64:
+		return uint64(v), v >= 0
+	case map[string]interface{}:
+		return parseBlockNumberParam(v["blockNumber"])
+	}
+
+	return 0, false
+}
+
+func parseBlockHashParam(param interface{}) string {
+	switch v := param.(type) {
+	case string:
+		if len(v) == 66 {
+			return strings.ToLower(v)
+		}
+	case map[string]interface{}:
+		if hash, ok := v["blockHash"].(string); ok {
+			return strings.ToLower(hash)
+		}
+	}
+
+	return ""
+}
+
+func newCacheEntry(chainId uint64, data *RequestData, result json.RawMessage) *cacheEntry {
+	entry := &cacheEntry{result: result, chainId: chainId}
+
+	setBlock := func(number uint64, ok bool) {
+		entry.hasBlocks = ok
+		entry.fromBlock = number
+		entry.toBlock = number
+	}
+
+	if index, ok := cacheBlockParamIndex[data.Method]; ok && len(data.Params) > index {
+		setBlock(parseBlockNumberParam(data.Params[index]))
+		entry.blockHash = parseBlockHashParam(data.Params[index])
+	}
+
+	if data.Method == "eth_getLogs" && len(data.Params) > 0 {
+		if filter, ok := data.Params[0].(map[string]interface{}); ok {
+			from, ok1 := parseBlockNumberParam(filter["fromBlock"])
+			to, ok2 := parseBlockNumberParam(filter["toBlock"])
+
+			entry.hasBlocks = ok1 && ok2
+			entry.fromBlock, entry.toBlock = from, to
+			entry.blockHash = parseBlockHashParam(filter)
+		}
+	}
+
+	if cacheBlockHashMethods[data.Method] || cacheTxHashMethods[data.Method] {
+		// block results have number and hash, transaction results have blockNumber and blockHash
+		var res struct {
+			Number      *string `json:"number"`
+			Hash        *string `json:"hash"`
+			BlockNumber *string `json:"blockNumber"`
+			BlockHash   *string `json:"blockHash"`
+		}
+		_ = json.Unmarshal(result, &res)
+
+		number, hash := res.BlockNumber, res.BlockHash
+		if cacheBlockHashMethods[data.Method] && res.Number != nil {
+			number, hash = res.Number, res.Hash
+		}
+
+		if number != nil {
+			setBlock(parseBlockNumberParam(*number))
+		}
+
+		if hash != nil {
+			entry.blockHash = strings.ToLower(*hash)
+		} else if len(data.Params) > 0 && cacheBlockHashMethods[data.Method] {
+			entry.blockHash = parseBlockHashParam(data.Params[0])
+		}
+	}
+
+	return entry
+}
+
+func (e *cacheEntry) isInBlocks(numbers map[uint64]string) bool {
+	for number, hash := range numbers {
+		if e.blockHash != "" && e.blockHash == hash {
+			return true
+		}
+
+		if e.hasBlocks && e.fromBlock <= number && number <= e.toBlock {
+			return true
+		}
+	}
+
+	return false
+}
+
+// evictBlocks removes the cached results of the orphaned blocks, height => hash
+func evictBlocks(chainId uint64, orphans map[uint64]string) int {
+	evicted := 0
+
+	for _, key := range getCache().Keys() {
+		val, ok := getCache().Peek(key)
+		if !ok {
+			continue
+		}
+
+		if entry, ok := val.(*cacheEntry); ok && entry.chainId == chainId && entry.isInBlocks(orphans) {
+			getCache().Remove(key)
+			evicted++
+		}
+	}
+
+	return evicted
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsCacheableRequest(t *testing.T) {
+	finalized := newFinalizedBlock(1064, 64)
+	assert.Equal(t, finalizedBlock{number: 1000, ok: true}, finalized)
+
+	blockHash := "0x" + strings.Repeat("ab", 32)
+
+	cases := []struct {
+		body        string
+		cacheable   bool
+		checkResult bool
+	}{
+		{`{"method": "eth_chainId", "params": []}`, true, false},
+		{`{"method": "eth_blockNumber", "params": []}`, false, false},
+		{`{"method": "eth_gasPrice", "params": []}`, false, false},
+		{`{"method": "eth_getBlockByHash", "params": ["` + blockHash + `", false]}`, true, false},
+		{`{"method": "eth_getTransactionReceipt", "params": ["` + blockHash + `"]}`, true, true},
+		{`{"method": "eth_getBlockByNumber", "params": ["0x3e8", false]}`, true, false},
+		{`{"method": "eth_getBlockByNumber", "params": ["0x3e9", false]}`, false, false},
+		{`{"method": "eth_getBlockByNumber", "params": ["latest", false]}`, false, false},
+		{`{"method": "eth_getBlockByNumber", "params": ["finalized", false]}`, false, false},
+		{`{"method": "eth_getBlockByNumber", "params": ["earliest", false]}`, true, false},
+		{`{"method": "eth_getBalance", "params": ["0x01"]}`, false, false},
+		{`{"method": "eth_getBalance", "params": ["0x01", "pending"]}`, false, false},
+		{`{"method": "eth_call", "params": [{"to": "0x01"}, "0x10"]}`, true, false},
+		{`{"method": "eth_call", "params": [{"to": "0x01"}, {"blockHash": "` + blockHash + `"}]}`, true, false},
+		{`{"method": "eth_call", "params": [{"to": "0x01"}, {"blockNumber": "0x1000"}]}`, false, false},
+		{`{"method": "eth_getStorageAt", "params": ["0x01", "0x0", "0x10"]}`, true, false},
+		{`{"method": "eth_getLogs", "params": [{"fromBlock": "0x1", "toBlock": "0x10"}]}`, true, false},
+		{`{"method": "eth_getLogs", "params": [{"fromBlock": "0x1"}]}`, false, false},
+		{`{"method": "eth_getLogs", "params": [{"fromBlock": "0x1", "toBlock": "0x3e9"}]}`, false, false},
+		{`{"method": "eth_getLogs", "params": [{"blockHash": "` + blockHash + `"}]}`, true, false},
+	}
+
+	for _, c := range cases {
+		var data RequestData
+		if err := json.Unmarshal([]byte(c.body), &data); err != nil {
+			t.Fatal(err)
+		}
+
+		cacheable, checkResult := isCacheableRequest(&data, finalized)
+		assert.Equal(t, c.cacheable, cacheable, c.body)
+		assert.Equal(t, c.checkResult, checkResult, c.body)
+	}
+
+	// nothing is finalized while the head is unknown
+	var data RequestData
+	_ = json.Unmarshal([]byte(`{"method": "eth_getBlockByNumber", "params": ["0x0", false]}`), &data)
+
+	cacheable, _ := isCacheableRequest(&data, newFinalizedBlock(0, 64))
+	assert.Equal(t, false, cacheable)
+}
+
+func TestIsCacheableResult(t *testing.T) {
+	finalized := newFinalizedBlock(1064, 64)
+
+	assert.Equal(t, false, isCacheableResult(json.RawMessage(`null`), finalized, false))
+	assert.Equal(t, true, isCacheableResult(json.RawMessage(`[]`), finalized, false))
+	assert.Equal(t, true, isCacheableResult(json.RawMessage(`{"blockNumber": "0x3e8"}`), finalized, true))
+	assert.Equal(t, false, isCacheableResult(json.RawMessage(`{"blockNumber": "0x3e9"}`), finalized, true))
+	// pending transaction
+	assert.Equal(t, false, isCacheableResult(json.RawMessage(`{"blockNumber": null}`), finalized, true))
+}
+
+func TestHandleRequestCache(t *testing.T) {
+	var calls int64
+
+	// the cache is global, the entries of an earlier run are dropped
+	getCache().Purge()
+
+	upstream := newTestUpstreamServer(func(data *RequestData) interface{} {
+		switch data.Method {
+		case "eth_getBlockByHash":
+			atomic.AddInt64(&calls, 1)
+			return map[string]interface{}{"number": "0x1"}
+		case "eth_getTransactionByHash":
+			atomic.AddInt64(&calls, 1)
+			return nil
+		}
+		return "0x1"
+	})
+	defer upstream.Close()
+
+	defer closeTestConfig()
+	initTestConfigWithUpstream(t, upstream.URL, "")
+	getRunningConfig().Configs[1337].MethodLimitationEnabled = false
+
+	server := &Server{}
+
+	post := func(id int, method string) string {
+		body := fmt.Sprintf(`{"jsonrpc": "2.0", "id": %d, "method": "%s", "params": ["0x%s"]}`, id, method, strings.Repeat("cd", 32))
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/http/1337", strings.NewReader(body)))
+
+		return recorder.Body.String()
+	}
+
+	assert.Equal(t, `{"id":1,"jsonrpc":"2.0","result":{"number":"0x1"}}`, post(1, "eth_getBlockByHash"))
+	// the cached response carries the id of the new request
+	assert.Equal(t, `{"id":2,"jsonrpc":"2.0","result":{"number":"0x1"}}`, post(2, "eth_getBlockByHash"))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&calls))
+
+	// null results are not cached
+	post(3, "eth_getTransactionByHash")
+	post(4, "eth_getTransactionByHash")
+	assert.Equal(t, int64(3), atomic.LoadInt64(&calls))
+}
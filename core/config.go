@@ -5,9 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -20,59 +24,167 @@ func NewConfig() *Config {
 	return &c
 }
 
+// UnmarshalJSON only takes the chain id keys, the other keys belong to GlobalConfig.
+func (c *Config) UnmarshalJSON(bts []byte) error {
+	var raw map[string]json.RawMessage
+
+	if err := json.Unmarshal(bts, &raw); err != nil {
+		return err
+	}
+
+	if *c == nil {
+		*c = make(map[uint64]ChainConfig)
+	}
+
+	for key, value := range raw {
+		chainId, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		var chainCfg ChainConfig
+		if err := json.Unmarshal(value, &chainCfg); err != nil {
+			return fmt.Errorf("chain %d: %v", chainId, err)
+		}
+
+		(*c)[chainId] = chainCfg
+	}
+
+	return nil
+}
+
+// GlobalConfig holds the gateway wide settings, they live next to the chain ids in the same file.
+type GlobalConfig struct {
+	ApiKeys        []ApiKeyConfig   `json:"apiKeys"`
+	AllowAnonymous bool             `json:"allowAnonymous"`
+	RateLimit      *RateLimitConfig `json:"rateLimit"`
+	Timeouts       *TimeoutsConfig  `json:"timeouts"`
+	Admin          *AdminConfig     `json:"admin"`
+}
+
+func NewGlobalConfig() *GlobalConfig {
+	return &GlobalConfig{}
+}
+
 type ChainConfig struct {
-	Upstreams               []string `json:"upstreams"`
-	OldTrieUrl              string   `json:"oldTrieUrl"`
-	Strategy                string   `json:"strategy"`
-	MethodLimitationEnabled bool     `json:"methodLimitationEnabled"`
-	AllowedMethods          []string `json:"allowedMethods"`
-	ContractWhitelist       []string `json:"contractWhitelist"`
+	Upstreams               []UpstreamConfig `json:"upstreams"`
+	OldTrieUrl              string           `json:"oldTrieUrl"`
+	Strategy                string           `json:"strategy"`
+	MethodLimitationEnabled bool             `json:"methodLimitationEnabled"`
+	AllowedMethods          []string         `json:"allowedMethods"`
+	ContractWhitelist       []string         `json:"contractWhitelist"`
+	AllowContractCreation   bool             `json:"allowContractCreation"`
+	SenderWhitelist         []string         `json:"senderWhitelist"`
+	MaxBatchSize            int              `json:"maxBatchSize"`
+
+	// FinalityDepth is how many blocks behind the head a block is treated as final and cacheable
+	FinalityDepth uint64 `json:"finalityDepth"`
+
+	// RateLimit overrides the perChain limit of the global rate limit
+	RateLimit *TokenBucketConfig `json:"rateLimit"`
+
+	// Timeouts overrides the global timeouts
+	Timeouts *TimeoutsConfig `json:"timeouts"`
+
+	// Quorum sets how many upstreams must agree for the QUORUM strategy
+	Quorum *QuorumConfig `json:"quorum"`
+
+	// Hedge sets when the HEDGED strategy sends the second request
+	Hedge *HedgeConfig `json:"hedge"`
+
+	// Routes send some methods to their own upstreams, the first matching route is used
+	Routes []RouteConfig `json:"routes"`
+
+	// Broadcast sends eth_sendRawTransaction to many upstreams
+	Broadcast *BroadcastConfig `json:"broadcast"`
+
+	// CircuitBreaker sets when the upstreams are skipped after failures, enabled by default
+	CircuitBreaker *CircuitBreakerConfig `json:"circuitBreaker"`
+
+	// MaxLag sets how far behind the head an upstream can be before it's left out
+	MaxLag *MaxLagConfig `json:"maxLag"`
+
+	// Failover sets which upstream errors are retried on the other upstreams
+	Failover *FailoverConfig `json:"failover"`
+
+	// Consistency keeps the block height seen by a client monotonic and its reads after its writes
+	Consistency *ConsistencyConfig `json:"consistency"`
 }
 
+const defaultMaxBatchSize = 100
+
 type RunningConfig struct {
-	ctx     context.Context
-	stop    context.CancelFunc
-	Configs map[uint64]*RunningChainConfig
+	ctx        context.Context
+	stop       context.CancelFunc
+	goroutines *sync.WaitGroup // the background goroutines, see runInBackground
+	Configs    map[uint64]*RunningChainConfig
+
+	apiKeys        map[string]*RunningApiKey
+	allowAnonymous bool
+	rateLimiter    *rateLimiter
+	timeouts       *Timeouts
+	admin          *AdminConfig // nil when the admin api is disabled
 }
 
 func (c *RunningConfig) close() {
 	c.stop()
 }
 
+// healthCheck checks every chain on its own interval, the chains are spread by healthCheckChainDelay
 func (c *RunningConfig) healthCheck() {
-	go func() {
-		// TODO: Configurable
-		ticker := time.NewTicker(2 * time.Minute)
+	logrus.Infof("healthCheck started...")
 
-		check := func() {
-			logrus.Infof("healthCheck started...")
-			for _, cfg := range c.Configs {
-				cfg.healthCheck()
+	i := 0
+	for _, cfg := range c.Configs {
+		cfg.startHealthCheck(time.Duration(i) * c.timeouts.HealthCheckChainDelay)
+		i++
+	}
+}
 
-				time.Sleep(10 * time.Second)
-			}
-		}
+type goroutinesKey struct{}
+
+// runInBackground counts the goroutine in the WaitGroup of the running config of the context,
+// so that a closed config can be waited for
+func runInBackground(ctx context.Context, f func()) {
+	goroutines, _ := ctx.Value(goroutinesKey{}).(*sync.WaitGroup)
+	if goroutines == nil {
+		go f()
+		return
+	}
 
-		check()
+	goroutines.Add(1)
 
-		for {
-			select {
-			case <-ticker.C:
-				check()
-			case <-c.ctx.Done():
-				logrus.Infof("healthCheck closed...")
-				return
-			}
-		}
+	go func() {
+		defer goroutines.Done()
+		f()
 	}()
 }
 
 type RunningChainConfig struct {
+	ctx    context.Context
+	stop   context.CancelFunc
+	config ChainConfig // the config the chain is built from
+
 	Upstreams               []Upstream
 	Strategy                IStrategy
+	strategyName            string
 	MethodLimitationEnabled bool
+	MaxBatchSize            int
+	finalityDepth           uint64
 	allowedMethods          map[string]bool
 	allowedCallContracts    map[string]bool
+	allowContractCreation   bool
+	allowedSenders          map[string]bool
+	rateLimit               *TokenBucketConfig
+	subscriptions           *subscriptionManager
+	timeouts                *Timeouts
+	routes                  []*runningRoute
+	defaultRoute            *runningRoute
+	broadcast               *BroadcastProxy
+	maxLag                  *MaxLagConfig
+	headHistory             headHistory
+	sessions                *sessionStore // nil when the consistency is disabled
+	failover                *failoverPolicy
 
 	updateLocker sync.RWMutex
 }
@@ -81,6 +193,11 @@ func (c *RunningChainConfig) healthCheck() {
 	c.updateLocker.Lock()
 	defer c.updateLocker.Unlock()
 
+	// a rebuilt chain hands its upstreams over to the new one
+	if c.ctx != nil && c.ctx.Err() != nil {
+		return
+	}
+
 	var wg sync.WaitGroup
 	for _, up := range c.Upstreams {
 		wg.Add(1)
@@ -93,148 +210,685 @@ func (c *RunningChainConfig) healthCheck() {
 
 	wg.Wait()
 
-	sort.Slice(c.Upstreams, func(i, j int) bool {
-		return c.Upstreams[i].getLatancy() <= c.Upstreams[j].getLatancy()
+	for _, up := range c.Upstreams {
+		up.getInfo().raiseKnownBlock(up.getBlockNumber())
+	}
+
+	c.updateLag()
+
+	// lower tiers first, then the faster ones
+	sort.SliceStable(c.Upstreams, func(i, j int) bool {
+		if c.Upstreams[i].getInfo().tier != c.Upstreams[j].getInfo().tier {
+			return c.Upstreams[i].getInfo().tier < c.Upstreams[j].getInfo().tier
+		}
+
+		return c.Upstreams[i].getLatancy() < c.Upstreams[j].getLatancy()
 	})
 
+	c.updateRoutes()
+
 	logrus.Infof("running chain upstreams updated")
 }
 
-func NewRunningConfig(ctx context.Context, cfg *Config) (*RunningConfig, error) {
-	oldOne := currentRunningConfig
-	if oldOne != nil {
-		defer oldOne.close()
+func (c *RunningChainConfig) startHealthCheck(delay time.Duration) {
+	runInBackground(c.ctx, func() {
+		c.runHealthCheck(c.ctx, delay)
+	})
+
+	if c.maxLag != nil {
+		runInBackground(c.ctx, func() {
+			c.runLagCheck(c.ctx)
+		})
+	}
+}
+
+func (c *RunningChainConfig) runHealthCheck(ctx context.Context, delay time.Duration) {
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return
+	}
+
+	ticker := time.NewTicker(c.timeouts.HealthCheckInterval)
+	defer ticker.Stop()
+
+	c.healthCheck()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.healthCheck()
+		case <-ctx.Done():
+			logrus.Infof("healthCheck closed...")
+			return
+		}
 	}
+}
+
+// getFinalizedBlock is based on the highest block of the alive upstreams
+func (c *RunningChainConfig) getFinalizedBlock() finalizedBlock {
+	c.updateLocker.RLock()
+	defer c.updateLocker.RUnlock()
+
+	return newFinalizedBlock(c.highestBlock(), c.finalityDepth)
+}
 
-	ctx, stop := context.WithCancel(ctx)
+func NewRunningConfig(ctx context.Context, cfg *Config, globalCfg *GlobalConfig) (_ *RunningConfig, err error) {
+	goroutines := &sync.WaitGroup{}
+	ctx, stop := context.WithCancel(context.WithValue(ctx, goroutinesKey{}, goroutines))
 
 	rcfg := &RunningConfig{
-		ctx:     ctx,
-		stop:    stop,
-		Configs: make(map[uint64]*RunningChainConfig),
+		ctx:        ctx,
+		stop:       stop,
+		goroutines: goroutines,
+		Configs:    make(map[uint64]*RunningChainConfig),
+	}
+
+	// keep the old one running if the new one is broken
+	defer func() {
+		if err != nil {
+			rcfg.close()
+		}
+	}()
+
+	rcfg.apiKeys, err = buildApiKeys(globalCfg.ApiKeys)
+	if err != nil {
+		return nil, err
+	}
+	rcfg.allowAnonymous = globalCfg.AllowAnonymous || len(rcfg.apiKeys) == 0
+
+	if globalCfg.RateLimit != nil {
+		rcfg.rateLimiter, err = newRateLimiter(ctx, *globalCfg.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		// the buckets of keys and chains are taken by the same weights
+		for _, key := range rcfg.apiKeys {
+			if err := globalCfg.RateLimit.validateBurst(key.rateLimit); err != nil {
+				return nil, fmt.Errorf("api key %s: %v", key.Name, err)
+			}
+		}
 	}
-	currentRunningConfig = rcfg
+
+	rcfg.timeouts, err = globalCfg.Timeouts.merge(&defaultTimeouts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := globalCfg.Admin.validate(); err != nil {
+		return nil, err
+	}
+	rcfg.admin = globalCfg.Admin
 
 	for chainId, chainCfg := range *cfg {
-		rcfg.Configs[chainId] = &RunningChainConfig{}
+		if err := globalCfg.RateLimit.validateBurst(chainCfg.RateLimit); err != nil {
+			return nil, fmt.Errorf("chain %d: %v", chainId, err)
+		}
+
+		rcfg.Configs[chainId], err = newRunningChainConfig(ctx, chainId, chainCfg, rcfg.timeouts, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		rcfg.Configs[chainId].updateLocker.Lock()
-		defer rcfg.Configs[chainId].updateLocker.Unlock()
+	for _, chain := range rcfg.Configs {
+		if chain.subscriptions != nil {
+			chain.subscriptions.listen()
+		}
+	}
+
+	// the config is published once it's complete
+	oldOne := setRunningConfig(rcfg)
+	if oldOne != nil {
+		oldOne.close()
+	}
+
+	rcfg.healthCheck()
+
+	return rcfg, nil
+}
 
-		for _, url := range chainCfg.Upstreams {
+// newRunningChainConfig builds a chain. The upstreams of the old chain whose config didn't change are kept
+// with their state, the caller holds the updateLocker of the old chain and stops the upstreams left out.
+func newRunningChainConfig(ctx context.Context, chainId uint64, chainCfg ChainConfig, timeouts *Timeouts, old *RunningChainConfig) (_ *RunningChainConfig, err error) {
+	c := &RunningChainConfig{config: chainCfg}
+	c.ctx, c.stop = context.WithCancel(ctx)
 
-			var primaryUrl string
-			var oldTrieUrl string
+	c.updateLocker.Lock()
+	defer c.updateLocker.Unlock()
+
+	// kept upstreams => their disabled flag in the old chain
+	kept := make(map[Upstream]bool)
+
+	defer func() {
+		if err == nil {
+			return
+		}
 
-			if chainCfg.OldTrieUrl != "" {
-				primaryUrl = url
-				oldTrieUrl = chainCfg.OldTrieUrl
+		c.stop()
+
+		for _, up := range c.Upstreams {
+			if disabled, ok := kept[up]; ok {
+				up.getInfo().disabled = disabled
 			} else {
-				primaryUrl = url
-				oldTrieUrl = url
+				up.getInfo().close()
 			}
+		}
+	}()
+
+	// upstreams read the timeouts of their chain
+	if err := validateChainTimeouts(chainCfg.Timeouts); err != nil {
+		return nil, fmt.Errorf("chain %d: %v", chainId, err)
+	}
+
+	c.timeouts, err = chainCfg.Timeouts.merge(timeouts)
+	if err != nil {
+		return nil, fmt.Errorf("chain %d: %v", chainId, err)
+	}
+
+	breakerSettings, err := chainCfg.CircuitBreaker.resolve()
+	if err != nil {
+		return nil, fmt.Errorf("chain %d: %v", chainId, err)
+	}
+
+	if err := chainCfg.MaxLag.validate(); err != nil {
+		return nil, fmt.Errorf("chain %d: %v", chainId, err)
+	}
+	c.maxLag = chainCfg.MaxLag
+
+	c.failover, err = newFailoverPolicy(chainCfg.Failover)
+	if err != nil {
+		return nil, fmt.Errorf("chain %d: %v", chainId, err)
+	}
 
-			rcfg.Configs[chainId].Upstreams = append(rcfg.Configs[chainId].Upstreams, newUpstream(ctx, chainId, primaryUrl, oldTrieUrl))
+	if old != nil && reflect.DeepEqual(old.config.Consistency, chainCfg.Consistency) {
+		c.sessions = old.sessions
+	} else {
+		c.sessions, err = newSessionStore(chainCfg.Consistency)
+		if err != nil {
+			return nil, fmt.Errorf("chain %d: %v", chainId, err)
 		}
+	}
+
+	if _, err := url.Parse(chainCfg.OldTrieUrl); err != nil {
+		return nil, fmt.Errorf("chain %d: invalid oldTrieUrl", chainId)
+	}
+
+	names := make(map[string]bool)
 
-		if len(rcfg.Configs[chainId].Upstreams) == 0 {
-			return nil, fmt.Errorf("need upstreams")
+	for i, upstreamCfg := range chainCfg.Upstreams {
+		if err := upstreamCfg.validate(); err != nil {
+			return nil, fmt.Errorf("chain %d: %v", chainId, err)
 		}
 
-		go rcfg.healthCheck()
+		upstreamCfg.Name, err = upstreamName(upstreamCfg, i, names)
+		if err != nil {
+			return nil, fmt.Errorf("chain %d: %v", chainId, err)
+		}
 
-		switch chainCfg.Strategy {
-		case "NAIVE":
-			if len(rcfg.Configs[chainId].Upstreams) > 1 {
-				panic(fmt.Errorf("naive proxy strategy require exact 1 upstream"))
-			}
-			rcfg.Configs[chainId].Strategy = newNaiveProxy()
-		case "RACE":
-			if len(rcfg.Configs[chainId].Upstreams) < 2 {
-				panic(fmt.Errorf("race proxy strategy require more than 1 upstream"))
-			}
-			rcfg.Configs[chainId].Strategy = newRaceProxy()
-		case "FALLBACK":
-			if len(rcfg.Configs[chainId].Upstreams) < 2 {
-				panic(fmt.Errorf("fallback proxy strategy require more than 1 upstream"))
-			}
-			rcfg.Configs[chainId].Strategy = newFallbackProxy()
-		case "BALANCING":
-			if len(rcfg.Configs[chainId].Upstreams) < 2 {
-				panic(fmt.Errorf("loadbalance proxy strategy require more than 1 upstream"))
-			}
-			rcfg.Configs[chainId].Strategy = newLoadBalanceFallbackProxy()
-		default:
-			return nil, fmt.Errorf("blank of unsupported strategy: %s", chainCfg.Strategy)
+		names[upstreamCfg.Name] = true
+
+		if up := old.keptUpstream(upstreamCfg, &chainCfg); up != nil {
+			kept[up] = up.getInfo().disabled
+			up.getInfo().disabled = upstreamCfg.Disabled
+			c.Upstreams = append(c.Upstreams, up)
+			continue
 		}
 
-		(rcfg.Configs[chainId]).MethodLimitationEnabled = chainCfg.MethodLimitationEnabled
+		var oldTrieUrl string
 
-		rcfg.Configs[chainId].allowedMethods = make(map[string]bool)
-		for i := 0; i < len(chainCfg.AllowedMethods); i++ {
-			rcfg.Configs[chainId].allowedMethods[chainCfg.AllowedMethods[i]] = true
+		if chainCfg.OldTrieUrl != "" {
+			oldTrieUrl = chainCfg.OldTrieUrl
+		} else {
+			oldTrieUrl = upstreamCfg.Url
 		}
 
-		rcfg.Configs[chainId].allowedCallContracts = make(map[string]bool)
-		for i := 0; i < len(chainCfg.ContractWhitelist); i++ {
-			rcfg.Configs[chainId].allowedCallContracts[strings.ToLower(chainCfg.ContractWhitelist[i])] = true
+		// upstreams outlive their chain when it's rebuilt
+		upstreamCtx, stopUpstream := context.WithCancel(ctx)
+
+		upstream := newUpstream(upstreamCtx, chainId, upstreamCfg, oldTrieUrl)
+		upstream.getInfo().breaker = newCircuitBreaker(chainId, upstreamCfg.Name, breakerSettings)
+		upstream.getInfo().stop = stopUpstream
+
+		c.Upstreams = append(c.Upstreams, upstream)
+	}
+
+	if len(c.Upstreams) == 0 {
+		return nil, fmt.Errorf("need upstreams")
+	}
+
+	if old != nil {
+		c.headHistory.samples = append([]headSample(nil), old.headHistory.samples...)
+	}
+
+	c.subscriptions = newSubscriptionManager(c.ctx, chainId, c)
+
+	c.defaultRoute = &runningRoute{}
+
+	for _, routeCfg := range chainCfg.Routes {
+		route, err := newRunningRoute(routeCfg, names)
+		if err != nil {
+			return nil, fmt.Errorf("chain %d: %v", chainId, err)
 		}
+		c.routes = append(c.routes, route)
 	}
 
-	return rcfg, nil
+	c.updateRoutes()
+
+	if c.defaultRoute.size == 0 {
+		return nil, fmt.Errorf("chain %d: every upstream is dedicated to a route", chainId)
+	}
+
+	if c.emptyRoute() != nil {
+		return nil, fmt.Errorf("chain %d: every upstream of a route is disabled", chainId)
+	}
+
+	// disabled upstreams count, they can be enabled later
+	c.Strategy, err = newStrategy(chainCfg.Strategy, c.defaultRoute.size, &chainCfg)
+	if err != nil {
+		return nil, fmt.Errorf("chain %d default route: %v", chainId, err)
+	}
+	c.strategyName = chainCfg.Strategy
+	c.defaultRoute.strategy = c.Strategy
+
+	for i, route := range c.routes {
+		strategy := chainCfg.Routes[i].Strategy
+		if strategy == "" {
+			strategy = chainCfg.Strategy
+		}
+
+		route.strategy, err = newStrategy(strategy, route.size, &chainCfg)
+		if err != nil {
+			return nil, fmt.Errorf("chain %d route of %v: %v", chainId, chainCfg.Routes[i].Methods, err)
+		}
+	}
+
+	if chainCfg.Broadcast != nil && chainCfg.Broadcast.Enabled {
+		c.broadcast, err = newBroadcastProxy(chainCfg.Broadcast, names)
+		if err != nil {
+			return nil, fmt.Errorf("chain %d: %v", chainId, err)
+		}
+	}
+
+	c.MethodLimitationEnabled = chainCfg.MethodLimitationEnabled
+
+	c.MaxBatchSize = chainCfg.MaxBatchSize
+	if c.MaxBatchSize <= 0 {
+		c.MaxBatchSize = defaultMaxBatchSize
+	}
+
+	c.finalityDepth = chainCfg.FinalityDepth
+	if c.finalityDepth == 0 {
+		c.finalityDepth = defaultFinalityDepth
+	}
+
+	c.allowedMethods = make(map[string]bool)
+	for i := 0; i < len(chainCfg.AllowedMethods); i++ {
+		c.allowedMethods[chainCfg.AllowedMethods[i]] = true
+	}
+
+	c.allowedCallContracts = make(map[string]bool)
+	for i := 0; i < len(chainCfg.ContractWhitelist); i++ {
+		c.allowedCallContracts[strings.ToLower(chainCfg.ContractWhitelist[i])] = true
+	}
+
+	c.allowContractCreation = chainCfg.AllowContractCreation
+
+	if err := chainCfg.RateLimit.validate(); err != nil {
+		return nil, err
+	}
+	c.rateLimit = chainCfg.RateLimit
+
+	c.allowedSenders = make(map[string]bool)
+	for i := 0; i < len(chainCfg.SenderWhitelist); i++ {
+		c.allowedSenders[strings.ToLower(chainCfg.SenderWhitelist[i])] = true
+	}
+
+	tracker := newReorgTracker(chainId, c.finalityDepth)
+	runInBackground(c.ctx, func() {
+		tracker.run(c.ctx, c.timeouts.ReorgCheckInterval)
+	})
+
+	return c, nil
+}
+
+// keptUpstream finds the upstream of the old chain which can be kept for the upstream config,
+// only its disabled flag may change
+func (c *RunningChainConfig) keptUpstream(cfg UpstreamConfig, chainCfg *ChainConfig) Upstream {
+	if c == nil || c.config.OldTrieUrl != chainCfg.OldTrieUrl || !reflect.DeepEqual(c.config.CircuitBreaker, chainCfg.CircuitBreaker) {
+		return nil
+	}
+
+	up := c.getUpstream(cfg.Name)
+	if up == nil {
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for i, oldCfg := range c.config.Upstreams {
+		oldCfg.Name, _ = upstreamName(oldCfg, i, names)
+		names[oldCfg.Name] = true
+
+		if oldCfg.Name != cfg.Name {
+			continue
+		}
+
+		oldCfg.Disabled = cfg.Disabled
+		if reflect.DeepEqual(oldCfg, cfg) {
+			return up
+		}
+	}
+
+	return nil
+}
+
+// rebuildChain replaces a chain by one built from the config, the other chains and the upstreams
+// whose config didn't change keep running with their state
+func (c *RunningConfig) rebuildChain(chainId uint64, chainCfg ChainConfig) error {
+	old, ok := c.Configs[chainId]
+	if !ok {
+		return ChainNotSupportedError
+	}
+
+	// the old chain is frozen while its upstreams move to the new one
+	old.updateLocker.Lock()
+	defer old.updateLocker.Unlock()
+
+	chain, err := newRunningChainConfig(c.ctx, chainId, chainCfg, c.timeouts, old)
+	if err != nil {
+		return err
+	}
+
+	next := *c
+	next.Configs = make(map[uint64]*RunningChainConfig, len(c.Configs))
+	for id, cfg := range c.Configs {
+		next.Configs[id] = cfg
+	}
+	next.Configs[chainId] = chain
+
+	setRunningConfig(&next)
+
+	if chain.subscriptions != nil {
+		if old.subscriptions != nil {
+			chain.subscriptions.takeOver(old.subscriptions)
+		}
+		chain.subscriptions.listen()
+	}
+
+	old.stop()
+
+	kept := make(map[Upstream]bool)
+	for _, up := range chain.Upstreams {
+		kept[up] = true
+	}
+
+	for _, up := range old.Upstreams {
+		if !kept[up] {
+			up.getInfo().close()
+		}
+	}
+
+	chain.startHealthCheck(0)
+
+	return nil
+}
+
+// describe lists the chains of the config with their upstream names, for the logs.
+// The urls and headers are left out, they may hold api keys.
+func (c *Config) describe() string {
+	var chainIds []uint64
+	for chainId := range *c {
+		chainIds = append(chainIds, chainId)
+	}
+	sort.Slice(chainIds, func(i, j int) bool { return chainIds[i] < chainIds[j] })
+
+	var chains []string
+	for _, chainId := range chainIds {
+		chainCfg := (*c)[chainId]
+		chains = append(chains, fmt.Sprintf("chain %d: %s", chainId, chainCfg.describe()))
+	}
+
+	return strings.Join(chains, "; ")
+}
+
+// describe is the strategy and the upstream names of the chain
+func (c *ChainConfig) describe() string {
+	var names []string
+	taken := make(map[string]bool)
+
+	for i, upstreamCfg := range c.Upstreams {
+		name, err := upstreamName(upstreamCfg, i, taken)
+		if err != nil {
+			name = fmt.Sprintf("#%d", i)
+		}
+
+		taken[name] = true
+		names = append(names, name)
+	}
+
+	return fmt.Sprintf("%s [%s]", c.Strategy, strings.Join(names, ", "))
+}
+
+// upstreamName names an unnamed upstream by its host, upstreams of the same host are told apart by their index
+func upstreamName(cfg UpstreamConfig, i int, names map[string]bool) (string, error) {
+	if cfg.Name != "" {
+		if names[cfg.Name] {
+			return "", fmt.Errorf("duplicated upstream name %s", cfg.Name)
+		}
+
+		return cfg.Name, nil
+	}
+
+	u, err := url.Parse(cfg.Url)
+	if err != nil {
+		return "", err
+	}
+
+	if names[u.Host] {
+		return fmt.Sprintf("%s#%d", u.Host, i), nil
+	}
+
+	return u.Host, nil
+}
+
+// newStrategy creates the named strategy for a pool of upstreams
+func newStrategy(name string, upstreams int, chainCfg *ChainConfig) (IStrategy, error) {
+	switch name {
+	case "NAIVE":
+		if upstreams > 1 {
+			return nil, fmt.Errorf("naive proxy strategy require exact 1 upstream")
+		}
+		return newNaiveProxy(), nil
+	case "RACE":
+		if upstreams < 2 {
+			return nil, fmt.Errorf("race proxy strategy require more than 1 upstream")
+		}
+		return newRaceProxy(), nil
+	case "FALLBACK":
+		if upstreams < 2 {
+			return nil, fmt.Errorf("fallback proxy strategy require more than 1 upstream")
+		}
+		return newFallbackProxy(), nil
+	case "BALANCING":
+		if upstreams < 2 {
+			return nil, fmt.Errorf("loadbalance proxy strategy require more than 1 upstream")
+		}
+		return newLoadBalanceFallbackProxy(), nil
+	case "WEIGHTED":
+		if upstreams < 2 {
+			return nil, fmt.Errorf("weighted proxy strategy require more than 1 upstream")
+		}
+		return newWeightedProxy(), nil
+	case "LEAST_LATENCY":
+		if upstreams < 2 {
+			return nil, fmt.Errorf("least latency proxy strategy require more than 1 upstream")
+		}
+		return newLeastLatencyProxy(), nil
+	case "P2C":
+		if upstreams < 2 {
+			return nil, fmt.Errorf("p2c proxy strategy require more than 1 upstream")
+		}
+		return newP2CProxy(), nil
+	case "QUORUM":
+		size, threshold, err := chainCfg.Quorum.resolve(upstreams)
+		if err != nil {
+			return nil, err
+		}
+		return newQuorumProxy(size, threshold), nil
+	case "HEDGED":
+		if upstreams < 2 {
+			return nil, fmt.Errorf("hedged proxy strategy require more than 1 upstream")
+		}
+		if err := chainCfg.Hedge.validate(); err != nil {
+			return nil, err
+		}
+		return newHedgedProxy(chainCfg.Hedge), nil
+	default:
+		return nil, fmt.Errorf("blank of unsupported strategy: %s", name)
+	}
 }
 
+var configPath = "./config.json"
+
+// configLocker serializes the reloads of the config file and the changes of the admin api
+var configLocker sync.Mutex
+
+// currentConfigString is the json document of the running config before the env expansion, the admin api edits it
 var currentConfigString string = ""
-var currentRunningConfig *RunningConfig
 
-func LoadConfig(ctx context.Context, quit chan bool) {
+// currentFileString is the last content read from the config file, the file is reloaded when it changes
+var currentFileString string = ""
+
+var runningConfig atomic.Value
+
+// getRunningConfig returns the running config, requests read it once and keep it to the end
+func getRunningConfig() *RunningConfig {
+	c, _ := runningConfig.Load().(*RunningConfig)
+	return c
+}
+
+// setRunningConfig publishes a running config and returns the replaced one
+func setRunningConfig(c *RunningConfig) *RunningConfig {
+	old := getRunningConfig()
+	runningConfig.Store(c)
+	return old
+}
+
+// applyConfig builds the running config from a json config document, the caller holds the configLocker
+func applyConfig(ctx context.Context, bts []byte) error {
+	config := NewConfig()
+	globalConfig := NewGlobalConfig()
+
+	expanded, err := expandEnv(bts)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(expanded, config); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(expanded, globalConfig); err != nil {
+		return err
+	}
+
+	logrus.Infof("reloading config: %s", config.describe())
+
+	if _, err := BuildRunningConfigFromConfigs(ctx, config, globalConfig); err != nil {
+		return err
+	}
+
+	currentConfigString = string(bts)
+
+	return nil
+}
+
+// applyChainConfig rebuilds one chain from a json config document, the other chains keep running.
+// The caller holds the configLocker.
+func applyChainConfig(chainId uint64, bts []byte) error {
+	expanded, err := expandEnv(bts)
+	if err != nil {
+		return err
+	}
+
+	config := NewConfig()
+	if err := json.Unmarshal(expanded, config); err != nil {
+		return err
+	}
+
+	chainCfg, ok := (*config)[chainId]
+	if !ok {
+		return ChainNotSupportedError
+	}
+
+	logrus.Infof("rebuilding chain %d: %s", chainId, chainCfg.describe())
+
+	if err := getRunningConfig().rebuildChain(chainId, chainCfg); err != nil {
+		return err
+	}
+
+	currentConfigString = string(bts)
+
+	return nil
+}
+
+// LoadConfig loads the config file of the path and reloads it when it changes, the format is chosen by its extension
+func LoadConfig(ctx context.Context, path string, quit chan bool) {
+	format, err := getConfigFormat(path)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	configPath = path
+
 	reloadConfig := func() {
-		config := NewConfig()
+		configLocker.Lock()
+		defer configLocker.Unlock()
 
 		logrus.Debugf("load config from file")
-		bts, err := ioutil.ReadFile("./config.json")
+		bts, err := ioutil.ReadFile(configPath)
 
 		if err != nil {
 			if currentConfigString == "" {
 				logrus.Fatal(err)
 			} else {
 				logrus.Warn("hot read config err, use old config")
+				return
 			}
 		}
 
-		if currentConfigString == "" || string(bts) != currentConfigString {
-			_ = json.Unmarshal(bts, config)
-
-			logrus.Infof("reloading config: %v", *config)
-			currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+		if currentConfigString == "" || string(bts) != currentFileString {
+			doc, err := decodeConfigFile(format, bts)
+			if err == nil {
+				err = applyConfig(ctx, doc)
+			}
 
 			if err != nil {
 				if currentConfigString == "" {
 					logrus.Fatal(err)
 				} else {
-					logrus.Warn("hot build config err, use old config")
-
+					logrus.Warnf("hot build config err, use old config: %v", err)
 				}
+			} else {
+				logrus.Infof("reloading running config: %v", getRunningConfig().Configs)
 			}
 
-			logrus.Infof("reloading running config: %v", currentRunningConfig.Configs)
-
-			currentConfigString = string(bts)
+			currentFileString = string(bts)
 		}
 	}
 
 	// loading on init.
 	reloadConfig()
 
-	ticker := time.NewTicker(3 * time.Second)
 	go func() {
 		for {
+			// the interval may be changed by the reloaded config
 			select {
-			case <-ticker.C:
+			case <-time.After(getGlobalTimeouts().ConfigPollInterval):
 				reloadConfig()
 			case <-quit:
 				logrus.Info("quit loop config")
-				ticker.Stop()
 				return
 			}
 		}
@@ -242,5 +896,9 @@ func LoadConfig(ctx context.Context, quit chan bool) {
 }
 
 func BuildRunningConfigFromConfig(parentContext context.Context, cfg *Config) (*RunningConfig, error) {
-	return NewRunningConfig(parentContext, cfg)
+	return NewRunningConfig(parentContext, cfg, NewGlobalConfig())
+}
+
+func BuildRunningConfigFromConfigs(parentContext context.Context, cfg *Config, globalCfg *GlobalConfig) (*RunningConfig, error) {
+	return NewRunningConfig(parentContext, cfg, globalCfg)
 }
@@ -38,12 +38,13 @@ func TestBuildRunningConfigFromConfigNAIVE(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	currentRunningConfig, err := BuildRunningConfigFromConfig(context.Background(), config)
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	currentRunningChainConfig := currentRunningConfig.Configs[1337]
+	currentRunningChainConfig := getRunningConfig().Configs[1337]
 
 	assert.Equal(t, true, currentRunningChainConfig.MethodLimitationEnabled)
 
@@ -74,7 +75,8 @@ func TestBuildRunningConfigFromConfigNAIVE(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	assert.Panics(t, func() { BuildRunningConfigFromConfig(context.Background(), config) })
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	assert.NotNil(t, err)
 }
 
 func TestBuildRunningConfigFromConfigRACE(t *testing.T) {
@@ -107,7 +109,8 @@ func TestBuildRunningConfigFromConfigRACE(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	currentRunningConfig, err := BuildRunningConfigFromConfig(context.Background(), config)
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -115,7 +118,7 @@ func TestBuildRunningConfigFromConfigRACE(t *testing.T) {
 
 	chainId := uint64(1337)
 
-	assert.Equal(t, true, currentRunningConfig.Configs[chainId].MethodLimitationEnabled)
+	assert.Equal(t, true, getRunningConfig().Configs[chainId].MethodLimitationEnabled)
 
 	var testConfigStr2 = `{
 		"1337": {
@@ -143,7 +146,8 @@ func TestBuildRunningConfigFromConfigRACE(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	assert.Panics(t, func() { BuildRunningConfigFromConfig(context.Background(), config) })
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	assert.NotNil(t, err)
 }
 
 func TestBuildRunningConfigFromConfigFALLBACK(t *testing.T) {
@@ -176,7 +180,8 @@ func TestBuildRunningConfigFromConfigFALLBACK(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	currentRunningConfig, err := BuildRunningConfigFromConfig(context.Background(), config)
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -184,7 +189,7 @@ func TestBuildRunningConfigFromConfigFALLBACK(t *testing.T) {
 
 	chainId := uint64(1337)
 
-	assert.Equal(t, true, currentRunningConfig.Configs[chainId].MethodLimitationEnabled)
+	assert.Equal(t, true, getRunningConfig().Configs[chainId].MethodLimitationEnabled)
 
 	var testConfigStr2 = `{
 		"1337": {
@@ -212,7 +217,8 @@ func TestBuildRunningConfigFromConfigFALLBACK(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	assert.Panics(t, func() { BuildRunningConfigFromConfig(context.Background(), config) })
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	assert.NotNil(t, err)
 }
 
 func TestBuildRunningConfigFromConfigOldTreeUrl(t *testing.T) {
@@ -250,12 +256,13 @@ func TestBuildRunningConfigFromConfigOldTreeUrl(t *testing.T) {
 
 	chainId := uint64(1337)
 
-	currentRunningConfig, err := BuildRunningConfigFromConfig(context.Background(), config)
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	assert.Equal(t, true, currentRunningConfig.Configs[chainId].MethodLimitationEnabled)
+	assert.Equal(t, true, getRunningConfig().Configs[chainId].MethodLimitationEnabled)
 
 	var testConfigStr2 = `{
 		"1337": {
@@ -293,6 +300,18 @@ func TestBuildRunningConfigFromConfigOldTreeUrl(t *testing.T) {
 	assert.Equal(t, "https://ropsten.infura.io/v3/83438c4dcf834ceb8944162688749707x", (*config)[chainId].OldTrieUrl)
 }
 
+// closeTestConfig stops the running config of a test and waits for its goroutines,
+// so that they don't outlive the test
+func closeTestConfig() {
+	c := getRunningConfig()
+	if c == nil {
+		return
+	}
+
+	c.close()
+	c.goroutines.Wait()
+}
+
 func initTestConfig(t *testing.T) {
 	var testConfigStr1 = `{
 		"1337":{
@@ -331,3 +350,110 @@ func initTestConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestConfigUnmarshalJSON(t *testing.T) {
+	var testConfigStr = `{
+		"apiKeys": [{"key": "key1", "name": "team-a"}],
+		"allowAnonymous": true,
+		"1337": {
+			"upstreams": ["https://ropsten.infura.io/v3/83438c4dcf834ceb8944162688749707"],
+			"strategy": "NAIVE"
+		}
+	}`
+
+	config := NewConfig()
+
+	err := json.Unmarshal([]byte(testConfigStr), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 1, len(*config))
+	assert.Equal(t, "NAIVE", (*config)[1337].Strategy)
+
+	globalConfig := NewGlobalConfig()
+
+	err = json.Unmarshal([]byte(testConfigStr), globalConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, true, globalConfig.AllowAnonymous)
+	assert.Equal(t, "team-a", globalConfig.ApiKeys[0].Name)
+
+	err = json.Unmarshal([]byte(`{"1337": {"upstreams": "not a list"}}`), config)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestConfigDescribe(t *testing.T) {
+	config := NewConfig()
+
+	err := json.Unmarshal([]byte(`{
+		"5": {"upstreams": [{"url": "https://node.example.com/v3/secret", "name": "main", "headers": {"Authorization": "Bearer secret"}}], "strategy": "NAIVE"},
+		"1": {"upstreams": ["https://node.example.com/v3/secret", "wss://node.example.com/ws/secret"], "strategy": "FALLBACK"}
+	}`), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the logs get the names only
+	assert.Equal(t, "chain 1: FALLBACK [node.example.com, node.example.com#1]; chain 5: NAIVE [main]", config.describe())
+}
+
+func TestNewRunningConfigKeepsOldOneOnError(t *testing.T) {
+	defer closeTestConfig()
+	initTestConfig(t)
+	oldOne := getRunningConfig()
+
+	config := NewConfig()
+	(*config)[1337] = ChainConfig{Upstreams: []UpstreamConfig{{Url: "https://ropsten.infura.io/v3/83438c4dcf834ceb8944162688749707"}}, Strategy: "UNKNOWN"}
+
+	_, err := BuildRunningConfigFromConfig(context.Background(), config)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, oldOne, getRunningConfig())
+	assert.Equal(t, nil, oldOne.ctx.Err())
+}
+
+func TestBuildRunningConfigUpstreamObjects(t *testing.T) {
+	var testConfigStr = `{
+		"1337": {
+			"upstreams": [
+				"http://127.0.0.1:1/key1",
+				"http://127.0.0.1:1/key2",
+				{"url": "ws://127.0.0.1:2", "name": "archive", "tier": 1, "weight": 3, "archive": true, "methods": ["eth_call"]}
+			],
+			"strategy": "FALLBACK"
+		}
+	}`
+
+	config := NewConfig()
+
+	err := json.Unmarshal([]byte(testConfigStr), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, UpstreamConfig{Url: "http://127.0.0.1:1/key1"}, (*config)[1337].Upstreams[0])
+	assert.Equal(t, 3, (*config)[1337].Upstreams[2].Weight)
+
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreams := getRunningConfig().Configs[1337].Upstreams
+	assert.Equal(t, "127.0.0.1:1", upstreams[0].getName())
+	assert.Equal(t, "127.0.0.1:1#1", upstreams[1].getName())
+	assert.Equal(t, "archive", upstreams[2].getName())
+	assert.Equal(t, 1, upstreams[0].getInfo().weight)
+	assert.Equal(t, true, upstreams[2].getInfo().archive)
+	assert.Equal(t, false, upstreams[2].getInfo().supportsMethod("eth_getLogs"))
+
+	chainConfig := (*config)[1337]
+	chainConfig.Upstreams[1].Name = "archive"
+	(*config)[1337] = chainConfig
+
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// configFormat is chosen by the extension of the config file, the config is handled as json inside the gateway
+type configFormat string
+
+const (
+	jsonFormat configFormat = "json"
+	yamlFormat configFormat = "yaml"
+	tomlFormat configFormat = "toml"
+)
+
+func getConfigFormat(path string) (configFormat, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return jsonFormat, nil
+	case ".yaml", ".yml":
+		return yamlFormat, nil
+	case ".toml":
+		return tomlFormat, nil
+	}
+
+	return "", fmt.Errorf("unsupported config file %s, use .json, .yaml, .yml or .toml", path)
+}
+
+// decodeConfigFile converts the content of a config file to json
+func decodeConfigFile(format configFormat, bts []byte) ([]byte, error) {
+	var doc interface{}
+
+	switch format {
+	case jsonFormat:
+		return bts, nil
+	case yamlFormat:
+		if err := yaml.Unmarshal(bts, &doc); err != nil {
+			return nil, err
+		}
+		doc = stringKeys(doc)
+	case tomlFormat:
+		if _, err := toml.Decode(string(bts), &doc); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+// encodeConfigFile converts a json config to the format of the config file
+func encodeConfigFile(format configFormat, bts []byte) ([]byte, error) {
+	if format == jsonFormat {
+		return bts, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(bts))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	doc = plainNumbers(doc)
+
+	if format == yamlFormat {
+		return yaml.Marshal(doc)
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(doc); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// stringKeys turns the maps decoded from yaml into json objects, chain ids may be written as plain numbers
+func stringKeys(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		obj := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			obj[fmt.Sprint(key)] = stringKeys(item)
+		}
+		return obj
+	case []interface{}:
+		for i, item := range value {
+			value[i] = stringKeys(item)
+		}
+	}
+
+	return value
+}
+
+// plainNumbers keeps the integers of a json config integers in yaml and toml
+func plainNumbers(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = plainNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = plainNumbers(item)
+		}
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	}
+
+	return value
+}
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${ENV_VAR} of a json config by the environment variables, the variables must be set
+func expandEnv(bts []byte) ([]byte, error) {
+	var err error
+
+	expanded := envPattern.ReplaceAllFunc(bts, func(match []byte) []byte {
+		name := string(envPattern.FindSubmatch(match)[1])
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			err = fmt.Errorf("environment variable %s is not set", name)
+			return match
+		}
+
+		// the value is put inside a json string
+		quoted, _ := json.Marshal(value)
+		return quoted[1 : len(quoted)-1]
+	})
+
+	return expanded, err
+}
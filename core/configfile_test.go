@@ -0,0 +1,136 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetConfigFormat(t *testing.T) {
+	for path, format := range map[string]configFormat{
+		"./config.json":           jsonFormat,
+		"/etc/gateway/config.yml": yamlFormat,
+		"config.YAML":             yamlFormat,
+		"config.toml":             tomlFormat,
+	} {
+		got, err := getConfigFormat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, format, got, path)
+	}
+
+	_, err := getConfigFormat("config.ini")
+	assert.NotNil(t, err)
+
+	_, err = getConfigFormat("config")
+	assert.NotNil(t, err)
+}
+
+func TestDecodeConfigFile(t *testing.T) {
+	yamlConfig := `
+allowAnonymous: true
+timeouts:
+  requestTimeout: 5s
+1:
+  upstreams:
+    - https://node.example.com/v3/key
+    - url: wss://other.example.com/ws
+      name: other
+      weight: 2
+  strategy: FALLBACK
+`
+
+	tomlConfig := `
+allowAnonymous = true
+
+[timeouts]
+requestTimeout = "5s"
+
+[1]
+strategy = "FALLBACK"
+
+[[1.upstreams]]
+url = "https://node.example.com/v3/key"
+
+[[1.upstreams]]
+url = "wss://other.example.com/ws"
+name = "other"
+weight = 2
+`
+
+	for format, content := range map[configFormat]string{yamlFormat: yamlConfig, tomlFormat: tomlConfig} {
+		bts, err := decodeConfigFile(format, []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := NewConfig()
+		assert.Nil(t, json.Unmarshal(bts, config))
+		assert.Equal(t, "FALLBACK", (*config)[1].Strategy)
+		assert.Equal(t, "https://node.example.com/v3/key", (*config)[1].Upstreams[0].Url)
+		assert.Equal(t, UpstreamConfig{Url: "wss://other.example.com/ws", Name: "other", Weight: 2}, (*config)[1].Upstreams[1])
+
+		globalConfig := NewGlobalConfig()
+		assert.Nil(t, json.Unmarshal(bts, globalConfig))
+		assert.True(t, globalConfig.AllowAnonymous)
+		assert.Equal(t, 5*time.Second, time.Duration(*globalConfig.Timeouts.RequestTimeout))
+
+		// written back in the same format
+		file, err := encodeConfigFile(format, bts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		again, err := decodeConfigFile(format, file)
+		assert.Nil(t, err)
+		assert.JSONEq(t, string(bts), string(again))
+	}
+
+	_, err := decodeConfigFile(yamlFormat, []byte("1: [broken"))
+	assert.NotNil(t, err)
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("GATEWAY_TEST_KEY", `abc"def`)
+	defer os.Unsetenv("GATEWAY_TEST_KEY")
+
+	bts, err := expandEnv([]byte(`{"1": {"upstreams": ["https://node.example.com/v3/${GATEWAY_TEST_KEY}"], "strategy": "$NAIVE"}}`))
+	assert.Nil(t, err)
+
+	config := NewConfig()
+	assert.Nil(t, json.Unmarshal(bts, config))
+	assert.Equal(t, `https://node.example.com/v3/abc"def`, (*config)[1].Upstreams[0].Url)
+	assert.Equal(t, "$NAIVE", (*config)[1].Strategy)
+
+	_, err = expandEnv([]byte(`{"1": {"upstreams": ["https://node.example.com/v3/${GATEWAY_TEST_MISSING}"]}}`))
+	assert.EqualError(t, err, "environment variable GATEWAY_TEST_MISSING is not set")
+}
+
+func TestApplyConfigExpandsEnv(t *testing.T) {
+	upstream := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return "ok"
+	})
+	defer upstream.Close()
+
+	os.Setenv("GATEWAY_TEST_UPSTREAM", upstream.URL)
+	defer os.Unsetenv("GATEWAY_TEST_UPSTREAM")
+
+	configLocker.Lock()
+	defer configLocker.Unlock()
+
+	doc := `{"1337": {"upstreams": [{"url": "${GATEWAY_TEST_UPSTREAM}", "name": "node"}], "strategy": "NAIVE"}}`
+	defer closeTestConfig()
+	assert.Nil(t, applyConfig(context.Background(), []byte(doc)))
+
+	// the running config has the value, the document keeps the variable for the admin api
+	assert.Equal(t, upstream.URL, getRunningConfig().Configs[1337].getUpstream("node").getRpcUrl())
+	assert.Equal(t, doc, currentConfigString)
+
+	running := getRunningConfig()
+	assert.NotNil(t, applyConfig(context.Background(), []byte(`{"1337": {"upstreams": ["${GATEWAY_TEST_MISSING}"], "strategy": "NAIVE"}}`)))
+	assert.Equal(t, running, getRunningConfig())
+	assert.Equal(t, doc, currentConfigString)
+}
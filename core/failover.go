@@ -0,0 +1,189 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var NoValidUpstreamError = fmt.Errorf("no valid upstream")
+
+// errorClass tells whether another upstream could answer better
+type errorClass int
+
+const (
+	noError errorClass = iota
+	// transportError is no valid JSON-RPC answer: network errors, timeouts, broken or mismatched responses.
+	// The upstreams check the response ids.
+	transportError
+	// nodeError is a node which can't serve the request now: rate limits, pruned or missing state, not synced
+	nodeError
+	// executionError is deterministic, every node would return it, e.g. execution reverted or nonce too low
+	executionError
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case transportError:
+		return "transport_error"
+	case nodeError:
+		return "node_error"
+	case executionError:
+		return "execution_error"
+	}
+
+	return "ok"
+}
+
+// nodeErrorMessages are checked before executionErrorMessages, the messages of unknown errors are treated as node errors.
+// Errors with a code of executionErrorCodes or a revert are never matched by message.
+var nodeErrorMessages = []string{
+	"rate limit", "too many requests", "limit exceeded", "exceeded the quota", "capacity",
+	"missing trie node", "header not found", "unknown block", "block not found", "pruned",
+	"not synced", "syncing", "timeout", "timed out", "busy", "unavailable", "internal error",
+	"method not found", "not supported", "does not exist/is not available",
+}
+
+var executionErrorMessages = []string{
+	"execution reverted", "revert", "invalid opcode", "out of gas", "stack underflow", "stack overflow",
+	"nonce too low", "nonce too high", "insufficient funds", "intrinsic gas too low",
+	"gas required exceeds allowance", "exceeds block gas limit", "transaction underpriced",
+	"replacement transaction underpriced", "fee cap less than block base fee", "max fee per gas less than block base fee",
+	"already known", "known transaction", "invalid sender", "invalid signature", "invalid argument", "invalid params",
+}
+
+// JSON-RPC codes which don't depend on the node
+var executionErrorCodes = map[int64]bool{
+	3:      true, // execution reverted
+	-32700: true, // parse error
+	-32600: true, // invalid request
+	-32602: true, // invalid params
+}
+
+// FailoverConfig sets which upstream errors are retried on the other upstreams
+type FailoverConfig struct {
+	// MaxRetries is how many other upstreams are tried after the first one, default all of them
+	MaxRetries *int `json:"maxRetries"`
+	// NodeErrors are extra messages of node errors, which are retried
+	NodeErrors []string `json:"nodeErrors"`
+	// ExecutionErrors are extra messages of deterministic errors, which are returned to the client
+	ExecutionErrors []string `json:"executionErrors"`
+}
+
+// failoverPolicy is the resolved FailoverConfig, nil is the default policy
+type failoverPolicy struct {
+	maxRetries      int // negative means no limit
+	nodeErrors      []string
+	executionErrors []string
+}
+
+func newFailoverPolicy(cfg *FailoverConfig) (*failoverPolicy, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	p := &failoverPolicy{maxRetries: -1}
+
+	if cfg.MaxRetries != nil {
+		if *cfg.MaxRetries < 0 {
+			return nil, fmt.Errorf("failover: maxRetries can't be negative")
+		}
+		p.maxRetries = *cfg.MaxRetries
+	}
+
+	for _, message := range cfg.NodeErrors {
+		p.nodeErrors = append(p.nodeErrors, strings.ToLower(message))
+	}
+
+	for _, message := range cfg.ExecutionErrors {
+		p.executionErrors = append(p.executionErrors, strings.ToLower(message))
+	}
+
+	return p, nil
+}
+
+// attempts is how many of the upstreams a request can be sent to
+func (p *failoverPolicy) attempts(upstreams int) int {
+	if p == nil || p.maxRetries < 0 || p.maxRetries+1 > upstreams {
+		return upstreams
+	}
+
+	return p.maxRetries + 1
+}
+
+// classifyError tells a node error from a deterministic one. Reverts and known codes go first, whatever the
+// revert reason says, then the extra messages.
+func (p *failoverPolicy) classifyError(rpcErr *JsonRpcError) errorClass {
+	message := strings.ToLower(rpcErr.Message)
+
+	if executionErrorCodes[rpcErr.Code] || strings.Contains(message, "execution reverted") {
+		return executionError
+	}
+
+	if p != nil {
+		if containsAny(message, p.nodeErrors) {
+			return nodeError
+		}
+		if containsAny(message, p.executionErrors) {
+			return executionError
+		}
+	}
+
+	if containsAny(message, nodeErrorMessages) {
+		return nodeError
+	}
+
+	if containsAny(message, executionErrorMessages) {
+		return executionError
+	}
+
+	return nodeError
+}
+
+// classify tells what the answer of an upstream is worth
+func (p *failoverPolicy) classify(bts []byte, err error) errorClass {
+	if err != nil {
+		return transportError
+	}
+
+	var resp jsonRpcRawResponse
+	if err := json.Unmarshal(bts, &resp); err != nil {
+		logrus.Errorf("JsonRpcResponse unmarsharling failed: %v, resp: %v", err, string(bts))
+		return transportError
+	}
+
+	if resp.Error == nil {
+		return noError
+	}
+
+	return p.classifyError(resp.Error)
+}
+
+// check classifies the answer of an upstream and counts the failures
+func (p *failoverPolicy) check(req *Request, upstream Upstream, bts []byte, err error) errorClass {
+	class := p.classify(bts, err)
+
+	if class != noError {
+		CountUpstream(req.chainId, upstream.getName(), class.String())
+		req.logger.Debugf("upstream %s returned %s, err: %v", upstream.getName(), class, err)
+	}
+
+	return class
+}
+
+// getFailoverPolicy returns the policy of the chain of the request
+func getFailoverPolicy(req *Request) *failoverPolicy {
+	return req.getChain().failover
+}
+
+func containsAny(message string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	var policy *failoverPolicy
+
+	cases := map[JsonRpcError]errorClass{
+		{Code: 3, Message: "execution reverted: not owner"}:                               executionError,
+		{Code: -32000, Message: "nonce too low"}:                                          executionError,
+		{Code: -32000, Message: "insufficient funds for gas * price"}:                     executionError,
+		{Code: -32602, Message: "invalid argument 0"}:                                     executionError,
+		{Code: -32005, Message: "daily request count exceeded"}:                           nodeError,
+		{Code: -32000, Message: "missing trie node 1234 (path )"}:                         nodeError,
+		{Code: -32000, Message: "header not found"}:                                       nodeError,
+		{Code: 429, Message: "Too Many Requests"}:                                         nodeError,
+		{Code: -32601, Message: "the method trace_block does not exist/is not available"}: nodeError,
+		{Code: -32000, Message: "something else"}:                                         nodeError,
+		{Code: 3, Message: "execution reverted: deadline timeout"}:                        executionError,
+		{Code: 3, Message: "execution reverted: pool busy"}:                               executionError,
+		{Code: -32000, Message: "execution reverted: feed unavailable"}:                   executionError,
+		{Code: -32602, Message: "invalid params: block not found"}:                        executionError,
+	}
+
+	for rpcErr, class := range cases {
+		rpcErr := rpcErr
+		assert.Equal(t, class, policy.classifyError(&rpcErr), rpcErr.Message)
+	}
+
+	policy, err := newFailoverPolicy(&FailoverConfig{ExecutionErrors: []string{"Something Else"}})
+	assert.Nil(t, err)
+	assert.Equal(t, executionError, policy.classifyError(&JsonRpcError{Code: -32000, Message: "something else"}))
+
+	// the extra node errors don't turn reverts into node errors
+	policy, _ = newFailoverPolicy(&FailoverConfig{NodeErrors: []string{"timeout"}})
+	assert.Equal(t, executionError, policy.classifyError(&JsonRpcError{Code: 3, Message: "execution reverted: deadline timeout"}))
+	assert.Equal(t, nodeError, policy.classifyError(&JsonRpcError{Code: -32000, Message: "request timeout"}))
+	assert.Equal(t, 3, policy.attempts(3))
+
+	maxRetries := 1
+	policy, _ = newFailoverPolicy(&FailoverConfig{MaxRetries: &maxRetries})
+	assert.Equal(t, 2, policy.attempts(3))
+	assert.Equal(t, 1, policy.attempts(1))
+
+	maxRetries = -1
+	_, err = newFailoverPolicy(&FailoverConfig{MaxRetries: &maxRetries})
+	assert.NotNil(t, err)
+}
+
+func TestFailoverOnNodeErrorsOnly(t *testing.T) {
+	var failing atomic.Value
+	var backupHits int64
+
+	// the primary passes the health checks and fails the calls
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data RequestData
+		_ = json.NewDecoder(r.Body).Decode(&data)
+
+		res := map[string]interface{}{"jsonrpc": "2.0", "id": data.ID, "result": "0x1"}
+		if data.Method != "eth_blockNumber" {
+			res = map[string]interface{}{"jsonrpc": "2.0", "id": data.ID, "error": failing.Load()}
+		}
+
+		bts, _ := json.Marshal(res)
+		_, _ = w.Write(bts)
+	}))
+	defer primary.Close()
+
+	backup := newTestUpstreamServer(func(data *RequestData) interface{} {
+		if data.Method != "eth_blockNumber" {
+			atomic.AddInt64(&backupHits, 1)
+		}
+		return "0x2"
+	})
+	defer backup.Close()
+
+	defer closeTestConfig()
+	build := func(failover string) {
+		config := NewConfig()
+		err := json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {
+			"upstreams": [{"url": "%s", "name": "primary"}, {"url": "%s", "name": "backup", "tier": 1}],
+			"strategy": "FALLBACK"%s
+		}}`, primary.URL, backup.URL, failover)), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = BuildRunningConfigFromConfig(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		getRunningConfig().Configs[1337].healthCheck()
+	}
+
+	send := func() *JsonRpcResponse {
+		req, err := newRequest(1337, []byte(`{"params": [], "method": "eth_call", "id": 1, "jsonrpc": "2.0"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bts, err := getRunningConfig().Configs[1337].handle(req)
+		assert.Nil(t, err)
+
+		resp := &JsonRpcResponse{}
+		assert.Nil(t, json.Unmarshal(bts, resp))
+		return resp
+	}
+
+	build("")
+
+	// a revert is returned unchanged, without trying the backup
+	failing.Store(JsonRpcError{Code: 3, Message: "execution reverted"})
+	resp := send()
+	assert.Equal(t, int64(3), resp.Err.Code)
+	assert.Equal(t, "execution reverted", resp.Err.Message)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&backupHits))
+
+	// a node error goes to the backup
+	failing.Store(JsonRpcError{Code: -32000, Message: "header not found"})
+	resp = send()
+	assert.Equal(t, "0x2", resp.Result)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&backupHits))
+
+	// no retries left, the node error is returned
+	build(`, "failover": {"maxRetries": 0}`)
+	atomic.StoreInt64(&backupHits, 0)
+	resp = send()
+	assert.Equal(t, "header not found", resp.Err.Message)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&backupHits))
+}
@@ -7,10 +7,32 @@ import (
 )
 
 type NodeInfo struct {
-	RpcUrl  string `json:"rpcUrl"` // only first 20 chars
-	Latency string `json:"latency"`
-	Height  uint64 `json:"height"`
-	IsAlive bool   `json:"isAlive"`
+	Name      string `json:"name"`
+	Latency   string `json:"latency"`
+	Height    uint64 `json:"height"`
+	IsAlive   bool   `json:"isAlive"`
+	Breaker   string `json:"breaker"`
+	Lag       uint64 `json:"lag"`
+	LagTime   string `json:"lagTime"`
+	IsLagging bool   `json:"isLagging"`
+	State     string `json:"state"`
+	InFlight  int64  `json:"inFlight"`
+}
+
+// newNodeInfo reads the state of an upstream, the caller holds the updateLocker of its chain
+func newNodeInfo(up Upstream) NodeInfo {
+	return NodeInfo{
+		Name:      up.getName(),
+		Height:    up.getBlockNumber(),
+		Latency:   fmt.Sprintf("%s", time.Duration(up.getLatancy())),
+		IsAlive:   up.isAlive(),
+		Breaker:   up.getInfo().breaker.getState(),
+		Lag:       up.getInfo().lagBlocks,
+		LagTime:   up.getInfo().lagTime.String(),
+		IsLagging: up.getInfo().lagging,
+		State:     up.getInfo().getState(),
+		InFlight:  up.getInfo().getInFlight(),
+	}
 }
 
 type HealthInfo map[uint64][]NodeInfo
@@ -20,35 +42,36 @@ var nextUpdateTime time.Time
 var healthInfoUpdateLocker sync.Mutex
 
 func getHealthInfo() HealthInfo {
+	healthInfoUpdateLocker.Lock()
+	defer healthInfoUpdateLocker.Unlock()
+
 	if nextUpdateTime.Before(time.Now()) {
-		healthInfoUpdateLocker.Lock()
+		// the cached info may be in use, a new one is built
+		healthInfo := make(HealthInfo)
 
-		for chainId, cfg := range currentRunningConfig.Configs {
+		for chainId, cfg := range getRunningConfig().Configs {
 			nodesInfo := []NodeInfo{}
-			cfg.updateLocker.RLock()
-			defer cfg.updateLocker.RUnlock()
 
+			cfg.updateLocker.RLock()
 			for _, up := range cfg.Upstreams {
-				url := up.getRpcUrl()
-				if len(url) > 30 {
-					url = url[:30]
-				}
-
-				nodesInfo = append(nodesInfo, NodeInfo{
-					RpcUrl:  url,
-					Height:  up.getBlockNumber(),
-					Latency: fmt.Sprintf("%s", time.Duration(up.getLatancy())),
-					IsAlive: up.isAlive(),
-				})
+				nodesInfo = append(nodesInfo, newNodeInfo(up))
 			}
+			cfg.updateLocker.RUnlock()
 
-			cachedHealthInfo[chainId] = nodesInfo
+			healthInfo[chainId] = nodesInfo
 		}
 
-		healthInfoUpdateLocker.Unlock()
-
-		nextUpdateTime = time.Now().Add(1 * time.Minute)
+		cachedHealthInfo = healthInfo
+		nextUpdateTime = time.Now().Add(getGlobalTimeouts().HealthCacheTTL)
 	}
 
 	return cachedHealthInfo
 }
+
+// invalidateHealthInfo makes the next getHealthInfo read the upstreams again
+func invalidateHealthInfo() {
+	healthInfoUpdateLocker.Lock()
+	defer healthInfoUpdateLocker.Unlock()
+
+	nextUpdateTime = time.Time{}
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultHedgePercentile = 95
+	defaultHedgeDelay      = 500 * time.Millisecond
+	// minHedgeSamples is how many durations are needed before the percentile is trusted
+	minHedgeSamples = 20
+)
+
+// HedgeConfig sets when the HEDGED strategy sends the second request. A fixed Delay
+// wins over the Percentile of the recent latency of the preferred upstream.
+type HedgeConfig struct {
+	Delay      *Duration `json:"delay"`
+	Percentile float64   `json:"percentile"`
+}
+
+func (c *HedgeConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+
+	if c.Delay != nil && *c.Delay <= 0 {
+		return fmt.Errorf("hedge delay should be positive, got %s", time.Duration(*c.Delay))
+	}
+
+	if c.Percentile < 0 || c.Percentile >= 100 {
+		return fmt.Errorf("hedge percentile should be between 0 and 100, got %v", c.Percentile)
+	}
+
+	return nil
+}
+
+// hedgeDelay returns how long to wait for the upstream before hedging
+func (c *HedgeConfig) hedgeDelay(upstream Upstream) time.Duration {
+	percentile := float64(defaultHedgePercentile)
+
+	if c != nil {
+		if c.Delay != nil {
+			return time.Duration(*c.Delay)
+		}
+
+		if c.Percentile > 0 {
+			percentile = c.Percentile
+		}
+	}
+
+	if delay, ok := upstream.getInfo().stats.percentile(percentile, minHedgeSamples); ok {
+		return delay
+	}
+
+	return defaultHedgeDelay
+}
@@ -0,0 +1,34 @@
+package core
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHedgeConfig(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:1")
+	upstream := newHttpUpstream(context.Background(), 1337, u, u, newUpstreamInfo(1337, UpstreamConfig{Url: u.String()}, u))
+
+	// not enough samples for the percentile yet
+	assert.Equal(t, defaultHedgeDelay, (*HedgeConfig)(nil).hedgeDelay(upstream))
+
+	for i := 1; i <= 100; i++ {
+		upstream.stats.observe(time.Duration(i)*time.Millisecond, false)
+	}
+
+	assert.Equal(t, 95*time.Millisecond, (*HedgeConfig)(nil).hedgeDelay(upstream))
+	assert.Equal(t, 50*time.Millisecond, (&HedgeConfig{Percentile: 50}).hedgeDelay(upstream))
+
+	delay := Duration(time.Second)
+	assert.Equal(t, time.Second, (&HedgeConfig{Delay: &delay, Percentile: 50}).hedgeDelay(upstream))
+
+	assert.Nil(t, (&HedgeConfig{Delay: &delay}).validate())
+	assert.NotNil(t, (&HedgeConfig{Percentile: 100}).validate())
+
+	delay = 0
+	assert.NotNil(t, (&HedgeConfig{Delay: &delay}).validate())
+}
@@ -1,20 +1,115 @@
 package core
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 type RequestData struct {
-	JsonRpc string        `json:"jsonrpc"`
-	ID      int64         `json:"id,omitempty"`
-	Method  string        `json:"method"`
-	Params  []interface{} `json:"params"`
+	JsonRpc string `json:"jsonrpc"`
+	// ID is kept as sent by the client, a string, a number of any size or null. It's nil for notifications.
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params []interface{}   `json:"params"`
+}
+
+// isNotification tells a request without id, which gets no response
+func (d *RequestData) isNotification() bool {
+	return d.ID == nil
+}
+
+// validID tells an id which is a string, a number or null, a nil id is a notification
+func validID(id json.RawMessage) bool {
+	if id == nil || string(id) == "null" {
+		return true
+	}
+
+	c := id[0]
+	return c == '"' || c == '-' || (c >= '0' && c <= '9')
+}
+
+// invalidRequestID returns the id of an invalid request if it's a string or a number, else nil
+func invalidRequestID(bts []byte) json.RawMessage {
+	var req struct {
+		ID json.RawMessage `json:"id"`
+	}
+
+	if json.Unmarshal(bts, &req) != nil || len(req.ID) == 0 {
+		return nil
+	}
+
+	if string(req.ID) == "null" || !validID(req.ID) {
+		return nil
+	}
+
+	return req.ID
 }
 
 type JsonRpcResponse struct {
-	JsonRpc string       `json:"jsonrpc"`
-	ID      int64        `json:"id"`
-	Err     JsonRpcError `json:"error"`
-	Result  interface{}  `json:"result"`
+	JsonRpc string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Err     *JsonRpcError   `json:"error"`
+	Result  interface{}     `json:"result"`
+}
+
+// MarshalJSON writes either the error or the result, a null result is kept
+func (r *JsonRpcResponse) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{
+		"jsonrpc": r.JsonRpc,
+		"id":      r.ID,
+	}
+
+	if r.Err != nil {
+		fields["error"] = r.Err
+	} else {
+		fields["result"] = r.Result
+	}
+
+	return json.Marshal(fields)
 }
 
 type JsonRpcError struct {
-	Code    int64  `json:"code"`
-	Message string `json:"message"`
+	Code    int64       `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// jsonRpcRawResponse keeps the result undecoded
+type jsonRpcRawResponse struct {
+	JsonRpc string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   *JsonRpcError   `json:"error"`
+	Result  json.RawMessage `json:"result"`
+}
+
+// withID replaces the id of a request or a response, the other fields are kept as they are
+func withID(bts []byte, id json.RawMessage) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(bts, &fields); err != nil {
+		return nil, err
+	}
+
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	fields["id"] = id
+
+	return json.Marshal(fields)
+}
+
+// upstreamID returns the id of an upstream response, the gateway sends numeric ids only
+func upstreamID(bts []byte) (int64, error) {
+	var resp struct {
+		ID *int64 `json:"id"`
+	}
+
+	if err := json.Unmarshal(bts, &resp); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal json rpc resp: %v", err)
+	}
+
+	if resp.ID == nil {
+		return 0, fmt.Errorf("json rpc resp without id")
+	}
+
+	return *resp.ID, nil
 }
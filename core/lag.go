@@ -0,0 +1,180 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// headHistorySize is how many head heights are remembered to tell how long an upstream lags
+const headHistorySize = 1024
+
+// MaxLagConfig takes the upstreams lagging behind the chain head out of rotation,
+// they are back once they catch up.
+type MaxLagConfig struct {
+	// Blocks behind the head, 0 means no limit
+	Blocks uint64 `json:"blocks"`
+	// Time since the head passed the height of the upstream, unset means no limit
+	Time *Duration `json:"time"`
+}
+
+func (c *MaxLagConfig) validate() error {
+	if c != nil && c.Time != nil && *c.Time <= 0 {
+		return fmt.Errorf("maxLag: time should be positive")
+	}
+
+	return nil
+}
+
+// exceeded tells whether an upstream lagging that much is left out, never with a nil config
+func (c *MaxLagConfig) exceeded(blocks uint64, lagTime time.Duration) bool {
+	if c == nil || blocks == 0 {
+		return false
+	}
+
+	return (c.Blocks > 0 && blocks > c.Blocks) || (c.Time != nil && lagTime > time.Duration(*c.Time))
+}
+
+type headSample struct {
+	height uint64
+	seenAt time.Time
+}
+
+// headHistory records when every new head height was first seen
+type headHistory struct {
+	samples []headSample
+}
+
+func (h *headHistory) update(height uint64, now time.Time) {
+	if len(h.samples) > 0 && h.samples[len(h.samples)-1].height >= height {
+		return
+	}
+
+	h.samples = append(h.samples, headSample{height, now})
+
+	if len(h.samples) > headHistorySize {
+		h.samples = h.samples[len(h.samples)-headHistorySize:]
+	}
+}
+
+// behind returns how long ago the head went past the height
+func (h *headHistory) behind(height uint64, now time.Time) time.Duration {
+	for _, sample := range h.samples {
+		if sample.height > height {
+			return now.Sub(sample.seenAt)
+		}
+	}
+
+	return 0
+}
+
+// highestBlock is the head of the chain, the highest block of the alive upstreams.
+// The caller holds the updateLocker.
+func (c *RunningChainConfig) highestBlock() uint64 {
+	var head uint64
+	for _, up := range c.Upstreams {
+		if up.isAlive() && up.getBlockNumber() > head {
+			head = up.getBlockNumber()
+		}
+	}
+
+	return head
+}
+
+// updateLag measures how far every alive upstream is behind the head, the caller holds the updateLocker
+func (c *RunningChainConfig) updateLag() {
+	now := time.Now()
+	head := c.highestBlock()
+	c.headHistory.update(head, now)
+
+	for _, up := range c.Upstreams {
+		info := up.getInfo()
+
+		info.lagBlocks, info.lagTime = 0, 0
+		if up.isAlive() && up.getBlockNumber() < head {
+			info.lagBlocks = head - up.getBlockNumber()
+			info.lagTime = c.headHistory.behind(up.getBlockNumber(), now)
+		}
+
+		lagging := c.maxLag.exceeded(info.lagBlocks, info.lagTime)
+		if lagging != info.lagging {
+			if lagging {
+				logrus.Warnf("upstream %s lags %d blocks, %s behind the head %d, left out", info.name, info.lagBlocks, info.lagTime, head)
+			} else {
+				logrus.Infof("upstream %s caught up with the head %d", info.name, head)
+			}
+		}
+		info.lagging = lagging
+
+		ValueUpstreamLag(info.chainId, info.name, info.lagBlocks)
+	}
+}
+
+// checkLag polls the heights of the upstreams between the health checks, so that the lagging
+// upstreams are left out and brought back on recent heads
+func (c *RunningChainConfig) checkLag() {
+	c.updateLocker.RLock()
+	upstreams := append([]Upstream(nil), c.Upstreams...)
+	c.updateLocker.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, up := range upstreams {
+		wg.Add(1)
+
+		go func(up Upstream) {
+			up.updateBlockNumber()
+			wg.Done()
+		}(up)
+	}
+
+	wg.Wait()
+
+	c.updateLocker.Lock()
+	defer c.updateLocker.Unlock()
+
+	// a rebuilt chain hands its upstreams over to the new one
+	if c.ctx != nil && c.ctx.Err() != nil {
+		return
+	}
+
+	for _, up := range c.Upstreams {
+		up.getInfo().raiseKnownBlock(up.getBlockNumber())
+	}
+
+	c.updateLag()
+	c.updateRoutes()
+}
+
+func (c *RunningChainConfig) runLagCheck(ctx context.Context) {
+	ticker := time.NewTicker(c.timeouts.LagCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.checkLag()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// withoutLagging leaves the lagging upstreams out, unless nothing else is left
+func withoutLagging(upstreams []Upstream) []Upstream {
+	var kept []Upstream
+
+	for _, up := range upstreams {
+		if !up.getInfo().lagging {
+			kept = append(kept, up)
+		}
+	}
+
+	if len(kept) == 0 {
+		return upstreams
+	}
+
+	return kept
+}
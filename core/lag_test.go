@@ -0,0 +1,124 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeadHistory(t *testing.T) {
+	now := time.Now()
+	history := headHistory{}
+
+	history.update(100, now.Add(-10*time.Second))
+	history.update(100, now.Add(-8*time.Second))
+	history.update(105, now.Add(-5*time.Second))
+	history.update(110, now)
+
+	assert.Equal(t, 10*time.Second, history.behind(99, now))
+	assert.Equal(t, 5*time.Second, history.behind(100, now))
+	assert.Equal(t, 5*time.Second, history.behind(104, now))
+	assert.Equal(t, time.Duration(0), history.behind(110, now))
+
+	for i := 0; i < headHistorySize*2; i++ {
+		history.update(uint64(200+i), now)
+	}
+	assert.Equal(t, headHistorySize, len(history.samples))
+
+	lagTime := Duration(10 * time.Second)
+	assert.True(t, (&MaxLagConfig{Blocks: 5}).exceeded(6, 0))
+	assert.False(t, (&MaxLagConfig{Blocks: 5}).exceeded(5, time.Hour))
+	assert.True(t, (&MaxLagConfig{Time: &lagTime}).exceeded(1, 11*time.Second))
+	assert.False(t, (*MaxLagConfig)(nil).exceeded(1000, time.Hour))
+
+	lagTime = 0
+	assert.NotNil(t, (&MaxLagConfig{Time: &lagTime}).validate())
+}
+
+func TestLaggingUpstreams(t *testing.T) {
+	var laggingHeight int64 = 50
+
+	head := newTestUpstreamServer(func(data *RequestData) interface{} {
+		if data.Method == "eth_blockNumber" {
+			return "0x64"
+		}
+		return "head"
+	})
+	defer head.Close()
+
+	lagging := newTestUpstreamServer(func(data *RequestData) interface{} {
+		if data.Method == "eth_blockNumber" {
+			return fmt.Sprintf("0x%x", atomic.LoadInt64(&laggingHeight))
+		}
+		return "lagging"
+	})
+	defer lagging.Close()
+
+	config := NewConfig()
+	err := json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {
+		"upstreams": [{"url": "%s", "name": "lagging", "tier": 0}, {"url": "%s", "name": "head", "tier": 1}],
+		"strategy": "FALLBACK",
+		"maxLag": {"blocks": 10},
+		"timeouts": {"lagCheckInterval": "50ms"}
+	}}`, lagging.URL, head.URL)), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := getRunningConfig().Configs[1337]
+	cfg.healthCheck()
+
+	send := func() string {
+		req, err := newRequest(1337, []byte(`{"params": [], "method": "eth_gasPrice", "id": 1, "jsonrpc": "2.0"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bts, err := cfg.handle(req)
+		assert.Nil(t, err)
+
+		var res struct {
+			Result string `json:"result"`
+		}
+		_ = json.Unmarshal(bts, &res)
+
+		return res.Result
+	}
+
+	// the lower tier is left out while 50 blocks behind
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "head", send())
+	}
+
+	invalidateHealthInfo()
+	for _, node := range getHealthInfo()[1337] {
+		if node.Name == "lagging" {
+			assert.Equal(t, uint64(50), node.Lag)
+			assert.True(t, node.IsLagging)
+		} else {
+			assert.Equal(t, uint64(0), node.Lag)
+			assert.False(t, node.IsLagging)
+		}
+	}
+
+	// back once caught up, without waiting for the health check
+	atomic.StoreInt64(&laggingHeight, 95)
+	assert.Eventually(t, func() bool {
+		return send() == "lagging"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cfg.updateLocker.RLock()
+	assert.Equal(t, 2, len(cfg.defaultRoute.upstreams))
+	cfg.updateLocker.RUnlock()
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyEWMAAlpha is the weight of the newest sample in the moving averages
+	latencyEWMAAlpha = 0.2
+	// errorRatePenalty is the ms added to the score of an upstream failing every request,
+	// failures are often faster than successful responses
+	errorRatePenalty = 1000
+	// latencyWindowSize is how many recent successful durations are kept for percentiles
+	latencyWindowSize = 200
+)
+
+// latencyStats is the exponentially weighted moving average of the duration
+// and the outcome of the requests served by an upstream, and a window of the
+// recent successful durations.
+type latencyStats struct {
+	sync.Mutex
+	latency   float64 // ms
+	errorRate float64 // 0 to 1
+	samples   int64
+
+	window []time.Duration
+	next   int
+}
+
+func (s *latencyStats) observe(duration time.Duration, failed bool) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	ms := float64(duration.Nanoseconds()) / 1e6
+	errorValue := 0.0
+	if failed {
+		errorValue = 1
+	}
+
+	if s.samples == 0 {
+		s.latency = ms
+		s.errorRate = errorValue
+	} else {
+		s.latency = latencyEWMAAlpha*ms + (1-latencyEWMAAlpha)*s.latency
+		s.errorRate = latencyEWMAAlpha*errorValue + (1-latencyEWMAAlpha)*s.errorRate
+	}
+
+	s.samples++
+
+	if !failed {
+		if len(s.window) < latencyWindowSize {
+			s.window = append(s.window, duration)
+		} else {
+			s.window[s.next] = duration
+			s.next = (s.next + 1) % latencyWindowSize
+		}
+	}
+}
+
+// percentile returns the p-th percentile of the recent successful durations,
+// ok is false with less than minSamples durations.
+func (s *latencyStats) percentile(p float64, minSamples int) (d time.Duration, ok bool) {
+	if s == nil {
+		return 0, false
+	}
+
+	s.Lock()
+	window := append([]time.Duration{}, s.window...)
+	s.Unlock()
+
+	if len(window) == 0 || len(window) < minSamples {
+		return 0, false
+	}
+
+	sort.Slice(window, func(i, j int) bool { return window[i] < window[j] })
+
+	i := int(math.Ceil(p/100*float64(len(window)))) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return window[i], true
+}
+
+// score is lower for better upstreams, upstreams without samples score 0 so they are tried first
+func (s *latencyStats) score() float64 {
+	if s == nil {
+		return 0
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.samples == 0 {
+		return 0
+	}
+
+	return s.latency + errorRatePenalty*s.errorRate
+}
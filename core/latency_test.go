@@ -0,0 +1,73 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyStats(t *testing.T) {
+	stats := &latencyStats{}
+	assert.Equal(t, float64(0), stats.score())
+
+	stats.observe(100*time.Millisecond, false)
+	assert.Equal(t, float64(100), stats.score())
+
+	stats.observe(200*time.Millisecond, false)
+	assert.InDelta(t, 120, stats.score(), 0.001)
+
+	// a failure weighs more than the slow responses
+	stats.observe(10*time.Millisecond, true)
+	assert.InDelta(t, 98+0.2*errorRatePenalty, stats.score(), 0.001)
+
+	var nilStats *latencyStats
+	nilStats.observe(time.Second, true)
+	assert.Equal(t, float64(0), nilStats.score())
+}
+
+func TestLatencyStatsPercentile(t *testing.T) {
+	stats := &latencyStats{}
+
+	_, ok := stats.percentile(95, 1)
+	assert.False(t, ok)
+
+	for i := 1; i <= 100; i++ {
+		stats.observe(time.Duration(i)*time.Millisecond, false)
+	}
+	stats.observe(time.Second, true)
+
+	d, ok := stats.percentile(95, 20)
+	assert.True(t, ok)
+	assert.Equal(t, 95*time.Millisecond, d)
+
+	// the window keeps the recent durations only
+	for i := 0; i < latencyWindowSize; i++ {
+		stats.observe(time.Millisecond, false)
+	}
+
+	d, _ = stats.percentile(95, 20)
+	assert.Equal(t, time.Millisecond, d)
+
+	_, ok = stats.percentile(95, latencyWindowSize+1)
+	assert.False(t, ok)
+}
+
+func TestLatencyStatsNodeErrors(t *testing.T) {
+	info := &upstreamInfo{name: "node", stats: &latencyStats{}}
+	req := &Request{chainId: 1337, data: &RequestData{Method: "eth_call"}}
+
+	answer := func(bts string) func(*Request) ([]byte, error) {
+		return func(*Request) ([]byte, error) {
+			return []byte(bts), nil
+		}
+	}
+
+	// a revert is an answer
+	_, _ = info.serve(req, answer(`{"jsonrpc": "2.0", "id": 1, "error": {"code": 3, "message": "execution reverted"}}`))
+	assert.Equal(t, float64(0), info.stats.errorRate)
+
+	// a fast node error doesn't make the upstream look healthy
+	_, _ = info.serve(req, answer(`{"jsonrpc": "2.0", "id": 1, "error": {"code": -32005, "message": "rate limit exceeded"}}`))
+	assert.InDelta(t, 0.2, info.stats.errorRate, 0.001)
+}
@@ -1,12 +1,10 @@
 package core
 
 import (
-	"encoding/hex"
 	"fmt"
 	"strings"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
-	"github.com/ethereum/go-ethereum/rlp"
 )
 
 // eth_call
@@ -20,13 +18,29 @@ import (
 var DecodeError = fmt.Errorf("decode error")
 var DeniedMethod = fmt.Errorf("not allowed method")
 var DeniedContract = fmt.Errorf("not allowed contract or address")
+var DeniedContractCreation = fmt.Errorf("not allowed contract creation")
+var DeniedSender = fmt.Errorf("not allowed sender")
+var DeniedChainId = fmt.Errorf("not allowed chain id")
 
 func isAllowedMethod(chainId uint64, method string) bool {
-	return currentRunningConfig.Configs[chainId].allowedMethods[method]
+	return getRunningConfig().Configs[chainId].allowedMethods[method]
 }
 
 func inWhitelist(chainId uint64, contractAddress string) bool {
-	return currentRunningConfig.Configs[chainId].allowedCallContracts[strings.ToLower(contractAddress)]
+	return getRunningConfig().Configs[chainId].allowedCallContracts[strings.ToLower(contractAddress)]
+}
+
+// senders are not limited when the sender whitelist is empty
+func isSenderLimited(chainId uint64) bool {
+	return len(getRunningConfig().Configs[chainId].allowedSenders) > 0
+}
+
+func isAllowedSender(chainId uint64, address string) bool {
+	return getRunningConfig().Configs[chainId].allowedSenders[strings.ToLower(address)]
+}
+
+func isContractCreationAllowed(chainId uint64) bool {
+	return getRunningConfig().Configs[chainId].allowContractCreation
 }
 
 func isValidCall(chainId uint64, req *RequestData) (err error) {
@@ -46,48 +60,58 @@ func isValidCall(chainId uint64, req *RequestData) (err error) {
 	}
 
 	if req.Method == "eth_call" || req.Method == "eth_estimateGas" {
-		to := req.Params[0].(map[string]interface{})["to"].(string)
+		callArgs := req.Params[0].(map[string]interface{})
+		to := callArgs["to"].(string)
 
 		if !inWhitelist(chainId, to) {
 			return DeniedContract
 		}
 
+		if isSenderLimited(chainId) {
+			from, _ := callArgs["from"].(string)
+
+			if !isAllowedSender(chainId, from) {
+				return DeniedSender
+			}
+		}
+
 		return nil
 	}
 
 	if req.Method == "eth_sendRawTransaction" {
-		// 0. nonce
-		// 1. gasPrice
-		// 2. gasLimit
-		// 3. to
-		// 4. value
-		// 5. data
-		// 6. signature
-		var fields []interface{}
-
-		data := req.Params[0].(string)
-		bts, _ := hexutil.Decode(data)
-		err = rlp.DecodeBytes(bts, &fields)
+		tx, err := decodeRawTransaction(req.Params[0].(string))
 
 		if err != nil {
-			return DecodeError
+			return err
 		}
 
-		var contractAddress string
+		if isSenderLimited(chainId) {
+			sender, err := tx.sender(chainId)
 
-		switch address := fields[3].(type) {
-		case string:
-			contractAddress = address
-		case []byte:
-			contractAddress = "0x" + hex.EncodeToString(address)
-		default:
-			return DecodeError
+			if err != nil {
+				return err
+			}
+
+			if !isAllowedSender(chainId, hexutil.Encode(sender)) {
+				return DeniedSender
+			}
 		}
 
-		if !inWhitelist(chainId, contractAddress) {
+		if tx.isContractCreation() {
+			if !isContractCreationAllowed(chainId) {
+				return DeniedContractCreation
+			}
+		} else if !inWhitelist(chainId, hexutil.Encode(tx.To)) {
 			return DeniedContract
 		}
 
+		// an EIP-7702 authorization makes the signer run the code of its target
+		for _, address := range tx.Authorizations {
+			if !isZeroAddress(address) && !inWhitelist(chainId, hexutil.Encode(address)) {
+				return DeniedContract
+			}
+		}
+
 		return nil
 	}
 
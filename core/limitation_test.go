@@ -3,8 +3,10 @@ package core
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -40,7 +42,8 @@ func TestIsAllowedMethod(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -83,7 +86,8 @@ func TestInWhitelist(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -125,7 +129,8 @@ func TestIsValidCall(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -135,7 +140,7 @@ func TestIsValidCall(t *testing.T) {
 
 	requestData1 := &RequestData{
 		JsonRpc: "2.0",
-		ID:      1,
+		ID:      json.RawMessage("1"),
 		Method:  "eth_blockNumber",
 		Params:  nil,
 	}
@@ -144,7 +149,7 @@ func TestIsValidCall(t *testing.T) {
 
 	requestData2 := &RequestData{
 		JsonRpc: "2.0",
-		ID:      1,
+		ID:      json.RawMessage("1"),
 		Method:  "eth_getBalance",
 		Params:  nil,
 	}
@@ -153,7 +158,7 @@ func TestIsValidCall(t *testing.T) {
 
 	requestData3 := &RequestData{
 		JsonRpc: "2.0",
-		ID:      1,
+		ID:      json.RawMessage("1"),
 		Method:  "eth_call",
 		Params:  nil,
 	}
@@ -162,7 +167,7 @@ func TestIsValidCall(t *testing.T) {
 
 	requestData4 := &RequestData{
 		JsonRpc: "2.0",
-		ID:      1,
+		ID:      json.RawMessage("1"),
 		Method:  "eth_sendRawTransaction",
 		Params:  nil,
 	}
@@ -171,7 +176,7 @@ func TestIsValidCall(t *testing.T) {
 
 	requestData5 := &RequestData{
 		JsonRpc: "2.0",
-		ID:      1,
+		ID:      json.RawMessage("1"),
 		Method:  "eth_blockNumber_test",
 		Params:  nil,
 	}
@@ -180,7 +185,7 @@ func TestIsValidCall(t *testing.T) {
 
 	requestData6 := &RequestData{
 		JsonRpc: "2.0",
-		ID:      1,
+		ID:      json.RawMessage("1"),
 		Method:  "eth_call",
 		Params:  []interface{}{map[string]interface{}{"to": "0xc2c57336e01695D34F8012f6c0d250baB2Dd38Dd"}},
 	}
@@ -190,7 +195,7 @@ func TestIsValidCall(t *testing.T) {
 
 	requestData7 := &RequestData{
 		JsonRpc: "2.0",
-		ID:      1,
+		ID:      json.RawMessage("1"),
 		Method:  "eth_call",
 		Params:  []interface{}{map[string]interface{}{"to": "0x06898143df04616a8a8f9614deb3b99ba12b3096"}},
 	}
@@ -199,7 +204,7 @@ func TestIsValidCall(t *testing.T) {
 
 	requestData8 := &RequestData{
 		JsonRpc: "2.0",
-		ID:      1,
+		ID:      json.RawMessage("1"),
 		Method:  "eth_sendRawTransaction",
 		Params:  []interface{}{`0xffffffffffffffffffffffffffffffffffff`},
 	}
@@ -208,7 +213,7 @@ func TestIsValidCall(t *testing.T) {
 
 	requestData9 := &RequestData{
 		JsonRpc: "2.0",
-		ID:      1,
+		ID:      json.RawMessage("1"),
 		Method:  "eth_sendRawTransaction",
 		Params:  []interface{}{"0xf9018b14850306dc420083025db89406898143df04616a8a8f9614deb3b99ba12b309680b901248059cf3b000000000000000000000000000000000000000000000000000000000000002000000000000000000000000000000000000000000000000000000000000000010000000000000000000000000000000000000000000000000000000000000020000000000000000000000000000000000000000000000000000000000000000400000000000000000000000000000000000000000000000000000000000000400000000000000000000000000000000000000000000000000000000000000060000000000000000000000000000000000000000000000000000000000000000300000000000000000000000060fa59b6a32c08023c5e0002d6ddebdf4cb2c294000000000000000000000000000000000000000000000000000000002a45d6a02aa0a400038e05162401a612414b0129b7a0fab2824fdb7d365a4e9c34309b633aa5a02cd68de2b4146542a4fed0d918d011617e75d84f024dee4b0028dff56e1f9b31"},
 	}
@@ -217,10 +222,125 @@ func TestIsValidCall(t *testing.T) {
 
 	requestData10 := &RequestData{
 		JsonRpc: "2.0",
-		ID:      1,
+		ID:      json.RawMessage("1"),
 		Method:  "eth_sendRawTransaction",
 		Params:  []interface{}{"0xf9018b14850306dc420083025db89406898143df04616a8a8f9014deb3b99ba12b309680b901248059cf3b000000000000000000000000000000000000000000000000000000000000002000000000000000000000000000000000000000000000000000000000000000010000000000000000000000000000000000000000000000000000000000000020000000000000000000000000000000000000000000000000000000000000000400000000000000000000000000000000000000000000000000000000000000400000000000000000000000000000000000000000000000000000000000000060000000000000000000000000000000000000000000000000000000000000000300000000000000000000000060fa59b6a32c08023c5e0002d6ddebdf4cb2c294000000000000000000000000000000000000000000000000000000002a45d6a02aa0a400038e05162401a612414b0129b7a0fab2824fdb7d365a4e9c34309b633aa5a02cd68de2b4146542a4fed0d918d011617e75d84f024dee4b0028dff56e1f9b31"},
 	}
 
 	assert.Equal(t, DeniedContract, isValidCall(chainId, requestData10))
 }
+
+func TestIsValidCallTypedTransactions(t *testing.T) {
+	var testConfigStr = `{
+		"1337": {
+			"upstreams": ["https://ropsten.infura.io/v3/83438c4dcf834ceb8944162688749707"],
+			"strategy": "NAIVE",
+			"methodLimitationEnabled": true,
+			"allowedMethods": ["eth_sendRawTransaction"],
+			"contractWhitelist": ["0x06898143df04616a8a8f9614deb3b99ba12b3096"]
+		},
+		"1338": {
+			"upstreams": ["https://ropsten.infura.io/v3/83438c4dcf834ceb8944162688749707"],
+			"strategy": "NAIVE",
+			"methodLimitationEnabled": true,
+			"allowedMethods": ["eth_sendRawTransaction"],
+			"contractWhitelist": [],
+			"allowContractCreation": true
+		}
+	}`
+
+	config := NewConfig()
+
+	err := json.Unmarshal([]byte(testConfigStr), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	sendRawTransaction := func(raw string) *RequestData {
+		return &RequestData{JsonRpc: "2.0", ID: json.RawMessage("1"), Method: "eth_sendRawTransaction", Params: []interface{}{raw}}
+	}
+
+	chainId := uint64(1337)
+
+	for _, txType := range []byte{LegacyTxType, AccessListTxType, DynamicFeeTxType, BlobTxType} {
+		assert.Equal(t, nil, isValidCall(chainId, sendRawTransaction(encodeTestTransaction(t, txType, testTxTo))))
+		assert.Equal(t, DeniedContract, isValidCall(chainId, sendRawTransaction(encodeTestTransaction(t, txType, testTxOther))))
+	}
+
+	blobWrapper := encodeTestTransaction(t, BlobTxType, testTxTo, []interface{}{}, []interface{}{}, []interface{}{})
+	assert.Equal(t, nil, isValidCall(chainId, sendRawTransaction(blobWrapper)))
+
+	setCode := encodeTestTransaction(t, SetCodeTxType, testTxTo, testAuthorization(testTxTo), testAuthorization(make([]byte, 20)))
+	assert.Equal(t, nil, isValidCall(chainId, sendRawTransaction(setCode)))
+
+	setCode = encodeTestTransaction(t, SetCodeTxType, testTxTo, testAuthorization(testTxTo), testAuthorization(testTxOther))
+	assert.Equal(t, DeniedContract, isValidCall(chainId, sendRawTransaction(setCode)))
+
+	creation := encodeTestTransaction(t, DynamicFeeTxType, []byte{})
+	assert.Equal(t, DeniedContractCreation, isValidCall(chainId, sendRawTransaction(creation)))
+	assert.Equal(t, nil, isValidCall(uint64(1338), sendRawTransaction(creation)))
+
+	assert.Equal(t, DecodeError, isValidCall(chainId, sendRawTransaction("0x05c0")))
+}
+
+func TestIsValidCallSenderWhitelist(t *testing.T) {
+	sender := crypto.PubkeyToAddress(testTxKey.PublicKey).Hex()
+
+	var testConfigStr = fmt.Sprintf(`{
+		"1337": {
+			"upstreams": ["https://ropsten.infura.io/v3/83438c4dcf834ceb8944162688749707"],
+			"strategy": "NAIVE",
+			"methodLimitationEnabled": true,
+			"allowedMethods": ["eth_sendRawTransaction", "eth_call"],
+			"contractWhitelist": ["0x06898143df04616a8a8f9614deb3b99ba12b3096"],
+			"senderWhitelist": ["%s"]
+		}
+	}`, sender)
+
+	config := NewConfig()
+
+	err := json.Unmarshal([]byte(testConfigStr), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	chainId := uint64(1337)
+
+	otherKey, _ := crypto.GenerateKey()
+
+	sendRawTransaction := func(raw string) *RequestData {
+		return &RequestData{JsonRpc: "2.0", ID: json.RawMessage("1"), Method: "eth_sendRawTransaction", Params: []interface{}{raw}}
+	}
+
+	assert.Equal(t, nil, isValidCall(chainId, sendRawTransaction(signTestLegacyTransaction(t, testTxKey, 1337, testTxTo))))
+	assert.Equal(t, nil, isValidCall(chainId, sendRawTransaction(signTestDynamicFeeTransaction(t, testTxKey, 1337, testTxTo))))
+	assert.Equal(t, DeniedSender, isValidCall(chainId, sendRawTransaction(signTestLegacyTransaction(t, otherKey, 1337, testTxTo))))
+	assert.Equal(t, DeniedSender, isValidCall(chainId, sendRawTransaction(signTestDynamicFeeTransaction(t, otherKey, 1337, testTxTo))))
+	assert.Equal(t, DeniedChainId, isValidCall(chainId, sendRawTransaction(signTestDynamicFeeTransaction(t, testTxKey, 1, testTxTo))))
+
+	call := func(from string) *RequestData {
+		args := map[string]interface{}{"to": "0x06898143df04616a8a8f9614deb3b99ba12b3096"}
+		if from != "" {
+			args["from"] = from
+		}
+		return &RequestData{JsonRpc: "2.0", ID: json.RawMessage("1"), Method: "eth_call", Params: []interface{}{args, "latest"}}
+	}
+
+	assert.Equal(t, nil, isValidCall(chainId, call(sender)))
+	assert.Equal(t, DeniedSender, isValidCall(chainId, call(crypto.PubkeyToAddress(otherKey.PublicKey).Hex())))
+	assert.Equal(t, DeniedSender, isValidCall(chainId, call("")))
+}
@@ -6,12 +6,18 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 var counter *prometheus.CounterVec
 var gauge *prometheus.GaugeVec
 var histogram *prometheus.HistogramVec
+var upstreamCounter *prometheus.CounterVec
+var upstreamHistogram *prometheus.HistogramVec
+var upstreamInFlightGauge *prometheus.GaugeVec
+var upstreamLagGauge *prometheus.GaugeVec
+var reorgDepthGauge *prometheus.GaugeVec
 
 func init() {
 	histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -29,9 +35,39 @@ func init() {
 		Help: "gauge",
 	}, []string{"key"})
 
+	upstreamCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_counter",
+		Help: "upstream counter",
+	}, []string{"chain_id", "upstream", "key"})
+
+	upstreamHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "upstream_latency",
+		Help: "upstream latency in ms",
+	}, []string{"chain_id", "upstream"})
+
+	upstreamInFlightGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "upstream_in_flight",
+		Help: "upstream in-flight requests",
+	}, []string{"chain_id", "upstream"})
+
+	upstreamLagGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "upstream_lag_blocks",
+		Help: "upstream blocks behind the chain head",
+	}, []string{"chain_id", "upstream"})
+
+	reorgDepthGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "reorg_depth",
+		Help: "orphaned blocks of the last reorg",
+	}, []string{"chain_id"})
+
 	prometheus.MustRegister(counter)
 	prometheus.MustRegister(gauge)
 	prometheus.MustRegister(histogram)
+	prometheus.MustRegister(upstreamCounter)
+	prometheus.MustRegister(upstreamHistogram)
+	prometheus.MustRegister(upstreamInFlightGauge)
+	prometheus.MustRegister(upstreamLagGauge)
+	prometheus.MustRegister(reorgDepthGauge)
 }
 
 func Time(key string, value float64) {
@@ -46,6 +82,27 @@ func Value(key string, value float64) {
 	gauge.WithLabelValues(key).Set(value)
 }
 
+// the upstream metrics are labeled with the chain id too, chains may share an upstream name
+func CountUpstream(chainId uint64, upstream string, key string) {
+	upstreamCounter.WithLabelValues(strconv.FormatUint(chainId, 10), upstream, key).Inc()
+}
+
+func TimeUpstream(chainId uint64, upstream string, value float64) {
+	upstreamHistogram.WithLabelValues(strconv.FormatUint(chainId, 10), upstream).Observe(value)
+}
+
+func ValueUpstreamInFlight(chainId uint64, upstream string, value int64) {
+	upstreamInFlightGauge.WithLabelValues(strconv.FormatUint(chainId, 10), upstream).Set(float64(value))
+}
+
+func ValueUpstreamLag(chainId uint64, upstream string, blocks uint64) {
+	upstreamLagGauge.WithLabelValues(strconv.FormatUint(chainId, 10), upstream).Set(float64(blocks))
+}
+
+func ValueReorgDepth(chainId uint64, blocks int) {
+	reorgDepthGauge.WithLabelValues(strconv.FormatUint(chainId, 10)).Set(float64(blocks))
+}
+
 func Handler() http.Handler {
 	return promhttp.Handler()
 }
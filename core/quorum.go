@@ -0,0 +1,96 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+var QuorumNotReachedError = fmt.Errorf("quorum not reached, upstreams disagree")
+
+// QuorumConfig is used by the QUORUM strategy, the request is sent to Size upstreams
+// and Threshold of them must return the same response.
+type QuorumConfig struct {
+	// Size is how many upstreams get the request, default all
+	Size int `json:"size"`
+	// Threshold is how many upstreams must agree, default the majority of Size
+	Threshold int `json:"threshold"`
+}
+
+// resolve applies the defaults and checks the config against the upstreams count
+func (c *QuorumConfig) resolve(upstreams int) (size int, threshold int, err error) {
+	if c != nil {
+		size, threshold = c.Size, c.Threshold
+	}
+
+	if size == 0 {
+		size = upstreams
+	}
+
+	if threshold == 0 {
+		threshold = size/2 + 1
+	}
+
+	if size < 2 || size > upstreams {
+		return 0, 0, fmt.Errorf("quorum size should be between 2 and the upstreams count %d, got %d", upstreams, size)
+	}
+
+	if threshold < 1 || threshold > size {
+		return 0, 0, fmt.Errorf("quorum threshold should be between 1 and the size %d, got %d", size, threshold)
+	}
+
+	return size, threshold, nil
+}
+
+// normalizeResponse returns the part of a response the upstreams should agree on.
+// The result, or the error, is decoded and encoded again so the spacing and the
+// order of the keys don't matter, and hex strings are compared in lower case.
+func normalizeResponse(bts []byte) (string, error) {
+	var resp struct {
+		Error  *JsonRpcError    `json:"error"`
+		Result *json.RawMessage `json:"result"`
+	}
+
+	if err := json.Unmarshal(bts, &resp); err != nil {
+		return "", err
+	}
+
+	if resp.Error != nil {
+		return fmt.Sprintf("error %d %s", resp.Error.Code, resp.Error.Message), nil
+	}
+
+	if resp.Result == nil {
+		return "null", nil
+	}
+
+	var result interface{}
+	if err := json.Unmarshal(*resp.Result, &result); err != nil {
+		return "", err
+	}
+
+	normalized, err := json.Marshal(lowerHexStrings(result))
+	if err != nil {
+		return "", err
+	}
+
+	return string(normalized), nil
+}
+
+func lowerHexStrings(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+			return strings.ToLower(v)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = lowerHexStrings(v[i])
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = lowerHexStrings(v[key])
+		}
+	}
+
+	return v
+}
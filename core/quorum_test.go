@@ -0,0 +1,51 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuorumConfigResolve(t *testing.T) {
+	size, threshold, err := (*QuorumConfig)(nil).resolve(3)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, size)
+	assert.Equal(t, 2, threshold)
+
+	size, threshold, err = (&QuorumConfig{Size: 4}).resolve(5)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, size)
+	assert.Equal(t, 3, threshold)
+
+	_, _, err = (&QuorumConfig{Size: 4}).resolve(3)
+	assert.NotNil(t, err)
+
+	_, _, err = (&QuorumConfig{Threshold: 4}).resolve(3)
+	assert.NotNil(t, err)
+
+	_, _, err = (*QuorumConfig)(nil).resolve(1)
+	assert.NotNil(t, err)
+}
+
+func TestNormalizeResponse(t *testing.T) {
+	a, err := normalizeResponse([]byte(`{"jsonrpc": "2.0", "id": 1, "result": {"hash": "0xABCD", "number": "0x1"}}`))
+	assert.Nil(t, err)
+
+	b, err := normalizeResponse([]byte(`{"id":2,"result":{"number":"0x1","hash":"0xabcd"},"jsonrpc":"2.0"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, a, b)
+
+	c, _ := normalizeResponse([]byte(`{"jsonrpc": "2.0", "id": 1, "result": {"hash": "0xabce", "number": "0x1"}}`))
+	assert.NotEqual(t, a, c)
+
+	// only hex strings ignore the case
+	d, _ := normalizeResponse([]byte(`{"jsonrpc": "2.0", "id": 1, "result": "Hello"}`))
+	e, _ := normalizeResponse([]byte(`{"jsonrpc": "2.0", "id": 1, "result": "hello"}`))
+	assert.NotEqual(t, d, e)
+
+	f, _ := normalizeResponse([]byte(`{"jsonrpc": "2.0", "id": 1, "error": {"code": 3, "message": "execution reverted"}}`))
+	assert.Equal(t, "error 3 execution reverted", f)
+
+	_, err = normalizeResponse([]byte(`bad gateway`))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,304 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var RateLimitedError = fmt.Errorf("rate limit exceeded")
+
+const rateLimitCleanupInterval = 10 * time.Minute
+
+// TokenBucketConfig allows Rate tokens per second with bursts up to Burst tokens.
+type TokenBucketConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+type RateLimitConfig struct {
+	PerIp    *TokenBucketConfig `json:"perIp"`
+	PerKey   *TokenBucketConfig `json:"perKey"`
+	PerChain *TokenBucketConfig `json:"perChain"`
+	// PerMethod limits a method of a chain for all clients
+	PerMethod map[string]TokenBucketConfig `json:"perMethod"`
+	// MethodWeights is the tokens a method costs, default 1
+	MethodWeights map[string]float64 `json:"methodWeights"`
+}
+
+func (c *TokenBucketConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+
+	if c.Rate <= 0 || c.Burst <= 0 {
+		return fmt.Errorf("rate limit needs positive rate and burst, got %+v", *c)
+	}
+
+	return nil
+}
+
+func (c *RateLimitConfig) validate() error {
+	for method, weight := range c.MethodWeights {
+		if weight < 0 {
+			return fmt.Errorf("%s: negative method weight %v", method, weight)
+		}
+	}
+
+	for _, cfg := range []*TokenBucketConfig{c.PerIp, c.PerKey, c.PerChain} {
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+
+		if err := c.validateBurst(cfg); err != nil {
+			return err
+		}
+	}
+
+	for method, cfg := range c.PerMethod {
+		cfg := cfg
+		if err := cfg.validate(); err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+
+		if weight, ok := c.MethodWeights[method]; ok && weight > cfg.Burst {
+			return fmt.Errorf("%s: method weight %v is greater than burst %v", method, weight, cfg.Burst)
+		}
+	}
+
+	return nil
+}
+
+// validateBurst rejects the method weights greater than the burst of a bucket, the bucket never has enough tokens for them
+func (c *RateLimitConfig) validateBurst(bucket *TokenBucketConfig) error {
+	if c == nil || bucket == nil {
+		return nil
+	}
+
+	for method, weight := range c.MethodWeights {
+		if weight > bucket.Burst {
+			return fmt.Errorf("%s: method weight %v is greater than burst %v", method, weight, bucket.Burst)
+		}
+	}
+
+	return nil
+}
+
+type tokenBucket struct {
+	sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastTime time.Time
+}
+
+func newTokenBucket(cfg *TokenBucketConfig) *tokenBucket {
+	return &tokenBucket{
+		rate:     cfg.Rate,
+		burst:    cfg.Burst,
+		tokens:   cfg.Burst,
+		lastTime: time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !now.After(b.lastTime) {
+		return
+	}
+
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.lastTime).Seconds()*b.rate)
+	b.lastTime = now
+}
+
+// take returns the tokens left, or how long to wait when there are not enough tokens.
+func (b *tokenBucket) take(n float64, now time.Time) (bool, float64, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(now)
+
+	if b.tokens < n {
+		wait := time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+		return false, b.tokens, wait
+	}
+
+	b.tokens -= n
+
+	return true, b.tokens, 0
+}
+
+func (b *tokenBucket) refund(n float64) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.tokens = math.Min(b.burst, b.tokens+n)
+}
+
+func (b *tokenBucket) isIdle(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(now)
+
+	return b.tokens >= b.burst
+}
+
+// RateLimitStatus is the state of the tightest bucket a request went through
+type RateLimitStatus struct {
+	Limit      float64
+	Remaining  float64
+	RetryAfter time.Duration
+}
+
+func (s *RateLimitStatus) setHeaders(header http.Header) {
+	header.Set("X-RateLimit-Limit", strconv.FormatFloat(math.Floor(s.Limit), 'f', -1, 64))
+	header.Set("X-RateLimit-Remaining", strconv.FormatFloat(math.Floor(s.Remaining), 'f', -1, 64))
+
+	if s.RetryAfter > 0 {
+		header.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(s.RetryAfter.Seconds())), 10))
+	}
+}
+
+type rateLimiter struct {
+	config  RateLimitConfig
+	buckets sync.Map // scope key => *tokenBucket
+}
+
+func newRateLimiter(ctx context.Context, cfg RateLimitConfig) (*rateLimiter, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	l := &rateLimiter{config: cfg}
+
+	runInBackground(ctx, func() {
+		l.cleanup(ctx)
+	})
+
+	return l, nil
+}
+
+// cleanup drops the buckets which are full again, they are the same as new ones
+func (l *rateLimiter) cleanup(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			l.buckets.Range(func(key, value interface{}) bool {
+				if value.(*tokenBucket).isIdle(now) {
+					l.buckets.Delete(key)
+				}
+				return true
+			})
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *rateLimiter) getBucket(key string, cfg *TokenBucketConfig) *tokenBucket {
+	if value, ok := l.buckets.Load(key); ok {
+		return value.(*tokenBucket)
+	}
+
+	value, _ := l.buckets.LoadOrStore(key, newTokenBucket(cfg))
+
+	return value.(*tokenBucket)
+}
+
+func (l *rateLimiter) methodWeight(method string) float64 {
+	if weight, ok := l.config.MethodWeights[method]; ok {
+		return weight
+	}
+
+	return 1
+}
+
+type rateLimitScope struct {
+	name string
+	key  string
+	cfg  *TokenBucketConfig
+}
+
+func (l *rateLimiter) scopes(req *Request) []rateLimitScope {
+	var scopes []rateLimitScope
+
+	if l.config.PerIp != nil && req.client.remoteAddr != "" {
+		ip, _, err := net.SplitHostPort(req.client.remoteAddr)
+		if err != nil {
+			ip = req.client.remoteAddr
+		}
+		scopes = append(scopes, rateLimitScope{"ip", "ip:" + ip, l.config.PerIp})
+	}
+
+	if req.client.apiKey != "" {
+		cfg := l.config.PerKey
+
+		if apiKey, ok := getRunningConfig().apiKeys[req.client.apiKey]; ok && apiKey.rateLimit != nil {
+			cfg = apiKey.rateLimit
+		}
+
+		if cfg != nil {
+			scopes = append(scopes, rateLimitScope{"key", "key:" + req.client.apiKey, cfg})
+		}
+	}
+
+	chainCfg := l.config.PerChain
+	if rateLimit := req.getChain().rateLimit; rateLimit != nil {
+		chainCfg = rateLimit
+	}
+
+	if chainCfg != nil {
+		scopes = append(scopes, rateLimitScope{"chain", fmt.Sprintf("chain:%d", req.chainId), chainCfg})
+	}
+
+	if cfg, ok := l.config.PerMethod[req.data.Method]; ok {
+		scopes = append(scopes, rateLimitScope{"method", fmt.Sprintf("method:%d:%s", req.chainId, req.data.Method), &cfg})
+	}
+
+	return scopes
+}
+
+// allow takes the method weight from every bucket of the request, or from none of them.
+func (l *rateLimiter) allow(req *Request) (*RateLimitStatus, error) {
+	weight := l.methodWeight(req.data.Method)
+	now := time.Now()
+
+	var status *RateLimitStatus
+	var taken []*tokenBucket
+
+	for _, scope := range l.scopes(req) {
+		bucket := l.getBucket(scope.key, scope.cfg)
+		ok, remaining, wait := bucket.take(weight, now)
+
+		if !ok {
+			for _, b := range taken {
+				b.refund(weight)
+			}
+
+			status = &RateLimitStatus{Limit: scope.cfg.Burst, Remaining: remaining, RetryAfter: wait}
+
+			Count("rate_limited")
+			Count("rate_limited_" + scope.name)
+			req.logger.Infof("rate limited by %s, method: %s, weight: %v", scope.name, req.data.Method, weight)
+
+			return status, RateLimitedError
+		}
+
+		taken = append(taken, bucket)
+
+		if status == nil || remaining < status.Remaining {
+			status = &RateLimitStatus{Limit: scope.cfg.Burst, Remaining: remaining}
+		}
+	}
+
+	return status, nil
+}
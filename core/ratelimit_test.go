@@ -0,0 +1,128 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(&TokenBucketConfig{Rate: 10, Burst: 2})
+	now := bucket.lastTime
+
+	ok, remaining, _ := bucket.take(1, now)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, float64(1), remaining)
+
+	ok, _, _ = bucket.take(1, now)
+	assert.Equal(t, true, ok)
+
+	ok, _, wait := bucket.take(1, now)
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 100*time.Millisecond, wait)
+
+	ok, _, _ = bucket.take(1, now.Add(100*time.Millisecond))
+	assert.Equal(t, true, ok)
+
+	bucket.refund(5)
+	assert.Equal(t, float64(2), bucket.tokens)
+	assert.Equal(t, true, bucket.isIdle(now.Add(time.Second)))
+}
+
+func TestRateLimitConfigValidate(t *testing.T) {
+	assert.Equal(t, nil, (&RateLimitConfig{PerIp: &TokenBucketConfig{Rate: 1, Burst: 1}}).validate())
+	assert.NotEqual(t, nil, (&RateLimitConfig{PerIp: &TokenBucketConfig{Rate: 0, Burst: 1}}).validate())
+	assert.NotEqual(t, nil, (&RateLimitConfig{PerMethod: map[string]TokenBucketConfig{"eth_getLogs": {}}}).validate())
+	assert.NotEqual(t, nil, (&RateLimitConfig{MethodWeights: map[string]float64{"eth_getLogs": -1}}).validate())
+
+	// a weight greater than a burst never passes the bucket
+	assert.NotEqual(t, nil, (&RateLimitConfig{PerIp: &TokenBucketConfig{Rate: 1, Burst: 5}, MethodWeights: map[string]float64{"eth_getLogs": 10}}).validate())
+	assert.NotEqual(t, nil, (&RateLimitConfig{PerMethod: map[string]TokenBucketConfig{"eth_getLogs": {Rate: 1, Burst: 5}}, MethodWeights: map[string]float64{"eth_getLogs": 10}}).validate())
+	assert.Equal(t, nil, (&RateLimitConfig{PerMethod: map[string]TokenBucketConfig{"eth_call": {Rate: 1, Burst: 5}}, MethodWeights: map[string]float64{"eth_getLogs": 10}}).validate())
+	assert.NotEqual(t, nil, (&RateLimitConfig{MethodWeights: map[string]float64{"eth_getLogs": 10}}).validateBurst(&TokenBucketConfig{Rate: 1, Burst: 5}))
+}
+
+func TestServeHTTPRateLimit(t *testing.T) {
+	upstream := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return data.Method
+	})
+	defer upstream.Close()
+
+	var testConfigStr = fmt.Sprintf(`{
+		"rateLimit": {
+			"perIp": {"rate": 0.001, "burst": 5},
+			"perMethod": {"eth_chainId": {"rate": 0.001, "burst": 1}},
+			"methodWeights": {"eth_getLogs": 3}
+		},
+		"1337": {
+			"upstreams": ["%s"],
+			"strategy": "NAIVE",
+			"methodLimitationEnabled": false
+		}
+	}`, upstream.URL)
+
+	config := NewConfig()
+	globalConfig := NewGlobalConfig()
+
+	err := json.Unmarshal([]byte(testConfigStr), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = json.Unmarshal([]byte(testConfigStr), globalConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfigs(context.Background(), config, globalConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &Server{}
+
+	post := func(remoteAddr string, method string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"jsonrpc": "2.0", "id": 1, "method": "%s", "params": ["rate limit"]}`, method)
+		req := httptest.NewRequest(http.MethodPost, "/http/1337", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+
+		return recorder
+	}
+
+	recorder := post("10.0.0.1:1000", "eth_getLogs")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "5", recorder.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "2", recorder.Header().Get("X-RateLimit-Remaining"))
+
+	// only 2 tokens left for this ip
+	recorder = post("10.0.0.1:1001", "eth_getLogs")
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.NotEqual(t, "", recorder.Header().Get("Retry-After"))
+	assert.Contains(t, recorder.Body.String(), RateLimitedError.Error())
+
+	recorder = post("10.0.0.1:1002", "eth_blockNumber")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// the method limit is shared by all clients
+	recorder = post("10.0.0.2:1000", "eth_chainId")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	recorder = post("10.0.0.3:1000", "eth_chainId")
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+
+	// the ip bucket of 10.0.0.3 is refunded when the method bucket is empty
+	recorder = post("10.0.0.3:1000", "eth_getLogs")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "2", recorder.Header().Get("X-RateLimit-Remaining"))
+}
@@ -0,0 +1,223 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/sirupsen/logrus"
+)
+
+const minReorgTrackDepth = 128
+
+type blockHeader struct {
+	Number     hexutil.Uint64 `json:"number"`
+	Hash       string         `json:"hash"`
+	ParentHash string         `json:"parentHash"`
+}
+
+// reorgTracker keeps the hashes of the recent canonical blocks of a chain, and finds
+// the orphaned ones when a known height gets another hash.
+type reorgTracker struct {
+	chainId  uint64
+	depth    uint64   // how many blocks below the head are tracked
+	upstream Upstream // the upstream of the current check, its blocks are compared together
+	fetch    func(blockParam string) (*blockHeader, error)
+
+	hashes map[uint64]string // height => hash
+	lowest uint64
+	head   uint64
+}
+
+func newReorgTracker(chainId uint64, finalityDepth uint64) *reorgTracker {
+	depth := 2 * finalityDepth
+	if depth < minReorgTrackDepth {
+		depth = minReorgTrackDepth
+	}
+
+	t := &reorgTracker{
+		chainId: chainId,
+		depth:   depth,
+		hashes:  make(map[uint64]string),
+	}
+
+	t.fetch = func(blockParam string) (*blockHeader, error) {
+		return fetchBlockHeader(t.upstream, blockParam)
+	}
+
+	return t
+}
+
+// pickReorgUpstream is the available upstream of the default route with the highest block,
+// the blocks are read from a single upstream rather than through the strategy of the chain
+func pickReorgUpstream(chainId uint64) Upstream {
+	rcfg := getRunningConfig()
+	if rcfg == nil || rcfg.Configs[chainId] == nil {
+		return nil
+	}
+
+	cfg := rcfg.Configs[chainId]
+
+	cfg.updateLocker.RLock()
+	defer cfg.updateLocker.RUnlock()
+
+	var picked Upstream
+	for _, up := range cfg.defaultRoute.upstreams {
+		if isAvailable(up) && (picked == nil || up.getBlockNumber() > picked.getBlockNumber()) {
+			picked = up
+		}
+	}
+
+	return picked
+}
+
+func fetchBlockHeader(upstream Upstream, blockParam string) (*blockHeader, error) {
+	if upstream == nil {
+		return nil, NoValidUpstreamError
+	}
+
+	req, err := parseRequest(upstream.getInfo().chainId, []byte(fmt.Sprintf(
+		`{"params": ["%s", false], "method": "eth_getBlockByNumber", "id": %d, "jsonrpc": "2.0"}`, blockParam, time.Now().Unix())))
+	if err != nil {
+		return nil, err
+	}
+
+	bts, err := upstream.handle(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Result *blockHeader `json:"result"`
+	}
+
+	if err := json.Unmarshal(bts, &res); err != nil {
+		return nil, err
+	}
+
+	if res.Result == nil || res.Result.Hash == "" {
+		return nil, fmt.Errorf("block %s not found", blockParam)
+	}
+
+	res.Result.Hash = strings.ToLower(res.Result.Hash)
+	res.Result.ParentHash = strings.ToLower(res.Result.ParentHash)
+
+	return res.Result, nil
+}
+
+// update records the new head and walks back until it meets a known block,
+// it returns the orphaned blocks, height => old hash.
+func (t *reorgTracker) update(head *blockHeader) (map[uint64]string, error) {
+	orphans := make(map[uint64]string)
+	number := uint64(head.Number)
+
+	if number < t.head {
+		if hash, ok := t.hashes[number]; !ok || hash == head.Hash {
+			// the head comes from a lagging upstream
+			return orphans, nil
+		}
+
+		// the new chain is shorter
+		for n := number + 1; n <= t.head; n++ {
+			if hash, ok := t.hashes[n]; ok {
+				orphans[n] = hash
+				delete(t.hashes, n)
+			}
+		}
+	}
+
+	for n := range t.hashes {
+		if n+t.depth < number {
+			delete(t.hashes, n)
+		}
+	}
+
+	if number > t.depth && t.lowest < number-t.depth {
+		t.lowest = number - t.depth
+	}
+
+	if len(t.hashes) == 0 {
+		t.lowest = number
+	}
+
+	t.head = number
+
+	block := head
+	for {
+		n := uint64(block.Number)
+
+		if hash, ok := t.hashes[n]; ok {
+			if hash == block.Hash {
+				break
+			}
+
+			orphans[n] = hash
+		}
+
+		t.hashes[n] = block.Hash
+
+		if n == 0 || n <= t.lowest {
+			break
+		}
+
+		if parentHash, ok := t.hashes[n-1]; ok && parentHash == block.ParentHash {
+			break
+		}
+
+		// the parent is unknown or orphaned
+		var err error
+		block, err = t.fetch(hexutil.EncodeUint64(n - 1))
+		if err != nil {
+			return orphans, err
+		}
+	}
+
+	return orphans, nil
+}
+
+func (t *reorgTracker) check() {
+	t.upstream = pickReorgUpstream(t.chainId)
+
+	head, err := t.fetch("latest")
+	if err != nil {
+		logrus.Debugf("reorg check of chain %d failed: %v", t.chainId, err)
+		return
+	}
+
+	orphans, err := t.update(head)
+
+	if len(orphans) > 0 {
+		evicted := evictBlocks(t.chainId, orphans)
+
+		Count(fmt.Sprintf("reorg_%d", t.chainId))
+		ValueReorgDepth(t.chainId, len(orphans))
+
+		logrus.WithFields(logrus.Fields{
+			"chain_id":      t.chainId,
+			"head":          uint64(head.Number),
+			"reorg_depth":   len(orphans),
+			"evicted_cache": evicted,
+		}).Warnf("chain %d reorg detected, %d blocks orphaned", t.chainId, len(orphans))
+	}
+
+	if err != nil {
+		logrus.Debugf("reorg check of chain %d failed: %v", t.chainId, err)
+	}
+}
+
+func (t *reorgTracker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.check()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// testChain builds headers whose hashes are made of the fork name and the height
+type testChain map[uint64]*blockHeader
+
+func (c testChain) add(fork string, from uint64, to uint64) {
+	for n := from; n <= to; n++ {
+		parentFork := fork
+		if parent, ok := c[n-1]; ok && n == from {
+			parentFork = parent.Hash[:len(parent.Hash)-len(fmt.Sprintf("-%d", n-1))]
+		}
+
+		c[n] = &blockHeader{
+			Number:     hexutil.Uint64(n),
+			Hash:       fmt.Sprintf("%s-%d", fork, n),
+			ParentHash: fmt.Sprintf("%s-%d", parentFork, n-1),
+		}
+	}
+}
+
+func newTestReorgTracker(chain testChain) *reorgTracker {
+	tracker := newReorgTracker(1337, 64)
+	tracker.fetch = func(blockParam string) (*blockHeader, error) {
+		n, _ := hexutil.DecodeUint64(blockParam)
+		return chain[n], nil
+	}
+
+	return tracker
+}
+
+func TestReorgTrackerUpdate(t *testing.T) {
+	chain := testChain{}
+	chain.add("a", 1, 10)
+
+	tracker := newTestReorgTracker(chain)
+
+	orphans, err := tracker.update(chain[10])
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(orphans))
+
+	// the gap is filled with the parents
+	chain.add("a", 11, 13)
+	orphans, _ = tracker.update(chain[13])
+	assert.Equal(t, 0, len(orphans))
+	assert.Equal(t, "a-11", tracker.hashes[11])
+
+	// a lagging upstream is not a reorg
+	orphans, _ = tracker.update(chain[12])
+	assert.Equal(t, 0, len(orphans))
+	assert.Equal(t, uint64(13), tracker.head)
+
+	// blocks 12 and 13 are replaced
+	chain.add("b", 12, 14)
+	orphans, _ = tracker.update(chain[14])
+	assert.Equal(t, map[uint64]string{12: "a-12", 13: "a-13"}, orphans)
+	assert.Equal(t, "b-12", tracker.hashes[12])
+
+	// the new chain is shorter
+	chain.add("c", 13, 13)
+	delete(chain, 14)
+	orphans, _ = tracker.update(chain[13])
+	assert.Equal(t, map[uint64]string{13: "b-13", 14: "b-14"}, orphans)
+	assert.Equal(t, uint64(13), tracker.head)
+}
+
+func TestEvictBlocks(t *testing.T) {
+	add := func(key string, chainId uint64, body string, result string) {
+		var data RequestData
+		_ = json.Unmarshal([]byte(body), &data)
+
+		getCache().Add(key, newCacheEntry(chainId, &data, json.RawMessage(result)))
+	}
+
+	add("reorg-1", 7777, `{"method": "eth_getBlockByNumber", "params": ["0xc", false]}`, `{"number": "0xc"}`)
+	add("reorg-2", 7777, `{"method": "eth_getLogs", "params": [{"fromBlock": "0x1", "toBlock": "0x10"}]}`, `[]`)
+	add("reorg-3", 7777, `{"method": "eth_getTransactionReceipt", "params": ["0x01"]}`, `{"blockNumber": "0x20", "blockHash": "0xAB"}`)
+	add("reorg-4", 7777, `{"method": "eth_getBlockByNumber", "params": ["0xb", false]}`, `{"number": "0xb"}`)
+	add("reorg-5", 8888, `{"method": "eth_getBlockByNumber", "params": ["0xc", false]}`, `{"number": "0xc"}`)
+	add("reorg-6", 7777, `{"method": "eth_chainId", "params": []}`, `"0x1"`)
+
+	evicted := evictBlocks(7777, map[uint64]string{12: "0x00", 32: "0xab"})
+	assert.Equal(t, 3, evicted)
+
+	for key, exist := range map[string]bool{
+		"reorg-1": false,
+		"reorg-2": false,
+		"reorg-3": false,
+		"reorg-4": true,
+		"reorg-5": true,
+		"reorg-6": true,
+	} {
+		assert.Equal(t, exist, getCache().Contains(key), key)
+	}
+}
@@ -1,9 +1,12 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ivanzzeth/ethereum-jsonrpc-gateway/utils"
@@ -12,17 +15,109 @@ import (
 
 var TimeoutError = fmt.Errorf("timeout error")
 var AllUpstreamsFailedError = fmt.Errorf("all upstream requests are failed")
+var ChainNotSupportedError = fmt.Errorf("chain not supported")
+var InvalidRequestError = fmt.Errorf("invalid request")
+var ParseError = fmt.Errorf("parse error")
+var InvalidChainIdError = fmt.Errorf("invalid chain id")
+var HttpMethodError = fmt.Errorf("http method should be POST")
+var ProtocolError = fmt.Errorf("protocol should be http or ws")
+var EmptyBatchError = fmt.Errorf("empty batch")
+var BatchTooLargeError = fmt.Errorf("batch too large")
 
 type Request struct {
 	logger               *logrus.Entry
 	chainId              uint64
 	data                 *RequestData
 	reqBytes             []byte
-	isArchiveDataRequest bool
+	isArchiveDataRequest int32 // set by isOldTrieRequest, the upstreams of a request may send it at once
+	client               *clientInfo
+	chain                *RunningChainConfig // the chain when the request came, nil before a config is running
+	session              *session            // nil when the consistency is disabled
+	ctx                  context.Context     // cancels the upstream requests, nil means never
+}
+
+// clientInfo describes where a request comes from
+type clientInfo struct {
+	remoteAddr string
+	apiKey     string
+	session    string        // the SessionHeader
+	conn       *wsClientConn // nil for http clients
+
+	rateLimitLocker sync.Mutex
+	rateLimitStatus *RateLimitStatus
+}
+
+// setRateLimitStatus keeps the tightest status among the requests of a batch
+func (c *clientInfo) setRateLimitStatus(status *RateLimitStatus) {
+	c.rateLimitLocker.Lock()
+	defer c.rateLimitLocker.Unlock()
+
+	if c.rateLimitStatus == nil || status.RetryAfter > c.rateLimitStatus.RetryAfter ||
+		(c.rateLimitStatus.RetryAfter == 0 && status.Remaining < c.rateLimitStatus.Remaining) {
+		c.rateLimitStatus = status
+	}
+}
+
+func (c *clientInfo) getRateLimitStatus() *RateLimitStatus {
+	c.rateLimitLocker.Lock()
+	defer c.rateLimitLocker.Unlock()
+
+	return c.rateLimitStatus
+}
+
+// getChain returns the chain of the request, a chain rebuilt meanwhile serves the next requests
+func (r *Request) getChain() *RunningChainConfig {
+	if r.chain != nil {
+		return r.chain
+	}
+
+	if rcfg := getRunningConfig(); rcfg != nil {
+		return rcfg.Configs[r.chainId]
+	}
+
+	return nil
+}
+
+func (r *Request) getContext() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+
+	return r.ctx
+}
+
+// withContext returns a shallow copy of the request whose upstream requests are cancelled with ctx
+func (r *Request) withContext(ctx context.Context) *Request {
+	req := *r
+	req.ctx = ctx
+
+	return &req
+}
+
+// upstreamBody is the request sent to an upstream, with the id of the upstream request
+// instead of the one of the client, so concurrent upstream requests never share an id
+func (r *Request) upstreamBody(id int64) ([]byte, error) {
+	return withID(r.reqBytes, json.RawMessage(strconv.FormatInt(id, 10)))
+}
+
+// clientResponse checks the upstream response answers the upstream request, and gives it the id of the client back
+func (r *Request) clientResponse(bts []byte, id int64) ([]byte, error) {
+	respID, err := upstreamID(bts)
+	if err != nil {
+		logrus.Warnf("%v", err)
+		return nil, err
+	}
+
+	if respID != id {
+		logrus.Warnf("not match request's ID, reqId=%v, respId=%v", id, respID)
+		return nil, fmt.Errorf("not match request's ID, reqId=%v, respId=%v", id, respID)
+	}
+
+	return withID(bts, r.data.ID)
 }
 
 func getBlockNumberRequest(chainId uint64) *Request {
-	res, err := newRequest(chainId, []byte(fmt.Sprintf(`{"params": [], "method": "eth_blockNumber", "id": %d, "jsonrpc": "2.0"}`, time.Now().Unix())))
+	res, err := parseRequest(chainId, []byte(fmt.Sprintf(`{"params": [], "method": "eth_blockNumber", "id": %d, "jsonrpc": "2.0"}`, time.Now().Unix())))
 	if err != nil {
 		panic(err)
 	}
@@ -31,7 +126,11 @@ func getBlockNumberRequest(chainId uint64) *Request {
 
 func (r *Request) isOldTrieRequest(currentBlockNumber int) (res bool) {
 	defer func() {
-		r.isArchiveDataRequest = res
+		if res {
+			atomic.StoreInt32(&r.isArchiveDataRequest, 1)
+		} else {
+			atomic.StoreInt32(&r.isArchiveDataRequest, 0)
+		}
 	}()
 
 	method := r.data.Method
@@ -100,10 +199,34 @@ func (r *Request) isOldTrieRequest(currentBlockNumber int) (res bool) {
 }
 
 func newRequest(chainId uint64, reqBodyBytes []byte) (*Request, error) {
+	return newClientRequest(chainId, reqBodyBytes, &clientInfo{})
+}
+
+func newClientRequest(chainId uint64, reqBodyBytes []byte, client *clientInfo) (*Request, error) {
+	req, err := parseRequest(chainId, reqBodyBytes)
+	req.client = client
+
+	if err != nil {
+		return req, err
+	}
+
+	// method limit, for directly external access
+	err = req.valid()
+
+	if err != nil {
+		return req, err
+	}
+
+	return req, nil
+}
+
+// parseRequest builds a request without the method limitation, which is only
+// meant for requests sent by the gateway itself.
+func parseRequest(chainId uint64, reqBodyBytes []byte) (*Request, error) {
 	logger := logrus.WithFields(logrus.Fields{"request_id": utils.RandStringRunes(8)})
 
 	var data RequestData
-	_ = json.Unmarshal(reqBodyBytes, &data)
+	err := json.Unmarshal(reqBodyBytes, &data)
 
 	logger.Debugf("New, method: %s\n", data.Method)
 	logger.Debugf("Request Body: %s\n", string(reqBodyBytes))
@@ -115,23 +238,37 @@ func newRequest(chainId uint64, reqBodyBytes []byte) (*Request, error) {
 		reqBytes: reqBodyBytes,
 	}
 
-	// method limit, for directly external access
-	err := req.valid()
+	if rcfg := getRunningConfig(); rcfg != nil {
+		req.chain = rcfg.Configs[chainId]
+	}
 
-	if err != nil {
-		return req, err
+	// a half-parsed request is dropped, only its id is kept when it's valid
+	if !json.Valid(reqBodyBytes) {
+		data = RequestData{}
+		return req, ParseError
+	}
+
+	if err != nil || data.Method == "" || !validID(data.ID) {
+		data = RequestData{ID: invalidRequestID(reqBodyBytes)}
+		return req, InvalidRequestError
 	}
 
 	return req, nil
 }
 
 func (r *Request) valid() error {
+	err := r.validApiKey()
 
-	if !currentRunningConfig.Configs[r.chainId].MethodLimitationEnabled {
+	if err != nil {
+		r.logger.Printf("api key not valid, skip\n")
+		return err
+	}
+
+	if !r.getChain().MethodLimitationEnabled {
 		return nil
 	}
 
-	err := isValidCall(r.chainId, r.data)
+	err = isValidCall(r.chainId, r.data)
 
 	if err != nil {
 		r.logger.Printf("not valid, skip\n")
@@ -140,3 +277,41 @@ func (r *Request) valid() error {
 
 	return nil
 }
+
+func (r *Request) rateLimit() error {
+	limiter := getRunningConfig().rateLimiter
+	if limiter == nil {
+		return nil
+	}
+
+	status, err := limiter.allow(r)
+
+	if status != nil {
+		r.client.setRateLimitStatus(status)
+	}
+
+	return err
+}
+
+// validApiKey looks the key up on every request, so that a hot reload
+// applies to opened websocket connections as well.
+func (r *Request) validApiKey() error {
+	var key string
+	if r.client != nil {
+		key = r.client.apiKey
+	}
+
+	apiKey, err := authenticate(key)
+
+	if err != nil {
+		return err
+	}
+
+	if apiKey == nil {
+		return nil
+	}
+
+	r.logger = r.logger.WithField("api_key", apiKey.Name)
+
+	return apiKey.isValidCall(r.chainId, r.data)
+}
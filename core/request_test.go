@@ -15,6 +15,7 @@ import (
 func TestGetBlockNumberRequest(t *testing.T) {
 	chainId := uint64(1337)
 
+	defer closeTestConfig()
 	initTestConfig(t)
 	req := getBlockNumberRequest(chainId)
 	assert.Equal(t, "eth_blockNumber", req.data.Method)
@@ -91,6 +92,7 @@ func TestIsOldTrieRequest(t *testing.T) {
 
 func TestNewRequest(t *testing.T) {
 	chainId := uint64(1337)
+	defer closeTestConfig()
 	initTestConfig(t)
 
 	reqBodyBytes1 := []byte(fmt.Sprintf(`{"params": [], "method": "eth_blockNumber", "id": %d, "jsonrpc": "2.0"}`, time.Now().Unix()))
@@ -134,7 +136,8 @@ func TestValid(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
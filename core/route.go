@@ -0,0 +1,171 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RouteConfig sends some methods of a chain to a subset of its upstreams
+type RouteConfig struct {
+	// Methods are method names, or prefixes ending with *, e.g. "trace_*"
+	Methods []string `json:"methods"`
+	// Upstreams are the names of the upstreams serving the methods
+	Upstreams []string `json:"upstreams"`
+	// Strategy of the route, default is the strategy of the chain
+	Strategy string `json:"strategy"`
+	// Dedicated upstreams only serve their routes, they are kept out of the default pool
+	Dedicated bool `json:"dedicated"`
+}
+
+type runningRoute struct {
+	methods   map[string]bool
+	prefixes  []string
+	names     map[string]bool // nil for the default route
+	dedicated bool
+	size      int // upstreams of the route, the disabled ones included
+	upstreams []Upstream
+	strategy  IStrategy
+}
+
+func newRunningRoute(cfg RouteConfig, upstreamNames map[string]bool) (*runningRoute, error) {
+	if len(cfg.Methods) == 0 || len(cfg.Upstreams) == 0 {
+		return nil, fmt.Errorf("route needs methods and upstreams")
+	}
+
+	route := &runningRoute{
+		methods:   make(map[string]bool),
+		names:     make(map[string]bool),
+		dedicated: cfg.Dedicated,
+	}
+
+	for _, method := range cfg.Methods {
+		if strings.HasSuffix(method, "*") {
+			route.prefixes = append(route.prefixes, strings.TrimSuffix(method, "*"))
+		} else {
+			route.methods[method] = true
+		}
+	}
+
+	for _, name := range cfg.Upstreams {
+		if !upstreamNames[name] {
+			return nil, fmt.Errorf("route of %v: unknown upstream %s", cfg.Methods, name)
+		}
+		route.names[name] = true
+	}
+
+	return route, nil
+}
+
+func (r *runningRoute) match(method string) bool {
+	if r.methods[method] {
+		return true
+	}
+
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// route returns the first route matching the method, or the default route
+func (c *RunningChainConfig) route(method string) *runningRoute {
+	for _, route := range c.routes {
+		if route.match(method) {
+			return route
+		}
+	}
+
+	return c.defaultRoute
+}
+
+// updateRoutes fills the routes with their upstreams, in the order of the chain upstreams,
+// disabled and lagging upstreams are left out. The caller holds the updateLocker.
+func (c *RunningChainConfig) updateRoutes() {
+	dedicated := make(map[string]bool)
+
+	for _, route := range c.routes {
+		route.upstreams = nil
+
+		for _, up := range c.Upstreams {
+			if route.names[up.getName()] {
+				route.upstreams = append(route.upstreams, up)
+			}
+		}
+
+		route.size = len(route.upstreams)
+		route.upstreams = withoutLagging(withoutDisabled(route.upstreams))
+
+		if route.dedicated {
+			for name := range route.names {
+				dedicated[name] = true
+			}
+		}
+	}
+
+	c.defaultRoute.upstreams = nil
+	for _, up := range c.Upstreams {
+		if !dedicated[up.getName()] {
+			c.defaultRoute.upstreams = append(c.defaultRoute.upstreams, up)
+		}
+	}
+
+	c.defaultRoute.size = len(c.defaultRoute.upstreams)
+	c.defaultRoute.upstreams = withoutLagging(withoutDisabled(c.defaultRoute.upstreams))
+}
+
+// withoutDisabled leaves the disabled upstreams out
+func withoutDisabled(upstreams []Upstream) []Upstream {
+	var kept []Upstream
+
+	for _, up := range upstreams {
+		if !up.getInfo().disabled {
+			kept = append(kept, up)
+		}
+	}
+
+	return kept
+}
+
+// emptyRoute returns a route whose upstreams are all disabled, the caller holds the updateLocker
+func (c *RunningChainConfig) emptyRoute() *runningRoute {
+	for _, route := range c.routes {
+		if len(route.upstreams) == 0 {
+			return route
+		}
+	}
+
+	if len(c.defaultRoute.upstreams) == 0 {
+		return c.defaultRoute
+	}
+
+	return nil
+}
+
+// getUpstream returns the upstream of the name, nil if there is none
+func (c *RunningChainConfig) getUpstream(name string) Upstream {
+	for _, up := range c.Upstreams {
+		if up.getName() == name {
+			return up
+		}
+	}
+
+	return nil
+}
+
+// handle sends the request to the strategy of its route, transactions are broadcast if enabled
+func (c *RunningChainConfig) handle(req *Request) ([]byte, error) {
+	if req.data.Method == "eth_sendRawTransaction" && c.broadcast != nil {
+		return c.broadcast.handle(req)
+	}
+
+	return c.route(req.data.Method).strategy.handle(req)
+}
+
+// getUpstreams returns the upstreams of the route of the request which fit its session,
+// strategies call it holding the updateLocker of the chain.
+func getUpstreams(req *Request) []Upstream {
+	return req.session.filter(req.getChain().route(req.data.Method).upstreams)
+}
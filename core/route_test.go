@@ -0,0 +1,118 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunningRouteMatch(t *testing.T) {
+	route, err := newRunningRoute(RouteConfig{
+		Methods:   []string{"trace_*", "eth_getLogs"},
+		Upstreams: []string{"erigon"},
+	}, map[string]bool{"erigon": true})
+	assert.Nil(t, err)
+
+	assert.True(t, route.match("trace_block"))
+	assert.True(t, route.match("eth_getLogs"))
+	assert.False(t, route.match("eth_getLogsX"))
+	assert.False(t, route.match("debug_traceTransaction"))
+
+	_, err = newRunningRoute(RouteConfig{Methods: []string{"trace_*"}, Upstreams: []string{"unknown"}}, map[string]bool{"erigon": true})
+	assert.NotNil(t, err)
+
+	_, err = newRunningRoute(RouteConfig{Upstreams: []string{"erigon"}}, map[string]bool{"erigon": true})
+	assert.NotNil(t, err)
+}
+
+func TestBuildRunningConfigRoutes(t *testing.T) {
+	public := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return "public"
+	})
+	defer public.Close()
+	erigon := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return "erigon"
+	})
+	defer erigon.Close()
+
+	defer closeTestConfig()
+	build := func(routes string) error {
+		config := NewConfig()
+		err := json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {
+			"upstreams": [{"url": "%s", "name": "public"}, {"url": "%s", "name": "erigon"}],
+			"strategy": "NAIVE",
+			"routes": %s
+		}}`, public.URL, erigon.URL, routes)), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = BuildRunningConfigFromConfig(context.Background(), config)
+		return err
+	}
+
+	err := build(`[
+		{"methods": ["trace_*", "debug_traceTransaction"], "upstreams": ["erigon"], "dedicated": true},
+		{"methods": ["eth_getLogs"], "upstreams": ["public", "erigon"], "strategy": "FALLBACK"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := getRunningConfig().Configs[1337]
+	assert.IsType(t, &FallbackProxy{}, cfg.route("eth_getLogs").strategy)
+	assert.IsType(t, &NaiveProxy{}, cfg.route("trace_block").strategy)
+	assert.Equal(t, cfg.Strategy, cfg.route("eth_gasPrice").strategy)
+
+	for method, upstream := range map[string]string{
+		"trace_block":            "erigon",
+		"debug_traceTransaction": "erigon",
+		"eth_gasPrice":           "public",
+	} {
+		req, err := newRequest(1337, []byte(fmt.Sprintf(`{"params": [], "method": "%s", "id": 1, "jsonrpc": "2.0"}`, method)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bts, err := cfg.handle(req)
+		assert.Nil(t, err)
+		assert.Contains(t, string(bts), fmt.Sprintf(`"result":"%s"`, upstream), method)
+	}
+
+	// the default pool can't be empty
+	assert.NotNil(t, build(`[{"methods": ["trace_*"], "upstreams": ["public", "erigon"], "dedicated": true}]`))
+
+	// the route strategy is checked against its pool
+	assert.NotNil(t, build(`[{"methods": ["trace_*"], "upstreams": ["erigon"], "dedicated": true, "strategy": "WEIGHTED"}]`))
+}
+
+func TestBuildRunningConfigRouteStrategyErrors(t *testing.T) {
+	upstream := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return "ok"
+	})
+	defer upstream.Close()
+
+	// the legacy strategies return errors for a wrong pool size too
+	config := NewConfig()
+	err := json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {
+		"upstreams": [{"url": "%s", "name": "public"}, {"url": "%s", "name": "erigon"}],
+		"strategy": "FALLBACK",
+		"routes": [{"methods": ["trace_*"], "upstreams": ["erigon"], "strategy": "RACE"}]
+	}}`, upstream.URL, upstream.URL)), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	assert.EqualError(t, err, "chain 1337 route of [trace_*]: race proxy strategy require more than 1 upstream")
+
+	config = NewConfig()
+	_ = json.Unmarshal([]byte(`{"1337": {"upstreams": ["xxx://node"], "strategy": "NAIVE"}}`), config)
+
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JSON-RPC error codes of the failures of the gateway itself, the errors of
+// the upstreams are returned as they are
+const (
+	ParseErrorCode          int64 = -32700
+	InvalidRequestCode      int64 = -32600
+	MethodNotAllowedCode    int64 = -32601 // method not found or not allowed
+	InvalidParamsCode       int64 = -32602
+	InternalErrorCode       int64 = -32603
+	UpstreamUnavailableCode int64 = -32002 // EIP-1474 resource unavailable
+	LimitExceededCode       int64 = -32005 // EIP-1474 limit exceeded
+)
+
+// gatewayError is how a failure of the gateway is reported to the client
+type gatewayError struct {
+	code   int64
+	status int    // http status of a single request, batches are 200 with an error per element
+	reason string // the machine-readable data.reason of the error
+}
+
+var internalError = gatewayError{InternalErrorCode, http.StatusInternalServerError, "internal_error"}
+
+// the network failures of the upstreams, their messages may carry the upstream urls
+var upstreamNetworkError = gatewayError{UpstreamUnavailableCode, http.StatusBadGateway, "upstream_unavailable"}
+var upstreamTimeoutError = gatewayError{UpstreamUnavailableCode, http.StatusGatewayTimeout, "timeout"}
+
+var gatewayErrors = map[error]gatewayError{
+	ParseError:             {ParseErrorCode, http.StatusBadRequest, "parse_error"},
+	InvalidRequestError:    {InvalidRequestCode, http.StatusBadRequest, "invalid_request"},
+	EmptyBatchError:        {InvalidRequestCode, http.StatusBadRequest, "empty_batch"},
+	InvalidChainIdError:    {InvalidRequestCode, http.StatusBadRequest, "invalid_chain_id"},
+	ChainNotSupportedError: {InvalidRequestCode, http.StatusNotFound, "chain_not_supported"},
+	HttpMethodError:        {InvalidRequestCode, http.StatusMethodNotAllowed, "http_method_not_allowed"},
+	ProtocolError:          {InvalidRequestCode, http.StatusNotFound, "protocol_not_supported"},
+	DecodeError:            {InvalidParamsCode, http.StatusBadRequest, "decode_error"},
+
+	UnauthorizedError:              {MethodNotAllowedCode, http.StatusUnauthorized, "unauthorized"},
+	DeniedChain:                    {MethodNotAllowedCode, http.StatusForbidden, "denied_chain"},
+	DeniedMethod:                   {MethodNotAllowedCode, http.StatusForbidden, "denied_method"},
+	DeniedContract:                 {MethodNotAllowedCode, http.StatusForbidden, "denied_contract"},
+	DeniedContractCreation:         {MethodNotAllowedCode, http.StatusForbidden, "denied_contract_creation"},
+	DeniedSender:                   {MethodNotAllowedCode, http.StatusForbidden, "denied_sender"},
+	DeniedChainId:                  {MethodNotAllowedCode, http.StatusForbidden, "denied_chain_id"},
+	NotificationsNotSupportedError: {MethodNotAllowedCode, http.StatusBadRequest, "websocket_required"},
+	SubscriptionNotSupportedError:  {MethodNotAllowedCode, http.StatusNotImplemented, "subscription_not_supported"},
+
+	RateLimitedError:   {LimitExceededCode, http.StatusTooManyRequests, "rate_limited"},
+	BatchTooLargeError: {LimitExceededCode, http.StatusRequestEntityTooLarge, "batch_too_large"},
+
+	TimeoutError:             {UpstreamUnavailableCode, http.StatusGatewayTimeout, "timeout"},
+	context.DeadlineExceeded: {UpstreamUnavailableCode, http.StatusGatewayTimeout, "timeout"},
+	AllUpstreamsFailedError:  {UpstreamUnavailableCode, http.StatusBadGateway, "upstream_unavailable"},
+	NoValidUpstreamError:     {UpstreamUnavailableCode, http.StatusBadGateway, "upstream_unavailable"},
+	QuorumNotReachedError:    {UpstreamUnavailableCode, http.StatusBadGateway, "quorum_not_reached"},
+	CircuitOpenError:         {UpstreamUnavailableCode, http.StatusServiceUnavailable, "upstream_unavailable"},
+	UpstreamBusyError:        {UpstreamUnavailableCode, http.StatusServiceUnavailable, "upstream_unavailable"},
+	MethodNotSupportedError:  {UpstreamUnavailableCode, http.StatusServiceUnavailable, "upstream_unavailable"},
+}
+
+// toGatewayError maps an error, wrapped ones included, to its code, status and the message sent to the client.
+// Only the messages of the gateway errors are sent, network and unknown errors get a fixed message.
+func toGatewayError(err error) (gatewayError, string) {
+	if gwErr, ok := gatewayErrors[err]; ok {
+		return gwErr, err.Error()
+	}
+
+	for target, gwErr := range gatewayErrors {
+		if errors.Is(err, target) {
+			if gwErr.reason == "timeout" {
+				return gwErr, TimeoutError.Error()
+			}
+
+			return gwErr, target.Error()
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return upstreamTimeoutError, TimeoutError.Error()
+		}
+
+		return upstreamNetworkError, NoValidUpstreamError.Error()
+	}
+
+	logrus.Errorf("internal error: %v", err)
+
+	return internalError, "internal error"
+}
+
+// getErrorData is the data of the error, with the seconds to wait before retrying when rate limited
+func getErrorData(gwErr gatewayError, client *clientInfo) map[string]interface{} {
+	data := map[string]interface{}{"reason": gwErr.reason}
+
+	if gwErr.code == LimitExceededCode && client != nil {
+		if status := client.getRateLimitStatus(); status != nil && status.RetryAfter > 0 {
+			data["retryAfter"] = int64(math.Ceil(status.RetryAfter.Seconds()))
+		}
+	}
+
+	return data
+}
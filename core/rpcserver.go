@@ -1,12 +1,16 @@
 package core
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,21 +21,23 @@ var httpClient *http.Client
 
 const (
 	maxIdleConnections int = 200
-	requestTimeout     int = 10
+	wsWriteTimeout         = 10 * time.Second
+	wsClientQueueSize      = 256
 )
 
+var WsClientTooSlowError = fmt.Errorf("ws client too slow, connection closed")
+
 func init() {
 	httpClient = createHTTPClient()
 	rand.Seed(time.Now().UnixNano())
 }
 
-// createHTTPClient for connection re-use
+// createHTTPClient for connection re-use, the timeout is set per request by the requestTimeout of the chain
 func createHTTPClient() *http.Client {
 	return &http.Client{
 		Transport: &http.Transport{
 			MaxIdleConnsPerHost: maxIdleConnections,
 		},
-		Timeout: time.Duration(requestTimeout) * time.Second,
 	}
 }
 
@@ -45,74 +51,215 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-func (h *Server) ServerWS(chainId uint64, conn *websocket.Conn) error {
-	defer conn.Close()
+type wsMessage struct {
+	messageType int
+	bts         []byte
+}
+
+// wsClientConn queues the responses and subscription notifications of a client, they are written
+// in order by its own goroutine so that a slow client never blocks the upstreams
+type wsClientConn struct {
+	conn      *websocket.Conn
+	queue     chan wsMessage
+	done      chan struct{}
+	closeOnce sync.Once
+
+	managersLocker sync.Mutex
+	managers       map[*subscriptionManager]bool // managers holding subscriptions of the connection
+}
+
+func newWsClientConn(conn *websocket.Conn) *wsClientConn {
+	c := &wsClientConn{
+		conn:     conn,
+		queue:    make(chan wsMessage, wsClientQueueSize),
+		done:     make(chan struct{}),
+		managers: make(map[*subscriptionManager]bool),
+	}
+
+	go c.run()
+
+	return c
+}
 
+func (c *wsClientConn) run() {
 	for {
-		messageType, r, err := conn.NextReader()
-		if err != nil {
-			return err
+		select {
+		case msg := <-c.queue:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+
+			if err := c.conn.WriteMessage(msg.messageType, msg.bts); err != nil {
+				logrus.Debugf("write to ws client failed %v", err)
+				_ = c.close()
+				return
+			}
+		case <-c.done:
+			return
 		}
+	}
+}
+
+// write queues a response, the reading of the client waits while its queue is full
+func (c *wsClientConn) write(messageType int, bts []byte) error {
+	select {
+	case c.queue <- wsMessage{messageType, bts}:
+		return nil
+	case <-c.done:
+		return websocket.ErrCloseSent
+	}
+}
 
-		w, err := conn.NextWriter(messageType)
+// writeText queues a notification, a client whose queue is full is closed instead of waited for
+func (c *wsClientConn) writeText(bts []byte) error {
+	select {
+	case c.queue <- wsMessage{websocket.TextMessage, bts}:
+		return nil
+	case <-c.done:
+		return websocket.ErrCloseSent
+	default:
+		_ = c.close()
+		return WsClientTooSlowError
+	}
+}
 
-		if err != nil {
-			return err
-		}
+func (c *wsClientConn) close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
 
-		reqBodyBytes, _ := ioutil.ReadAll(r)
-		proxyRequest, err := newRequest(chainId, reqBodyBytes)
+	return c.conn.Close()
+}
 
-		if err != nil {
-			return err
-		}
+func (c *wsClientConn) addSubscriptionManager(m *subscriptionManager) {
+	c.managersLocker.Lock()
+	defer c.managersLocker.Unlock()
+
+	c.managers[m] = true
+}
+
+// moveSubscriptionManager replaces the manager of a rebuilt chain by the new one
+func (c *wsClientConn) moveSubscriptionManager(old *subscriptionManager, m *subscriptionManager) {
+	c.managersLocker.Lock()
+	defer c.managersLocker.Unlock()
+
+	if c.managers[old] {
+		delete(c.managers, old)
+		c.managers[m] = true
+	}
+}
+
+func (c *wsClientConn) removeSubscriptions() {
+	c.managersLocker.Lock()
+	managers := c.managers
+	c.managers = make(map[*subscriptionManager]bool)
+	c.managersLocker.Unlock()
 
-		Count(proxyRequest.data.Method)
+	for m := range managers {
+		m.removeConn(c)
+	}
+}
+
+func (h *Server) ServerWS(chainId uint64, conn *websocket.Conn, client *clientInfo) error {
+	wsConn := newWsClientConn(conn)
+	client.conn = wsConn
 
-		bts, err := currentRunningConfig.Configs[chainId].Strategy.handle(proxyRequest)
+	defer wsConn.close()
+	defer wsConn.removeSubscriptions()
 
+	for {
+		messageType, r, err := conn.NextReader()
 		if err != nil {
-			bts = getErrorResponseBytes(proxyRequest.data.ID, err.Error())
+			return err
 		}
 
-		if _, err := w.Write(bts); err != nil {
-			return err
+		reqBodyBytes, _ := ioutil.ReadAll(r)
+		bts, _ := h.handleBody(chainId, reqBodyBytes, client)
+		if bts == nil {
+			continue
 		}
 
-		if err := w.Close(); err != nil {
+		if err := wsConn.write(messageType, bts); err != nil {
 			return err
 		}
 	}
 }
 
-func getErrorResponseBytes(id interface{}, reason interface{}) []byte {
-	bts, _ := json.Marshal(map[string]interface{}{
-		"jsonrpc": "2.0",
-		"id":      id,
-		"error": map[string]interface{}{
-			"code":    -32602,
-			"message": reason,
+// getErrorResponse returns the response to a failure of the gateway with its http status
+func getErrorResponse(id json.RawMessage, err error, client *clientInfo) ([]byte, int) {
+	gwErr, message := toGatewayError(err)
+
+	bts, _ := json.Marshal(&JsonRpcResponse{
+		JsonRpc: "2.0",
+		ID:      id,
+		Err: &JsonRpcError{
+			Code:    gwErr.code,
+			Message: message,
+			Data:    getErrorData(gwErr, client),
 		},
 	})
 
+	return bts, gwErr.status
+}
+
+func getResultResponseBytes(id json.RawMessage, result json.RawMessage) []byte {
+	bts, _ := json.Marshal(&JsonRpcResponse{
+		JsonRpc: "2.0",
+		ID:      id,
+		Result:  result,
+	})
+
 	return bts
 }
 
+// writeError writes the error response of a request rejected before its body is read
+func writeError(w http.ResponseWriter, err error, client *clientInfo) {
+	bts, status := getErrorResponse(nil, err, client)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(bts)
+}
+
+// parseChainPath parses {chainId} and the optional {key} of /http/{chainId}/{key}
+func parseChainPath(path string, prefix string) (uint64, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)
+
+	chainId, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if len(parts) == 2 {
+		return chainId, parts[1], nil
+	}
+
+	return chainId, "", nil
+}
+
 // Support path:
-// 1. /ws/{chainId}
-// 2. /http/{chainId}
+// 1. /ws/{chainId} or /ws/{chainId}/{key}
+// 2. /http/{chainId} or /http/{chainId}/{key}
 func (h *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	var err error
 	if strings.HasPrefix(req.URL.Path, "/ws") {
-		chainIdStr := strings.Replace(req.URL.Path, "/ws/", "", 1)
-		chainId, err := strconv.ParseUint(chainIdStr, 10, 64)
+		chainId, pathKey, err := parseChainPath(req.URL.Path, "/ws/")
 		if err != nil {
-			w.WriteHeader(400)
-			_, _ = w.Write([]byte("Invalid ChainId"))
+			writeError(w, InvalidChainIdError, nil)
 			Count("bad_request")
 			return
 		}
 
+		client := &clientInfo{
+			remoteAddr: req.RemoteAddr,
+			apiKey:     getApiKeyFromRequest(req, pathKey),
+			session:    req.Header.Get(SessionHeader),
+		}
+
+		if _, err := authenticate(client.apiKey); err != nil {
+			writeError(w, err, client)
+			Count("unauthorized")
+			return
+		}
+
 		conn, err := upgrader.Upgrade(w, req, nil)
 
 		if err != nil {
@@ -120,12 +267,12 @@ func (h *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		_ = h.ServerWS(chainId, conn)
+		_ = h.ServerWS(chainId, conn, client)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+ApiKeyHeader+", "+SessionHeader)
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	if req.URL.Path == "/health" {
@@ -135,46 +282,163 @@ func (h *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if req.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	if req.Method != http.MethodPost {
-		w.WriteHeader(400)
-		_, _ = w.Write([]byte("Method Should Be POST"))
+		writeError(w, HttpMethodError, nil)
 		Count("bad_request")
 		return
 	}
 
 	if !strings.HasPrefix(req.URL.Path, "/http") {
-		w.WriteHeader(400)
-		_, _ = w.Write([]byte("protocol Should Be http or ws"))
+		writeError(w, ProtocolError, nil)
 		Count("bad_request")
 		return
 	}
 
-	if req.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
+	chainId, pathKey, err := parseChainPath(req.URL.Path, "/http/")
+	if err != nil {
+		writeError(w, InvalidChainIdError, nil)
+		Count("bad_request")
 		return
 	}
 
-	chainIdStr := strings.Replace(req.URL.Path, "/http/", "", 1)
-	chainId, err := strconv.ParseUint(chainIdStr, 10, 64)
-	if err != nil {
-		w.WriteHeader(400)
-		_, _ = w.Write([]byte("Invalid ChainId"))
-		Count("bad_request")
+	client := &clientInfo{
+		remoteAddr: req.RemoteAddr,
+		apiKey:     getApiKeyFromRequest(req, pathKey),
+		session:    req.Header.Get(SessionHeader),
+	}
+
+	if _, err := authenticate(client.apiKey); err != nil {
+		writeError(w, err, client)
+		Count("unauthorized")
 		return
 	}
 
-	startTime := time.Now()
 	reqBodyBytes, _ := ioutil.ReadAll(req.Body)
-	proxyRequest, err := newRequest(chainId, reqBodyBytes)
+	bts, status := h.handleBody(chainId, reqBodyBytes, client)
+
+	if rateLimitStatus := client.getRateLimitStatus(); rateLimitStatus != nil {
+		rateLimitStatus.setHeaders(w.Header())
+	}
+
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+
+	_, _ = w.Write(bts)
+}
+
+// handleBody serves a raw request body, which is either a single JSON-RPC request
+// or a batch of them, and returns the response body with its http status.
+func (h *Server) handleBody(chainId uint64, reqBodyBytes []byte, client *clientInfo) ([]byte, int) {
+	if _, ok := getRunningConfig().Configs[chainId]; !ok {
+		Count("bad_request")
+		return getErrorResponse(nil, ChainNotSupportedError, client)
+	}
+
+	if isBatchRequest(reqBodyBytes) {
+		return h.handleBatch(chainId, reqBodyBytes, client)
+	}
+
+	return h.handleSingle(chainId, reqBodyBytes, client)
+}
+
+// handleBatch serves every element of a batch on its own and joins the responses
+// in request order. Errors are reported per element, the batch itself only fails
+// when it is malformed, empty or larger than the chain's maxBatchSize.
+func (h *Server) handleBatch(chainId uint64, reqBodyBytes []byte, client *clientInfo) ([]byte, int) {
+	var items []json.RawMessage
+
+	if err := json.Unmarshal(reqBodyBytes, &items); err != nil {
+		Count("bad_request")
+		return getErrorResponse(nil, ParseError, client)
+	}
+
+	if len(items) == 0 {
+		Count("bad_request")
+		return getErrorResponse(nil, EmptyBatchError, client)
+	}
+
+	maxBatchSize := getRunningConfig().Configs[chainId].MaxBatchSize
+	if len(items) > maxBatchSize {
+		Count("bad_request")
+		logrus.Errorf("Batch from %s rejected, size %d exceeds %d", client.remoteAddr, len(items), maxBatchSize)
+		return getErrorResponse(nil, BatchTooLargeError, client)
+	}
+
+	Count("batch_request")
+
+	responses := make([][]byte, len(items))
+
+	var wg sync.WaitGroup
+	for i := range items {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			responses[i], _ = h.handleSingle(chainId, items[i], client)
+		}(i)
+	}
+
+	wg.Wait()
+
+	return joinBatchResponses(responses)
+}
+
+// handleSingle serves a single request, the notifications get no response
+func (h *Server) handleSingle(chainId uint64, reqBodyBytes []byte, client *clientInfo) ([]byte, int) {
+	proxyRequest, err := newClientRequest(chainId, reqBodyBytes, client)
+	bts, status := h.serveSingle(proxyRequest, err)
+
+	// notifications are still proxied, but never answered, even with an error
+	if err != InvalidRequestError && err != ParseError && proxyRequest.data.isNotification() {
+		return nil, http.StatusNoContent
+	}
+
+	return bts, status
+}
+
+func (h *Server) serveSingle(proxyRequest *Request, err error) ([]byte, int) {
+	client := proxyRequest.client
 	Count(proxyRequest.data.Method)
 
+	if err == nil {
+		err = proxyRequest.rateLimit()
+	}
+
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write(getErrorResponseBytes(proxyRequest.data.ID, err.Error()))
-		logrus.Errorf("Req from %s %s 500 %s", req.RemoteAddr, proxyRequest.data.Method, err.Error())
-		return
+		bts, status := getErrorResponse(proxyRequest.data.ID, err, client)
+		if status != http.StatusTooManyRequests {
+			logrus.Errorf("Req from %s %s %d %s", client.remoteAddr, proxyRequest.data.Method, status, err.Error())
+		}
+		return bts, status
 	}
 
+	proxyRequest.session = proxyRequest.getChain().sessions.get(client.sessionKey())
+
+	var bts []byte
+	if isSubscriptionRequest(proxyRequest.data.Method) {
+		bts, err = handleSubscriptionRequest(proxyRequest)
+	} else {
+		bts, err = h.handleRequest(proxyRequest)
+	}
+
+	if err != nil {
+		return getErrorResponse(proxyRequest.data.ID, err, client)
+	}
+
+	return bts, http.StatusOK
+}
+
+func (h *Server) handleRequest(proxyRequest *Request) ([]byte, error) {
+	chainId := proxyRequest.chainId
+	remoteAddr := proxyRequest.client.remoteAddr
+	startTime := time.Now()
+
 	rpcReqKey := &ReqCacheKey{
 		ChainId: chainId,
 		RequestData: RequestData{
@@ -185,32 +449,35 @@ func (h *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	reqKey, err := json.Marshal(rpcReqKey)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write(getErrorResponseBytes(proxyRequest.data.ID, err.Error()))
-		logrus.Errorf("Req from %s %s 500 %s", req.RemoteAddr, proxyRequest.data.Method, err.Error())
-		return
+		logrus.Errorf("Req from %s %s 500 %s", remoteAddr, proxyRequest.data.Method, err.Error())
+		return nil, err
 	}
 
-	if val, ok := getCache().Get(string(reqKey)); ok {
-		resp := val.([]byte)
-		_, _ = w.Write(resp)
+	finalized := proxyRequest.getChain().getFinalizedBlock()
+	cacheable, checkResult := isCacheableRequest(proxyRequest.data, finalized)
 
-		Count("hit_cache")
-		Count("hit_cache_" + proxyRequest.data.Method)
+	if cacheable {
+		if val, ok := getCache().Get(string(reqKey)); ok {
+			// the cache keeps the result only, the id belongs to the request
+			resp := getResultResponseBytes(proxyRequest.data.ID, val.(*cacheEntry).result)
 
-		trimedResp := resp
-		if len(trimedResp) > 200 {
-			trimedResp = trimedResp[:200]
+			Count("hit_cache")
+			Count("hit_cache_" + proxyRequest.data.Method)
+
+			trimedResp := resp
+			if len(trimedResp) > 200 {
+				trimedResp = trimedResp[:200]
+			}
+			logrus.Infof("Req for chain %d from %s %s(%v) 200 hits cache: %v", chainId, remoteAddr,
+				proxyRequest.data.Method, string(proxyRequest.reqBytes), string(trimedResp))
+
+			return resp, nil
 		}
-		logrus.Infof("Req for chain %d from %s %s(%v) 200 hits cache: %v", chainId, req.RemoteAddr,
-			proxyRequest.data.Method, string(proxyRequest.reqBytes), string(trimedResp))
 
-		return
+		Count("miss_cache")
+		Count("miss_cache_" + proxyRequest.data.Method)
 	}
 
-	Count("miss_cache")
-	Count("miss_cache_" + proxyRequest.data.Method)
-
 	var btsResp []byte
 
 	defer func() {
@@ -225,39 +492,54 @@ func (h *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			trimedResp = trimedResp[:200]
 		}
 		if err == nil {
-			// cache result
-			jsonRpcResp := &JsonRpcResponse{}
-			err = json.Unmarshal(btsResp, jsonRpcResp)
-			if err == nil {
-
-				if proxyRequest.isArchiveDataRequest && jsonRpcResp.Result != nil {
-					logrus.Infof("Req for chain %d from %s %s(%v) 200 and cache it: %v", chainId, req.RemoteAddr,
-						proxyRequest.data.Method, string(proxyRequest.reqBytes), string(trimedResp))
-					getCache().Add(string(reqKey), btsResp)
-				}
-			}
-
-			if !proxyRequest.isArchiveDataRequest {
-				logrus.Infof("Req for chain %d from %s %s(%v) 200: %v", chainId, req.RemoteAddr, proxyRequest.data.Method,
+			// cache result, errors and null results are never cached
+			var jsonRpcResp jsonRpcRawResponse
+			if cacheable && json.Unmarshal(btsResp, &jsonRpcResp) == nil && jsonRpcResp.Error == nil &&
+				isCacheableResult(jsonRpcResp.Result, finalized, checkResult) {
+				logrus.Infof("Req for chain %d from %s %s(%v) 200 and cache it: %v", chainId, remoteAddr,
+					proxyRequest.data.Method, string(proxyRequest.reqBytes), string(trimedResp))
+				getCache().Add(string(reqKey), newCacheEntry(chainId, proxyRequest.data, jsonRpcResp.Result))
+			} else {
+				logrus.Infof("Req for chain %d from %s %s(%v) 200: %v", chainId, remoteAddr, proxyRequest.data.Method,
 					string(proxyRequest.reqBytes), string(trimedResp))
 			}
 		}
 	}()
 
-	btsResp, err = currentRunningConfig.Configs[chainId].Strategy.handle(proxyRequest)
+	btsResp, err = proxyRequest.getChain().handle(proxyRequest)
 	var isArchiveRequestText string
-	if proxyRequest.isArchiveDataRequest {
+	if atomic.LoadInt32(&proxyRequest.isArchiveDataRequest) == 1 {
 		isArchiveRequestText = "(ArchiveData)"
 		logrus.Debug("archive data call: ", string(proxyRequest.reqBytes))
 	}
 
 	if err != nil {
-		w.WriteHeader(500)
-		_, _ = w.Write(getErrorResponseBytes(proxyRequest.data.ID, err.Error()))
-		logrus.Errorf("Req%s from %s %s(%v) 500 %s", isArchiveRequestText, req.RemoteAddr,
+		logrus.Errorf("Req%s from %s %s(%v) 500 %s", isArchiveRequestText, remoteAddr,
 			proxyRequest.data.Method, string(proxyRequest.reqBytes), err.Error())
-		return
+		return nil, err
+	}
+
+	return btsResp, nil
+}
+
+// isBatchRequest reports whether the body is a JSON array, i.e. a JSON-RPC batch.
+func isBatchRequest(reqBodyBytes []byte) bool {
+	trimmed := bytes.TrimLeft(reqBodyBytes, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// joinBatchResponses leaves the notifications out, a batch of notifications only gets no content
+func joinBatchResponses(responses [][]byte) ([]byte, int) {
+	var answered [][]byte
+	for _, response := range responses {
+		if response != nil {
+			answered = append(answered, response)
+		}
+	}
+
+	if len(answered) == 0 {
+		return nil, http.StatusNoContent
 	}
 
-	_, _ = w.Write(btsResp)
+	return append(append([]byte{'['}, bytes.Join(answered, []byte{','})...), ']'), http.StatusOK
 }
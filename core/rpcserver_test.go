@@ -2,10 +2,19 @@ package core
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -14,10 +23,43 @@ func TestCreateHTTPClient(t *testing.T) {
 	assert.IsType(t, &http.Client{}, createHTTPClient())
 }
 
-func TestGetErrorResponseBytes(t *testing.T) {
-	bts := getErrorResponseBytes(1, "test msg")
+func TestGetErrorResponse(t *testing.T) {
+	bts, status := getErrorResponse(json.RawMessage("1"), DeniedMethod, nil)
 
-	assert.Equal(t, "{\"error\":{\"code\":-32602,\"message\":\"test msg\"},\"id\":1,\"jsonrpc\":\"2.0\"}", string(bts))
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, `{"error":{"code":-32601,"message":"not allowed method","data":{"reason":"denied_method"}},"id":1,"jsonrpc":"2.0"}`, string(bts))
+
+	bts, status = getErrorResponse(nil, fmt.Errorf("boom"), nil)
+
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, `{"error":{"code":-32603,"message":"internal error","data":{"reason":"internal_error"}},"id":null,"jsonrpc":"2.0"}`, string(bts))
+
+	// the messages of network errors carry the upstream urls, they are not sent
+	_, err := http.Post("http://127.0.0.1:1/secret-key", "application/json", nil)
+	bts, status = getErrorResponse(json.RawMessage("1"), err, nil)
+
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Equal(t, `{"error":{"code":-32002,"message":"no valid upstream","data":{"reason":"upstream_unavailable"}},"id":1,"jsonrpc":"2.0"}`, string(bts))
+
+	bts, status = getErrorResponse(json.RawMessage("1"), &url.Error{Op: "Post", URL: "http://node/secret-key", Err: context.DeadlineExceeded}, nil)
+
+	assert.Equal(t, http.StatusGatewayTimeout, status)
+	assert.Equal(t, `{"error":{"code":-32002,"message":"timeout error","data":{"reason":"timeout"}},"id":1,"jsonrpc":"2.0"}`, string(bts))
+
+	bts, status = getErrorResponse(json.RawMessage("1"), fmt.Errorf("chain 1: %w", RateLimitedError), nil)
+
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, `{"error":{"code":-32005,"message":"rate limit exceeded","data":{"reason":"rate_limited"}},"id":1,"jsonrpc":"2.0"}`, string(bts))
+
+	client := &clientInfo{}
+	client.setRateLimitStatus(&RateLimitStatus{RetryAfter: 1500 * time.Millisecond})
+	bts, status = getErrorResponse(json.RawMessage(`"a"`), RateLimitedError, client)
+
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, `{"error":{"code":-32005,"message":"rate limit exceeded","data":{"reason":"rate_limited","retryAfter":2}},"id":"a","jsonrpc":"2.0"}`, string(bts))
+
+	bts = getResultResponseBytes(json.RawMessage("2"), nil)
+	assert.Equal(t, `{"id":2,"jsonrpc":"2.0","result":null}`, string(bts))
 }
 
 func TestServeHTTP(t *testing.T) {
@@ -37,3 +79,266 @@ func TestServeHTTP(t *testing.T) {
 
 	assert.Equal(t, 1, 1)
 }
+
+// newTestUpstreamServer starts a fake node answering every request with result(data).
+func newTestUpstreamServer(result func(data *RequestData) interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bts, _ := ioutil.ReadAll(r.Body)
+
+		var data RequestData
+		_ = json.Unmarshal(bts, &data)
+
+		resBts, _ := json.Marshal(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      data.ID,
+			"result":  result(&data),
+		})
+		_, _ = w.Write(resBts)
+	}))
+}
+
+func initTestConfigWithUpstream(t *testing.T, upstreamUrl string, extra string) {
+	var testConfigStr = fmt.Sprintf(`{
+		"1337": {
+			"upstreams": ["%s"],
+			"strategy": "NAIVE",
+			"methodLimitationEnabled": true,
+			"allowedMethods": ["eth_blockNumber", "eth_chainId"],
+			"contractWhitelist": []%s
+		}
+	}`, upstreamUrl, extra)
+
+	config := NewConfig()
+
+	err := json.Unmarshal([]byte(testConfigStr), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeHTTPBatch(t *testing.T) {
+	upstream := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return data.Method
+	})
+	defer upstream.Close()
+
+	defer closeTestConfig()
+	initTestConfigWithUpstream(t, upstream.URL, `, "maxBatchSize": 3`)
+
+	server := &Server{}
+
+	body := `[
+		{"jsonrpc": "2.0", "id": 1, "method": "eth_blockNumber", "params": []},
+		{"jsonrpc": "2.0", "id": 2, "method": "eth_getBalance", "params": []},
+		{"jsonrpc": "2.0", "id": 3, "method": "eth_chainId", "params": []}
+	]`
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/http/1337", strings.NewReader(body)))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var responses []JsonRpcResponse
+	err := json.Unmarshal(recorder.Body.Bytes(), &responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 3, len(responses))
+	assert.Equal(t, json.RawMessage("1"), responses[0].ID)
+	assert.Equal(t, "eth_blockNumber", responses[0].Result)
+	assert.Equal(t, json.RawMessage("2"), responses[1].ID)
+	assert.Equal(t, DeniedMethod.Error(), responses[1].Err.Message)
+	assert.Equal(t, json.RawMessage("3"), responses[2].ID)
+	assert.Equal(t, "eth_chainId", responses[2].Result)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/http/1337", strings.NewReader(`[]`)))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), EmptyBatchError.Error())
+
+	tooLarge := "[" + strings.Repeat(`{"jsonrpc": "2.0", "id": 1, "method": "eth_chainId", "params": []},`, 4)
+	tooLarge = strings.TrimSuffix(tooLarge, ",") + "]"
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/http/1337", strings.NewReader(tooLarge)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), BatchTooLargeError.Error())
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/http/1337", strings.NewReader(`[1, {"jsonrpc": "2.0", "id": 5, "method": "eth_chainId"}]`)))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	responses = nil
+	err = json.Unmarshal(recorder.Body.Bytes(), &responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, InvalidRequestError.Error(), responses[0].Err.Message)
+	assert.Equal(t, "eth_chainId", responses[1].Result)
+}
+
+func TestServeHTTPRequestIds(t *testing.T) {
+	var upstreamIds []string
+	var locker sync.Mutex
+
+	upstream := newTestUpstreamServer(func(data *RequestData) interface{} {
+		locker.Lock()
+		upstreamIds = append(upstreamIds, string(data.ID))
+		locker.Unlock()
+
+		return data.Method
+	})
+	defer upstream.Close()
+
+	defer closeTestConfig()
+	initTestConfigWithUpstream(t, upstream.URL, "")
+
+	server := &Server{}
+
+	post := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/http/1337", strings.NewReader(body)))
+		return recorder
+	}
+
+	// the ids are returned exactly as sent
+	for _, id := range []string{`"abc-1"`, `123456789012345678901234567890`, `null`, `-7`} {
+		recorder := post(fmt.Sprintf(`{"jsonrpc": "2.0", "id": %s, "method": "eth_chainId", "params": []}`, id))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		var resp JsonRpcResponse
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+		assert.Equal(t, json.RawMessage(id), resp.ID)
+		assert.Equal(t, "eth_chainId", resp.Result)
+	}
+
+	// the upstreams got ids of their own
+	locker.Lock()
+	for _, id := range upstreamIds {
+		_, err := strconv.ParseInt(id, 10, 64)
+		assert.Nil(t, err)
+	}
+	locker.Unlock()
+
+	// notifications are proxied without response
+	recorder := post(`{"jsonrpc": "2.0", "method": "eth_chainId", "params": []}`)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, 0, recorder.Body.Len())
+
+	recorder = post(`[{"jsonrpc": "2.0", "method": "eth_chainId"}, {"jsonrpc": "2.0", "id": "x", "method": "eth_chainId"}]`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var responses []JsonRpcResponse
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &responses))
+	assert.Equal(t, 1, len(responses))
+	assert.Equal(t, json.RawMessage(`"x"`), responses[0].ID)
+
+	recorder = post(`[{"jsonrpc": "2.0", "method": "eth_chainId"}, {"jsonrpc": "2.0", "method": "eth_getBalance"}]`)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+}
+
+func TestServeHTTPErrors(t *testing.T) {
+	upstream := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return data.Method
+	})
+	defer upstream.Close()
+
+	defer closeTestConfig()
+	initTestConfigWithUpstream(t, upstream.URL, "")
+
+	server := &Server{}
+
+	send := func(method string, path string, body string) (int, *JsonRpcResponse) {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+
+		resp := &JsonRpcResponse{}
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), resp))
+		assert.NotContains(t, recorder.Body.String(), `"result"`)
+
+		return recorder.Code, resp
+	}
+
+	status, resp := send(http.MethodPost, "/http/1337", `{"jsonrpc": "2.0", "id": 1, "method": `)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, ParseErrorCode, resp.Err.Code)
+	assert.Equal(t, json.RawMessage("null"), resp.ID)
+
+	status, resp = send(http.MethodPost, "/http/1337", `{"jsonrpc": "2.0", "id": 5, "params": {}}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, InvalidRequestCode, resp.Err.Code)
+	assert.Equal(t, json.RawMessage("5"), resp.ID)
+
+	status, resp = send(http.MethodPost, "/http/1337", `{"jsonrpc": "2.0", "id": 6, "method": "eth_getBalance", "params": []}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, MethodNotAllowedCode, resp.Err.Code)
+	assert.Equal(t, map[string]interface{}{"reason": "denied_method"}, resp.Err.Data)
+
+	status, resp = send(http.MethodPost, "/http/1", `{"jsonrpc": "2.0", "id": 7, "method": "eth_chainId", "params": []}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, InvalidRequestCode, resp.Err.Code)
+
+	status, resp = send(http.MethodGet, "/http/1337", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+	assert.Equal(t, InvalidRequestCode, resp.Err.Code)
+
+	status, resp = send(http.MethodPost, "/http/chain", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, InvalidRequestCode, resp.Err.Code)
+
+	for _, id := range []string{`{"a": 1}`, `[1]`, `true`} {
+		status, resp = send(http.MethodPost, "/http/1337", `{"jsonrpc": "2.0", "id": `+id+`, "method": "eth_chainId", "params": []}`)
+		assert.Equal(t, http.StatusBadRequest, status, id)
+		assert.Equal(t, InvalidRequestCode, resp.Err.Code, id)
+		assert.Equal(t, json.RawMessage("null"), resp.ID, id)
+	}
+
+	// the url of a refused upstream isn't sent to the client
+	initTestConfigWithUpstream(t, "http://127.0.0.1:1/secret-key", "")
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/http/1337", strings.NewReader(`{"jsonrpc": "2.0", "id": 8, "method": "eth_blockNumber", "params": []}`)))
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), "secret-key")
+	assert.Contains(t, recorder.Body.String(), `"code":-32002`)
+}
+
+func TestWsClientConnSlowClient(t *testing.T) {
+	conns := make(chan *wsClientConn, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		conns <- newWsClientConn(conn)
+	}))
+	defer server.Close()
+
+	// the client never reads
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn := <-conns
+	notification := []byte(strings.Repeat("x", 64*1024))
+
+	// notifications never wait for the client, it's closed once its queue is full
+	for i := 0; i < 10000; i++ {
+		if err = conn.writeText(notification); err != nil {
+			break
+		}
+	}
+
+	assert.Equal(t, WsClientTooSlowError, err)
+	assert.Equal(t, websocket.ErrCloseSent, conn.writeText(notification))
+	assert.Equal(t, websocket.ErrCloseSent, conn.write(websocket.TextMessage, notification))
+}
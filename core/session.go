@@ -0,0 +1,271 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionHeader groups the requests of a client into a consistency session
+const SessionHeader = "X-Session-Id"
+
+const (
+	defaultWritePin   = 30 * time.Second
+	defaultSessionTTL = 10 * time.Minute
+)
+
+// ConsistencyConfig keeps the view of every client session consistent across upstreams:
+// the block height never goes backwards, and reads follow the upstream of the last write.
+type ConsistencyConfig struct {
+	Enabled bool `json:"enabled"`
+	// WritePin is how long the reads go to the upstream which took the last write, default 30s
+	WritePin *Duration `json:"writePin"`
+	// SessionTTL drops the sessions idle for that long, default 10m
+	SessionTTL *Duration `json:"sessionTTL"`
+}
+
+// isWriteMethod tells the methods which pin the session to their upstream
+func isWriteMethod(method string) bool {
+	return method == "eth_sendRawTransaction" || method == "eth_sendTransaction"
+}
+
+// session is what a client has seen so far
+type session struct {
+	sync.Mutex
+	writePin time.Duration
+
+	minBlock      uint64
+	writeUpstream string
+	wroteAt       time.Time
+
+	lastSeen time.Time // guarded by the store
+}
+
+// observe raises the height seen by the client, and pins it to the upstream of a write
+func (s *session) observe(upstream string, height uint64, wrote bool) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if height > s.minBlock {
+		s.minBlock = height
+	}
+
+	if wrote {
+		s.writeUpstream = upstream
+		s.wroteAt = time.Now()
+	}
+}
+
+// filter keeps the upstreams the session can read from: the upstream of a recent write,
+// or the ones at or beyond the height seen by the client. When none has reached it yet,
+// the ones with the highest known block are the closest.
+func (s *session) filter(upstreams []Upstream) []Upstream {
+	if s == nil {
+		return upstreams
+	}
+
+	s.Lock()
+	minBlock, writeUpstream, wroteAt := s.minBlock, s.writeUpstream, s.wroteAt
+	s.Unlock()
+
+	if writeUpstream != "" && time.Since(wroteAt) < s.writePin {
+		for _, up := range upstreams {
+			if up.getName() == writeUpstream && isAvailable(up) {
+				return []Upstream{up}
+			}
+		}
+	}
+
+	if minBlock == 0 {
+		return upstreams
+	}
+
+	var eligible, highest []Upstream
+	var highestBlock uint64
+
+	for _, up := range upstreams {
+		block := up.getInfo().getKnownBlock()
+
+		if block >= minBlock {
+			eligible = append(eligible, up)
+		}
+
+		if len(highest) == 0 || block > highestBlock {
+			highest, highestBlock = []Upstream{up}, block
+		} else if block == highestBlock {
+			highest = append(highest, up)
+		}
+	}
+
+	if len(eligible) == 0 {
+		return highest
+	}
+
+	return eligible
+}
+
+// sessionStore holds the sessions of a chain
+type sessionStore struct {
+	sync.Mutex
+	writePin  time.Duration
+	ttl       time.Duration
+	sessions  map[string]*session
+	lastSweep time.Time
+}
+
+// newSessionStore returns nil when the consistency is disabled
+func newSessionStore(cfg *ConsistencyConfig) (*sessionStore, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	s := &sessionStore{
+		writePin:  defaultWritePin,
+		ttl:       defaultSessionTTL,
+		sessions:  make(map[string]*session),
+		lastSweep: time.Now(),
+	}
+
+	if cfg.WritePin != nil {
+		if *cfg.WritePin < 0 {
+			return nil, fmt.Errorf("consistency: writePin can't be negative")
+		}
+		s.writePin = time.Duration(*cfg.WritePin)
+	}
+
+	if cfg.SessionTTL != nil {
+		if *cfg.SessionTTL <= 0 {
+			return nil, fmt.Errorf("consistency: sessionTTL should be positive")
+		}
+		s.ttl = time.Duration(*cfg.SessionTTL)
+	}
+
+	return s, nil
+}
+
+// get returns the session of the key, a blank key has no session
+func (s *sessionStore) get(key string) *session {
+	if s == nil || key == "" {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(s.lastSweep) > s.ttl {
+		for k, sess := range s.sessions {
+			if now.Sub(sess.lastSeen) > s.ttl {
+				delete(s.sessions, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	sess, ok := s.sessions[key]
+	if !ok {
+		sess = &session{writePin: s.writePin}
+		s.sessions[key] = sess
+	}
+	sess.lastSeen = now
+
+	return sess
+}
+
+// sessionKey is the session header if set, then the ws connection, then the api key.
+// Anonymous http clients without the header have no session.
+func (c *clientInfo) sessionKey() string {
+	switch {
+	case c.session != "":
+		return fmt.Sprintf("session:%s:%s", c.apiKey, c.session)
+	case c.conn != nil:
+		return fmt.Sprintf("conn:%p", c.conn)
+	case c.apiKey != "":
+		return "key:" + c.apiKey
+	}
+
+	return ""
+}
+
+// responseBlock returns the height a response proves the upstream has reached
+func responseBlock(method string, bts []byte) (uint64, bool) {
+	var field string
+
+	switch method {
+	case "eth_blockNumber":
+	case "eth_getBlockByNumber", "eth_getBlockByHash":
+		field = "number"
+	case "eth_getTransactionReceipt", "eth_getTransactionByHash":
+		field = "blockNumber"
+	default:
+		return 0, false
+	}
+
+	var resp jsonRpcRawResponse
+	if err := json.Unmarshal(bts, &resp); err != nil || resp.Error != nil {
+		return 0, false
+	}
+
+	var height string
+
+	if field == "" {
+		if err := json.Unmarshal(resp.Result, &height); err != nil {
+			return 0, false
+		}
+	} else {
+		var result map[string]interface{}
+		if err := json.Unmarshal(resp.Result, &result); err != nil {
+			return 0, false
+		}
+		height, _ = result[field].(string)
+	}
+
+	n, err := strconv.ParseUint(height, 0, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// getKnownBlock is the highest block the upstream is known to have, from the
+// health checks and the responses it returned since.
+func (i *upstreamInfo) getKnownBlock() uint64 {
+	return atomic.LoadUint64(&i.knownBlock)
+}
+
+func (i *upstreamInfo) raiseKnownBlock(height uint64) {
+	for {
+		known := atomic.LoadUint64(&i.knownBlock)
+		if height <= known || atomic.CompareAndSwapUint64(&i.knownBlock, known, height) {
+			return
+		}
+	}
+}
+
+// observeResponse records what a successful response tells about the upstream and the session
+func (i *upstreamInfo) observeResponse(request *Request, bts []byte) {
+	if height, ok := responseBlock(request.data.Method, bts); ok {
+		i.raiseKnownBlock(height)
+	}
+
+	if request.session == nil {
+		return
+	}
+
+	wrote := false
+	if isWriteMethod(request.data.Method) {
+		var resp jsonRpcRawResponse
+		wrote = json.Unmarshal(bts, &resp) == nil && resp.Error == nil
+	}
+
+	request.session.observe(i.name, i.getKnownBlock(), wrote)
+}
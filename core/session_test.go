@@ -0,0 +1,175 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseBlock(t *testing.T) {
+	height, ok := responseBlock("eth_blockNumber", []byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(16), height)
+
+	height, ok = responseBlock("eth_getTransactionReceipt", []byte(`{"jsonrpc":"2.0","id":1,"result":{"blockNumber":"0x20"}}`))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(32), height)
+
+	_, ok = responseBlock("eth_getTransactionReceipt", []byte(`{"jsonrpc":"2.0","id":1,"result":null}`))
+	assert.False(t, ok)
+
+	_, ok = responseBlock("eth_blockNumber", []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"x"}}`))
+	assert.False(t, ok)
+
+	_, ok = responseBlock("eth_gasPrice", []byte(`{"jsonrpc":"2.0","id":1,"result":"0x10"}`))
+	assert.False(t, ok)
+
+	assert.Equal(t, "", (&clientInfo{}).sessionKey())
+	assert.Equal(t, "key:a", (&clientInfo{apiKey: "a"}).sessionKey())
+	assert.Equal(t, "session:a:s", (&clientInfo{apiKey: "a", session: "s"}).sessionKey())
+
+	negative := Duration(-time.Second)
+	_, err := newSessionStore(&ConsistencyConfig{Enabled: true, WritePin: &negative})
+	assert.NotNil(t, err)
+
+	store, err := newSessionStore(&ConsistencyConfig{})
+	assert.Nil(t, err)
+	assert.Nil(t, store)
+	assert.Nil(t, store.get("key:a"))
+}
+
+func TestSessionConsistency(t *testing.T) {
+	newServer := func(name string, height string) string {
+		server := newTestUpstreamServer(func(data *RequestData) interface{} {
+			switch data.Method {
+			case "eth_blockNumber":
+				return height
+			case "eth_sendRawTransaction":
+				return "0x" + name
+			}
+			return name
+		})
+		t.Cleanup(server.Close)
+
+		return server.URL
+	}
+
+	config := NewConfig()
+	err := json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {
+		"upstreams": [{"url": "%s", "name": "ahead"}, {"url": "%s", "name": "behind"}],
+		"strategy": "BALANCING",
+		"consistency": {"enabled": true}
+	}}`, newServer("ahead", "0x64"), newServer("behind", "0x60"))), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := getRunningConfig().Configs[1337]
+	cfg.healthCheck()
+
+	send := func(sessionKey string, method string) string {
+		req, err := newRequest(1337, []byte(fmt.Sprintf(`{"params": [], "method": "%s", "id": 1, "jsonrpc": "2.0"}`, method)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.session = cfg.sessions.get(sessionKey)
+
+		bts, err := cfg.handle(req)
+		assert.Nil(t, err)
+
+		var res struct {
+			Result string `json:"result"`
+		}
+		_ = json.Unmarshal(bts, &res)
+
+		return res.Result
+	}
+
+	// once the client has seen block 0x64, the upstream behind is skipped
+	client := "session:a:s1"
+	for send(client, "eth_blockNumber") != "0x64" {
+	}
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, "0x64", send(client, "eth_blockNumber"))
+		assert.Equal(t, "ahead", send(client, "eth_gasPrice"))
+	}
+
+	// reads follow the upstream of the last write
+	writer := "session:a:s2"
+	wroteTo := send(writer, "eth_sendRawTransaction")[2:]
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, wroteTo, send(writer, "eth_gasPrice"))
+	}
+
+	// no session, no pinning
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		seen[send("", "eth_gasPrice")] = true
+	}
+	assert.Equal(t, 2, len(seen))
+}
+
+func TestSessionHeader(t *testing.T) {
+	var clients []*clientInfo
+
+	upstream := newTestUpstreamServer(func(data *RequestData) interface{} {
+		return "0x1"
+	})
+	defer upstream.Close()
+
+	defer closeTestConfig()
+	initTestConfigWithUpstream(t, upstream.URL, `, "consistency": {"enabled": true}`)
+
+	sessions := getRunningConfig().Configs[1337].sessions
+	server := &Server{}
+
+	for _, id := range []string{"a", "a", "b"} {
+		req := httptest.NewRequest(http.MethodPost, "/http/1337", strings.NewReader(`{"jsonrpc": "2.0", "id": 1, "method": "eth_blockNumber", "params": []}`))
+		req.Header.Set(SessionHeader, id)
+		server.ServeHTTP(httptest.NewRecorder(), req)
+
+		clients = append(clients, &clientInfo{session: id})
+	}
+
+	assert.Equal(t, 2, len(sessions.sessions))
+	assert.Equal(t, uint64(1), sessions.get(clients[0].sessionKey()).minBlock)
+	assert.Equal(t, uint64(1), sessions.get(clients[2].sessionKey()).minBlock)
+}
+
+func TestSessionFilterBehind(t *testing.T) {
+	newTestUpstream := func(name string, height uint64) Upstream {
+		up := newUpstream(context.Background(), 1337, UpstreamConfig{Url: "http://" + name + ".example.com", Name: name}, "")
+		up.getInfo().raiseKnownBlock(height)
+		return up
+	}
+
+	a, b, c := newTestUpstream("a", 0x60), newTestUpstream("b", 0x62), newTestUpstream("c", 0x62)
+	upstreams := []Upstream{a, b, c}
+
+	store, err := newSessionStore(&ConsistencyConfig{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := store.get("a")
+	s.observe("d", 0x61, false)
+	assert.Equal(t, []Upstream{b, c}, s.filter(upstreams))
+
+	// no upstream has reached the height of the session, the highest ones are used
+	s.observe("d", 0x64, false)
+	assert.Equal(t, []Upstream{b, c}, s.filter(upstreams))
+	assert.Equal(t, []Upstream{a}, s.filter([]Upstream{a}))
+}
@@ -1,9 +1,11 @@
 package core
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"math"
+	"math/rand"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,6 +22,12 @@ type IStrategy interface {
 var _ IStrategy = &NaiveProxy{}
 var _ IStrategy = &RaceProxy{}
 var _ IStrategy = &FallbackProxy{}
+var _ IStrategy = &WeightedProxy{}
+var _ IStrategy = &LeastLatencyProxy{}
+var _ IStrategy = &P2CProxy{}
+var _ IStrategy = &QuorumProxy{}
+var _ IStrategy = &HedgedProxy{}
+var _ IStrategy = &BroadcastProxy{}
 
 // var _ IStrategy = &LoadBalanceFallbackProxy{}
 
@@ -30,10 +38,11 @@ func newNaiveProxy() *NaiveProxy {
 }
 
 func (p *NaiveProxy) handle(req *Request) ([]byte, error) {
-	currentRunningConfig.Configs[req.chainId].updateLocker.RLock()
-	defer currentRunningConfig.Configs[req.chainId].updateLocker.RUnlock()
+	cfg := req.getChain()
+	cfg.updateLocker.RLock()
+	defer cfg.updateLocker.RUnlock()
 
-	upstream := currentRunningConfig.Configs[req.chainId].Upstreams[0]
+	upstream := getUpstreams(req)[0]
 	bts, err := upstream.handle(req)
 
 	if err != nil {
@@ -56,18 +65,21 @@ func (p *RaceProxy) handle(req *Request) ([]byte, error) {
 		logrus.Debugf("geth_gateway %f", float64(time.Since(startAt))/1000000)
 	}()
 
-	successfulResponse := make(chan []byte, len(currentRunningConfig.Configs[req.chainId].Upstreams))
-	failedResponse := make(chan []byte, len(currentRunningConfig.Configs[req.chainId].Upstreams))
-	errorResponseUpstreams := make(chan Upstream, len(currentRunningConfig.Configs[req.chainId].Upstreams))
+	cfg := req.getChain()
+	cfg.updateLocker.RLock()
+	defer cfg.updateLocker.RUnlock()
 
-	currentRunningConfig.Configs[req.chainId].updateLocker.RLock()
-	defer currentRunningConfig.Configs[req.chainId].updateLocker.RUnlock()
+	upstreams := getUpstreams(req)
 
-	for _, upstream := range currentRunningConfig.Configs[req.chainId].Upstreams {
+	successfulResponse := make(chan []byte, len(upstreams))
+	failedResponse := make(chan []byte, len(upstreams))
+	errorResponseUpstreams := make(chan Upstream, len(upstreams))
+
+	for _, upstream := range upstreams {
 		go func(upstream Upstream) {
 			defer func() {
 				if err := recover(); err != nil {
-					req.logger.Debugf("%v Upstream %s failed, err: %v\n", time.Now().Sub(startAt), upstream, err)
+					req.logger.Debugf("%v Upstream %s failed, err: %v\n", time.Now().Sub(startAt), upstream.getName(), err)
 					errorResponseUpstreams <- upstream
 				}
 			}()
@@ -75,8 +87,8 @@ func (p *RaceProxy) handle(req *Request) ([]byte, error) {
 			bts, err := upstream.handle(req)
 
 			if err != nil {
-				req.logger.Debugf("%vms Upstream: %v, Error: %v\n", time.Now().Sub(startAt), upstream, err)
-				failedResponse <- nil
+				req.logger.Debugf("%vms Upstream: %v, Error: %v\n", time.Now().Sub(startAt), upstream.getName(), err)
+				errorResponseUpstreams <- upstream
 				return
 			}
 
@@ -84,20 +96,21 @@ func (p *RaceProxy) handle(req *Request) ([]byte, error) {
 
 			diff := time.Now().Sub(startAt)
 			if utils.NoErrorFieldInJSON(resBody) {
-				req.logger.Debugf("%v Upstream: %v Success, Body: %v\n", diff, upstream, resBody)
+				req.logger.Debugf("%v Upstream: %v Success, Body: %v\n", diff, upstream.getName(), resBody)
 				successfulResponse <- bts
 			} else {
-				req.logger.Debugf("%v Upstream: %v Failed, Body: %v\n", diff, upstream, resBody)
+				req.logger.Debugf("%v Upstream: %v Failed, Body: %v\n", diff, upstream.getName(), resBody)
 				failedResponse <- bts
 			}
 		}(upstream)
 	}
 
 	errorCount := 0
+	timeout := time.After(getTimeouts(req.chainId).RaceTimeout)
 
-	for errorCount < len(currentRunningConfig.Configs[req.chainId].Upstreams) {
+	for errorCount < len(upstreams) {
 		select {
-		case <-time.After(time.Second * 10):
+		case <-timeout:
 			req.logger.Debugf("%v Final Timeout\n", time.Now().Sub(startAt))
 			return nil, TimeoutError
 		case res := <-successfulResponse:
@@ -123,177 +136,579 @@ type FallbackProxy struct {
 
 type FallbackStatus struct {
 	currentUpstreamIndex *atomic.Value
-	upsteamStatus        *sync.Map
 }
 
 func newFallbackProxy() *FallbackProxy {
 	logrus.Infof("using fallback proxy for chain")
 
-	p := &FallbackProxy{}
+	return &FallbackProxy{}
+}
+
+// getFallbackStatus returns the status of the chain, it's created by the first request
+// because the strategy is built before its chain is running
+func getFallbackStatus(status *sync.Map, chainId uint64) *FallbackStatus {
+	if statusVal, ok := status.Load(chainId); ok {
+		return statusVal.(*FallbackStatus)
+	}
+
+	v := &atomic.Value{}
+	v.Store(0)
+
+	statusVal, _ := status.LoadOrStore(chainId, &FallbackStatus{
+		currentUpstreamIndex: v,
+	})
+
+	return statusVal.(*FallbackStatus)
+}
+
+func (p *FallbackProxy) handle(req *Request) ([]byte, error) {
+	status := getFallbackStatus(&p.status, req.chainId)
+
+	cfg := req.getChain()
+	cfg.updateLocker.RLock()
+	defer cfg.updateLocker.RUnlock()
+
+	upstreams := getUpstreams(req)
+	policy := getFailoverPolicy(req)
+
+	var failedResponse []byte
 
-	for chainId, cfg := range currentRunningConfig.Configs {
-		v := &atomic.Value{}
-		v.Store(0)
-		status := &FallbackStatus{
-			currentUpstreamIndex: v,
-			upsteamStatus:        &sync.Map{},
+	// upstreams with an open circuit breaker fail right away and are skipped
+	for i := 0; i < policy.attempts(len(upstreams)); i++ {
+		// the pool shrinks when upstreams lag behind
+		index := status.currentUpstreamIndex.Load().(int) % len(upstreams)
+		bts, err := upstreams[index].handle(req)
+
+		switch policy.check(req, upstreams[index], bts, err) {
+		case noError, executionError:
+			return bts, nil
+		case nodeError:
+			failedResponse = bts
 		}
-		for i := 0; i < len(cfg.Upstreams); i++ {
-			status.upsteamStatus.Store(i, true)
+
+		nextUpstreamIndex := int(math.Mod(float64(index+1), float64(len(upstreams))))
+		status.currentUpstreamIndex.Store(nextUpstreamIndex)
+
+		logrus.Infof("upstream %s return err, switch to %d", upstreams[index].getName(), nextUpstreamIndex)
+	}
+
+	return failedOrNoValidUpstream(failedResponse)
+}
+
+type LoadBalanceFallbackProxy struct {
+	status sync.Map
+}
+
+func newLoadBalanceFallbackProxy() *LoadBalanceFallbackProxy {
+	logrus.Infof("using load balancing proxy for chain")
+
+	return &LoadBalanceFallbackProxy{}
+}
+
+func (p *LoadBalanceFallbackProxy) handle(req *Request) ([]byte, error) {
+	status := getFallbackStatus(&p.status, req.chainId)
+
+	cfg := req.getChain()
+	cfg.updateLocker.RLock()
+	defer cfg.updateLocker.RUnlock()
+
+	upstreams := getUpstreams(req)
+	policy := getFailoverPolicy(req)
+
+	initialIndex := status.currentUpstreamIndex.Load().(int) % len(upstreams)
+
+	var failedResponse []byte
+
+	for i := 0; i < policy.attempts(len(upstreams)); i++ {
+		index := status.currentUpstreamIndex.Load().(int) % len(upstreams)
+		if i != 0 && index == initialIndex {
+			break
 		}
+		bts, err := upstreams[index].handle(req)
 
-		logrus.Infof("fallback proxy setup chainId %v", chainId)
-		p.status.Store(chainId, status)
+		nextUpstreamIndex := int(math.Mod(float64(index+1), float64(len(upstreams))))
+		status.currentUpstreamIndex.Store(nextUpstreamIndex)
+		logrus.Debugf("upstream %d load balancing, then switch to %d", index, nextUpstreamIndex)
+
+		switch policy.check(req, upstreams[index], bts, err) {
+		case noError, executionError:
+			return bts, nil
+		case nodeError:
+			failedResponse = bts
+		}
 	}
 
-	logrus.Infof("setup fallback proxy ended, chains %v, config: %v", len(currentRunningConfig.Configs), *currentRunningConfig)
+	return failedOrNoValidUpstream(failedResponse)
+}
+
+// WeightedProxy spreads requests by the upstream weights with smooth weighted
+// round-robin, and fails over to the next upstream on errors.
+type WeightedProxy struct {
+	status sync.Map // chainId => *weightedStatus
+}
 
-	return p
+type weightedStatus struct {
+	sync.Mutex
+	currentWeights map[string]int // upstream name => current weight
 }
 
-func (p *FallbackProxy) handle(req *Request) ([]byte, error) {
-	statusVal, ok := p.status.Load(req.chainId)
-	if !ok {
-		return nil, fmt.Errorf("chain not supported")
+func newWeightedProxy() *WeightedProxy {
+	logrus.Infof("using weighted proxy for chain")
+
+	return &WeightedProxy{}
+}
+
+// next picks the upstream with the highest current weight among the untried ones,
+// the available upstreams are preferred.
+func (s *weightedStatus) next(upstreams []Upstream, tried map[string]bool) Upstream {
+	s.Lock()
+	defer s.Unlock()
+
+	var candidates []Upstream
+	for _, available := range []bool{true, false} {
+		for _, up := range upstreams {
+			if !tried[up.getName()] && (isAvailable(up) || !available) {
+				candidates = append(candidates, up)
+			}
+		}
+
+		if len(candidates) > 0 {
+			break
+		}
 	}
 
-	status := statusVal.(*FallbackStatus)
+	var best Upstream
+	total := 0
 
-	cfg := currentRunningConfig.Configs[req.chainId]
+	for _, up := range candidates {
+		weight := up.getInfo().weight
+		total += weight
+		s.currentWeights[up.getName()] += weight
 
-	currentRunningConfig.Configs[req.chainId].updateLocker.RLock()
-	defer currentRunningConfig.Configs[req.chainId].updateLocker.RUnlock()
+		if best == nil || s.currentWeights[up.getName()] > s.currentWeights[best.getName()] {
+			best = up
+		}
+	}
 
-	for i := 0; i < len(cfg.Upstreams); i++ {
-		index := status.currentUpstreamIndex.Load().(int)
+	if best != nil {
+		s.currentWeights[best.getName()] -= total
+	}
 
-		value, _ := status.upsteamStatus.Load(index)
-		isUpstreamValid := value.(bool)
+	return best
+}
 
-		if isUpstreamValid {
-			bts, err := cfg.Upstreams[index].handle(req)
+func (p *WeightedProxy) handle(req *Request) ([]byte, error) {
+	statusVal, _ := p.status.LoadOrStore(req.chainId, &weightedStatus{currentWeights: make(map[string]int)})
+	status := statusVal.(*weightedStatus)
 
-			retry := func() {
-				nextUpstreamIndex := int(math.Mod(float64(index+1), float64(len(cfg.Upstreams))))
-				status.currentUpstreamIndex.Store(nextUpstreamIndex)
-				// status.upsteamStatus.Store(i, false)
+	cfg := req.getChain()
 
-				logrus.Infof("upstream %d return err, switch to %d", index, nextUpstreamIndex)
+	cfg.updateLocker.RLock()
+	defer cfg.updateLocker.RUnlock()
 
-				// go func(i int) {
-				// 	<-time.After(5 * time.Second)
-				// 	status.upsteamStatus.Store(i, true)
-				// }(index)
-			}
-			if err != nil {
-				retry()
-				continue
-			} else {
-				resp := &JsonRpcResponse{}
-				err = json.Unmarshal(bts, resp)
-				if err != nil {
-					logrus.Errorf("JsonRpcResponse unmarsharling failed: %v, resp: %v", err, string(bts))
-					retry()
-					continue
-				}
-				if resp.Err.Code != 0 {
-					retry()
-					continue
-				}
-				if resp.ID != req.data.ID {
-					retry()
-					continue
-				}
-				return bts, nil
-			}
+	tried := make(map[string]bool)
+
+	upstreams := getUpstreams(req)
+	policy := getFailoverPolicy(req)
+
+	var failedResponse []byte
+
+	for i := 0; i < policy.attempts(len(upstreams)); i++ {
+		upstream := status.next(upstreams, tried)
+		tried[upstream.getName()] = true
+
+		bts, err := upstream.handle(req)
+
+		switch policy.check(req, upstream, bts, err) {
+		case noError, executionError:
+			return bts, nil
+		case nodeError:
+			failedResponse = bts
 		}
+
+		logrus.Debugf("upstream %s failed, switch to the next one", upstream.getName())
 	}
 
-	return nil, fmt.Errorf("no valid upstream")
+	return failedOrNoValidUpstream(failedResponse)
 }
 
-type LoadBalanceFallbackProxy struct {
-	status sync.Map
+// handleInOrder tries the upstreams one by one until one of them returns a valid
+// response or a deterministic error, within the retry budget of the chain
+func handleInOrder(req *Request, upstreams []Upstream) ([]byte, error) {
+	policy := getFailoverPolicy(req)
+
+	var failedResponse []byte
+
+	for _, upstream := range upstreams[:policy.attempts(len(upstreams))] {
+		bts, err := upstream.handle(req)
+
+		switch policy.check(req, upstream, bts, err) {
+		case noError, executionError:
+			return bts, nil
+		case nodeError:
+			failedResponse = bts
+		}
+
+		logrus.Debugf("upstream %s failed, switch to the next one", upstream.getName())
+	}
+
+	return failedOrNoValidUpstream(failedResponse)
 }
 
-func newLoadBalanceFallbackProxy() *LoadBalanceFallbackProxy {
-	logrus.Infof("using load balancing proxy for chain")
+// failedOrNoValidUpstream returns the last node error once the retries are exhausted,
+// so the client can tell a rate limit from an outage
+func failedOrNoValidUpstream(failedResponse []byte) ([]byte, error) {
+	if failedResponse != nil {
+		return failedResponse, nil
+	}
+
+	return nil, NoValidUpstreamError
+}
+
+// leastLatencyExploreRatio is the share of requests sent to a random slower upstream,
+// so the scores of the slower upstreams keep being updated and can recover
+const leastLatencyExploreRatio = 0.05
+
+// LeastLatencyProxy sends requests to the upstream with the best live latency score,
+// and fails over to the next best one on errors.
+type LeastLatencyProxy struct {
+	exploreRatio float64
+}
+
+func newLeastLatencyProxy() *LeastLatencyProxy {
+	logrus.Infof("using least latency proxy for chain")
 
-	p := &LoadBalanceFallbackProxy{}
+	return &LeastLatencyProxy{exploreRatio: leastLatencyExploreRatio}
+}
+
+// order sorts the upstreams by score, the available ones first. Sometimes a random
+// slower upstream is moved to the front.
+func (p *LeastLatencyProxy) order(upstreams []Upstream) []Upstream {
+	ordered := append([]Upstream{}, upstreams...)
+	scores := make(map[Upstream]float64, len(ordered))
+	available := make(map[Upstream]bool, len(ordered))
+
+	for _, up := range ordered {
+		scores[up] = up.getInfo().stats.score()
+		available[up] = isAvailable(up)
+	}
 
-	for chainId, cfg := range currentRunningConfig.Configs {
-		v := &atomic.Value{}
-		v.Store(0)
-		status := &FallbackStatus{
-			currentUpstreamIndex: v,
-			upsteamStatus:        &sync.Map{},
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if available[ordered[i]] != available[ordered[j]] {
+			return available[ordered[i]]
 		}
-		for i := 0; i < len(cfg.Upstreams); i++ {
-			status.upsteamStatus.Store(i, true)
+		return scores[ordered[i]] < scores[ordered[j]]
+	})
+
+	if len(ordered) > 1 && rand.Float64() < p.exploreRatio {
+		i := 1 + rand.Intn(len(ordered)-1)
+		explored := ordered[i]
+		copy(ordered[1:i+1], ordered[:i])
+		ordered[0] = explored
+	}
+
+	return ordered
+}
+
+func (p *LeastLatencyProxy) handle(req *Request) ([]byte, error) {
+	cfg := req.getChain()
+
+	cfg.updateLocker.RLock()
+	defer cfg.updateLocker.RUnlock()
+
+	return handleInOrder(req, p.order(getUpstreams(req)))
+}
+
+// P2CProxy samples two upstreams and sends the request to the one with less
+// requests in flight, the other upstreams take the request on errors or when
+// the chosen one reached its maxConcurrency.
+type P2CProxy struct{}
+
+func newP2CProxy() *P2CProxy {
+	logrus.Infof("using power of two choices proxy for chain")
+
+	return &P2CProxy{}
+}
+
+// order puts the less loaded one of two random upstreams first, then the other
+// one, then the rest by in-flight requests. The available upstreams are preferred.
+func (p *P2CProxy) order(upstreams []Upstream) []Upstream {
+	var available, unavailable []Upstream
+	for _, up := range upstreams {
+		if isAvailable(up) {
+			available = append(available, up)
+		} else {
+			unavailable = append(unavailable, up)
 		}
+	}
 
-		logrus.Infof("load balancing proxy setup chainId %v", chainId)
-		p.status.Store(chainId, status)
+	candidates := available
+	if len(candidates) == 0 {
+		candidates, unavailable = unavailable, nil
 	}
 
-	logrus.Infof("setup load balancing proxy ended, chains %v, config: %v", len(currentRunningConfig.Configs), *currentRunningConfig)
+	ordered := append([]Upstream{}, candidates...)
+	rand.Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+
+	if len(ordered) > 1 && ordered[1].getInfo().getInFlight() < ordered[0].getInfo().getInFlight() {
+		ordered[0], ordered[1] = ordered[1], ordered[0]
+	}
 
-	return p
+	if len(ordered) > 2 {
+		rest := ordered[2:]
+		sort.SliceStable(rest, func(i, j int) bool {
+			return rest[i].getInfo().getInFlight() < rest[j].getInfo().getInFlight()
+		})
+	}
+
+	return append(ordered, unavailable...)
 }
 
-func (p *LoadBalanceFallbackProxy) handle(req *Request) ([]byte, error) {
-	statusVal, ok := p.status.Load(req.chainId)
-	if !ok {
-		return nil, fmt.Errorf("chain not supported")
+func (p *P2CProxy) handle(req *Request) ([]byte, error) {
+	cfg := req.getChain()
+
+	cfg.updateLocker.RLock()
+	defer cfg.updateLocker.RUnlock()
+
+	return handleInOrder(req, p.order(getUpstreams(req)))
+}
+
+// QuorumProxy mirrors the request to size upstreams like RaceProxy, and returns
+// once threshold of them returned the same normalized response.
+type QuorumProxy struct {
+	size      int
+	threshold int
+}
+
+func newQuorumProxy(size int, threshold int) *QuorumProxy {
+	logrus.Infof("using quorum proxy for chain, %d of %d upstreams", threshold, size)
+
+	return &QuorumProxy{size: size, threshold: threshold}
+}
+
+type quorumResponse struct {
+	upstream Upstream
+	bts      []byte
+	key      string
+	err      error
+}
+
+func (p *QuorumProxy) handle(req *Request) ([]byte, error) {
+	startAt := time.Now()
+	cfg := req.getChain()
+
+	cfg.updateLocker.RLock()
+	defer cfg.updateLocker.RUnlock()
+
+	// the available upstreams go first, the upstreams are sorted by the health check
+	var upstreams []Upstream
+	for _, available := range []bool{true, false} {
+		for _, up := range getUpstreams(req) {
+			if isAvailable(up) == available && len(upstreams) < p.size {
+				upstreams = append(upstreams, up)
+			}
+		}
 	}
 
-	status := statusVal.(*FallbackStatus)
+	responses := make(chan *quorumResponse, len(upstreams))
+
+	for _, upstream := range upstreams {
+		go func(upstream Upstream) {
+			res := &quorumResponse{upstream: upstream}
+
+			defer func() {
+				if err := recover(); err != nil {
+					res.err = fmt.Errorf("%v", err)
+				}
+				responses <- res
+			}()
 
-	cfg := currentRunningConfig.Configs[req.chainId]
+			res.bts, res.err = upstream.handle(req)
+			if res.err == nil {
+				res.key, res.err = normalizeResponse(res.bts)
+			}
+		}(upstream)
+	}
 
-	initialIndex := status.currentUpstreamIndex.Load().(int)
+	votes := make(map[string][]*quorumResponse)
+	timeout := time.After(getTimeouts(req.chainId).RaceTimeout)
 
-	for i := 0; i < len(cfg.Upstreams); i++ {
-		index := status.currentUpstreamIndex.Load().(int)
-		if i != 0 && index == initialIndex {
+	for received := 0; received < len(upstreams); received++ {
+		var res *quorumResponse
+
+		select {
+		case <-timeout:
+			req.logger.Debugf("%v quorum timeout", time.Since(startAt))
+			return nil, TimeoutError
+		case res = <-responses:
+		}
+
+		if res.err != nil {
+			req.logger.Debugf("%v Upstream: %v, Error: %v", time.Since(startAt), res.upstream.getName(), res.err)
+		} else {
+			votes[res.key] = append(votes[res.key], res)
+
+			if len(votes[res.key]) >= p.threshold {
+				if len(votes) > 1 {
+					p.logDisagreement(req, votes, res.key)
+				}
+				return res.bts, nil
+			}
+		}
+
+		// give up when no response can reach the threshold with the pending ones
+		pending := len(upstreams) - received - 1
+		best := 0
+		for _, group := range votes {
+			if len(group) > best {
+				best = len(group)
+			}
+		}
+
+		if best+pending < p.threshold {
 			break
 		}
-		value, _ := status.upsteamStatus.Load(index)
-		isUpstreamValid := value.(bool)
+	}
+
+	if len(votes) == 0 {
+		return nil, AllUpstreamsFailedError
+	}
+
+	if len(votes) > 1 {
+		p.logDisagreement(req, votes, "")
+	}
+
+	return nil, QuorumNotReachedError
+}
+
+// logDisagreement logs the upstreams which returned another response than the agreed one
+func (p *QuorumProxy) logDisagreement(req *Request, votes map[string][]*quorumResponse, agreed string) {
+	Count(fmt.Sprintf("quorum_disagreement_%d", req.chainId))
+
+	for key, group := range votes {
+		if key == agreed {
+			continue
+		}
+
+		for _, res := range group {
+			logrus.WithFields(logrus.Fields{
+				"chain_id": req.chainId,
+				"method":   req.data.Method,
+				"upstream": res.upstream.getName(),
+				"response": key,
+			}).Warnf("upstream %s disagrees on %s", res.upstream.getName(), req.data.Method)
+		}
+	}
+}
+
+// HedgedProxy sends the request to the preferred upstream, and to the next one
+// only when the first one didn't answer within the hedge delay. The first good
+// response wins, and the other request is cancelled.
+type HedgedProxy struct {
+	config *HedgeConfig
+}
+
+func newHedgedProxy(config *HedgeConfig) *HedgedProxy {
+	logrus.Infof("using hedged proxy for chain")
 
-		if isUpstreamValid {
-			bts, err := cfg.Upstreams[index].handle(req)
+	return &HedgedProxy{config: config}
+}
+
+type hedgedAttempt struct {
+	upstream Upstream
+	hedge    bool
+	bts      []byte
+	err      error
+}
 
-			switchFunc := func() {
-				nextUpstreamIndex := int(math.Mod(float64(index+1), float64(len(cfg.Upstreams))))
-				status.currentUpstreamIndex.Store(nextUpstreamIndex)
-				logrus.Debugf("upstream %d load balancing, then switch to %d", index, nextUpstreamIndex)
+func (p *HedgedProxy) handle(req *Request) ([]byte, error) {
+	cfg := req.getChain()
+
+	cfg.updateLocker.RLock()
+	defer cfg.updateLocker.RUnlock()
+
+	// the available upstreams go first, the upstreams are sorted by the health check
+	var upstreams []Upstream
+	for _, available := range []bool{true, false} {
+		for _, up := range getUpstreams(req) {
+			if isAvailable(up) == available {
+				upstreams = append(upstreams, up)
 			}
+		}
+	}
 
-			switchFunc()
+	// the losing requests are cancelled on return
+	ctx, cancel := context.WithCancel(req.getContext())
+	defer cancel()
 
-			if err != nil {
-				continue
-			} else {
-				resp := &JsonRpcResponse{}
-				err = json.Unmarshal(bts, resp)
-				if err != nil {
-					logrus.Errorf("JsonRpcResponse unmarsharling failed: %v", err)
-					switchFunc()
-					continue
-				}
-				if resp.Err.Code != 0 {
-					switchFunc()
-					continue
+	policy := getFailoverPolicy(req)
+	retries := policy.attempts(len(upstreams)) - 1
+
+	attempts := make(chan *hedgedAttempt, len(upstreams))
+	next := 0
+
+	launch := func(hedge bool) {
+		attempt := &hedgedAttempt{upstream: upstreams[next], hedge: hedge}
+		next++
+
+		go func() {
+			defer func() {
+				if err := recover(); err != nil {
+					attempt.err = fmt.Errorf("%v", err)
 				}
-				if resp.ID != req.data.ID {
-					switchFunc()
-					continue
+				attempts <- attempt
+			}()
+
+			attempt.bts, attempt.err = attempt.upstream.handle(req.withContext(ctx))
+		}()
+	}
+
+	launch(false)
+	pending := 1
+
+	hedgeTimer := time.NewTimer(p.config.hedgeDelay(upstreams[0]))
+	defer hedgeTimer.Stop()
+
+	var failedResponse []byte
+
+	for pending > 0 {
+		select {
+		case <-hedgeTimer.C:
+			if next < len(upstreams) {
+				req.logger.Debugf("upstream %s is slow, hedge to %s", upstreams[0].getName(), upstreams[next].getName())
+				Count(fmt.Sprintf("hedge_sent_%d", req.chainId))
+				launch(true)
+				pending++
+			}
+		case attempt := <-attempts:
+			pending--
+
+			switch policy.check(req, attempt.upstream, attempt.bts, attempt.err) {
+			case noError:
+				if attempt.hedge {
+					Count(fmt.Sprintf("hedge_won_%d", req.chainId))
 				}
-				return bts, nil
+				return attempt.bts, nil
+			case executionError:
+				return attempt.bts, nil
+			case nodeError:
+				failedResponse = attempt.bts
+			}
+
+			// a failed request is replaced right away, within the retry budget
+			if next < len(upstreams) && retries > 0 {
+				retries--
+				launch(false)
+				pending++
 			}
 		}
 	}
 
-	return nil, fmt.Errorf("no valid upstream")
+	if failedResponse != nil {
+		return failedResponse, nil
+	}
+
+	return nil, AllUpstreamsFailedError
 }
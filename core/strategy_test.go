@@ -4,9 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -42,7 +48,8 @@ func TestNaiveProxyHandle(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -98,7 +105,8 @@ func TestRaceProxyHandle(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -123,6 +131,7 @@ func TestRaceProxyHandle(t *testing.T) {
 }
 
 func TestNewFallbackProxy(t *testing.T) {
+	defer closeTestConfig()
 	initTestConfig(t)
 	assert.IsType(t, &FallbackProxy{}, newFallbackProxy())
 }
@@ -159,7 +168,8 @@ func TestFallbackProxyHandle(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	currentRunningConfig, err = BuildRunningConfigFromConfig(ctx, config)
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(ctx, config)
 
 	if err != nil {
 		logrus.Fatal(err)
@@ -182,3 +192,419 @@ func TestFallbackProxyHandle(t *testing.T) {
 
 	assert.IsType(t, []byte{}, bts)
 }
+
+func TestWeightedProxyHandle(t *testing.T) {
+	var locker sync.Mutex
+	hits := make(map[string]int)
+
+	newUpstream := func(name string, failing bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var data RequestData
+			_ = json.NewDecoder(r.Body).Decode(&data)
+
+			res := map[string]interface{}{"jsonrpc": "2.0", "id": data.ID, "result": "0x1"}
+
+			if data.Method == "eth_gasPrice" {
+				locker.Lock()
+				hits[name]++
+				locker.Unlock()
+
+				if failing {
+					res = map[string]interface{}{"jsonrpc": "2.0", "id": data.ID, "error": map[string]interface{}{"code": -32000, "message": "failed"}}
+				}
+			}
+
+			bts, _ := json.Marshal(res)
+			_, _ = w.Write(bts)
+		}))
+	}
+
+	a, b, c := newUpstream("a", false), newUpstream("b", false), newUpstream("c", true)
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+
+	defer closeTestConfig()
+	build := func(upstreams string) {
+		config := NewConfig()
+		err := json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {"upstreams": %s, "strategy": "WEIGHTED"}}`, upstreams)), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = BuildRunningConfigFromConfig(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Eventually(t, func() bool {
+			cfg := getRunningConfig().Configs[1337]
+			cfg.updateLocker.RLock()
+			defer cfg.updateLocker.RUnlock()
+
+			for _, up := range cfg.Upstreams {
+				if !up.isAlive() {
+					return false
+				}
+			}
+			return true
+		}, 5*time.Second, 10*time.Millisecond)
+
+		locker.Lock()
+		hits = make(map[string]int)
+		locker.Unlock()
+	}
+
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			req, err := newRequest(1337, []byte(fmt.Sprintf(`{"params": [], "method": "eth_gasPrice", "id": %d, "jsonrpc": "2.0"}`, i+1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bts, err := getRunningConfig().Configs[1337].Strategy.handle(req)
+			assert.Nil(t, err)
+			assert.Contains(t, string(bts), `"result":"0x1"`)
+		}
+	}
+
+	build(fmt.Sprintf(`[{"url": "%s", "name": "a", "weight": 5}, {"url": "%s", "name": "b", "weight": 2}]`, a.URL, b.URL))
+	assert.IsType(t, &WeightedProxy{}, getRunningConfig().Configs[1337].Strategy)
+
+	send(70)
+	assert.Equal(t, map[string]int{"a": 50, "b": 20}, hits)
+
+	// the weights follow the reloaded config
+	build(fmt.Sprintf(`[{"url": "%s", "name": "a", "weight": 1}, {"url": "%s", "name": "b", "weight": 1}]`, a.URL, b.URL))
+	send(10)
+	assert.Equal(t, map[string]int{"a": 5, "b": 5}, hits)
+
+	// the failed requests go to the next upstream, the breaker of c opens after 5 node errors in a row
+	build(fmt.Sprintf(`[{"url": "%s", "name": "c", "weight": 3}, {"url": "%s", "name": "b", "weight": 1}]`, c.URL, b.URL))
+	send(8)
+	assert.Equal(t, map[string]int{"b": 8, "c": 5}, hits)
+}
+
+func TestLeastLatencyProxyHandle(t *testing.T) {
+	var fastHits, slowHits, fastFailing int64
+
+	newUpstream := func(hits *int64, delay time.Duration, failing *int64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var data RequestData
+			_ = json.NewDecoder(r.Body).Decode(&data)
+
+			if data.Method == "eth_gasPrice" {
+				atomic.AddInt64(hits, 1)
+				time.Sleep(delay)
+
+				if failing != nil && atomic.LoadInt64(failing) == 1 {
+					_, _ = w.Write([]byte("bad gateway"))
+					return
+				}
+			}
+
+			bts, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": data.ID, "result": "0x1"})
+			_, _ = w.Write(bts)
+		}))
+	}
+
+	fast := newUpstream(&fastHits, 0, &fastFailing)
+	defer fast.Close()
+	slow := newUpstream(&slowHits, 20*time.Millisecond, nil)
+	defer slow.Close()
+
+	config := NewConfig()
+	err := json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {"upstreams": [{"url": "%s", "name": "slow"}, {"url": "%s", "name": "fast"}], "strategy": "LEAST_LATENCY"}}`, slow.URL, fast.URL)), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := getRunningConfig().Configs[1337].Strategy.(*LeastLatencyProxy)
+	proxy.exploreRatio = 0
+
+	var fastStats *latencyStats
+	assert.Eventually(t, func() bool {
+		cfg := getRunningConfig().Configs[1337]
+		cfg.updateLocker.RLock()
+		defer cfg.updateLocker.RUnlock()
+
+		for _, up := range cfg.Upstreams {
+			if up.getName() == "fast" {
+				fastStats = up.getInfo().stats
+			}
+			if !up.isAlive() {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			req, err := newRequest(1337, []byte(fmt.Sprintf(`{"params": [], "method": "eth_gasPrice", "id": %d, "jsonrpc": "2.0"}`, i+1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bts, err := proxy.handle(req)
+			assert.Nil(t, err)
+			assert.Contains(t, string(bts), `"result":"0x1"`)
+		}
+	}
+
+	// every upstream gets a first sample, then the fast one takes the traffic
+	send(20)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&slowHits))
+	assert.Equal(t, int64(19), atomic.LoadInt64(&fastHits))
+
+	// the failing upstream is skipped after its first failure
+	atomic.StoreInt64(&fastFailing, 1)
+	send(10)
+	assert.Equal(t, int64(11), atomic.LoadInt64(&slowHits))
+	assert.Equal(t, int64(20), atomic.LoadInt64(&fastHits))
+
+	// the explored requests let the score of the fixed upstream recover
+	atomic.StoreInt64(&fastFailing, 0)
+	failedScore := fastStats.score()
+	proxy.exploreRatio = 1
+	send(5)
+	assert.Equal(t, int64(25), atomic.LoadInt64(&fastHits))
+	assert.True(t, fastStats.score() < failedScore)
+}
+
+func TestP2CProxyHandle(t *testing.T) {
+	var aHits, bHits int64
+
+	a := newTestUpstreamServer(func(data *RequestData) interface{} {
+		if data.Method == "eth_gasPrice" {
+			atomic.AddInt64(&aHits, 1)
+		}
+		return "0x1"
+	})
+	defer a.Close()
+	b := newTestUpstreamServer(func(data *RequestData) interface{} {
+		if data.Method == "eth_gasPrice" {
+			atomic.AddInt64(&bHits, 1)
+		}
+		return "0x1"
+	})
+	defer b.Close()
+
+	config := NewConfig()
+	err := json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {"upstreams": [{"url": "%s", "name": "p2c-a"}, {"url": "%s", "name": "p2c-b", "maxConcurrency": 1}], "strategy": "P2C"}}`, a.URL, b.URL)), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreams := make(map[string]*upstreamInfo)
+	assert.Eventually(t, func() bool {
+		cfg := getRunningConfig().Configs[1337]
+		cfg.updateLocker.RLock()
+		defer cfg.updateLocker.RUnlock()
+
+		for _, up := range cfg.Upstreams {
+			upstreams[up.getName()] = up.getInfo()
+			if !up.isAlive() {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			req, err := newRequest(1337, []byte(fmt.Sprintf(`{"params": [], "method": "eth_gasPrice", "id": %d, "jsonrpc": "2.0"}`, i+1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bts, err := getRunningConfig().Configs[1337].Strategy.handle(req)
+			assert.Nil(t, err)
+			assert.Contains(t, string(bts), `"result":"0x1"`)
+		}
+	}
+
+	// the less loaded upstream takes the requests
+	atomic.StoreInt64(&upstreams["p2c-a"].inFlight, 5)
+	send(10)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&aHits))
+	assert.Equal(t, int64(10), atomic.LoadInt64(&bHits))
+
+	// the requests spill over when the upstream reached its maxConcurrency
+	atomic.StoreInt64(&upstreams["p2c-a"].inFlight, 2)
+	atomic.StoreInt64(&upstreams["p2c-b"].inFlight, 1)
+	send(10)
+	assert.Equal(t, int64(10), atomic.LoadInt64(&aHits))
+	assert.Equal(t, int64(10), atomic.LoadInt64(&bHits))
+
+	// the in-flight requests are exported per chain and upstream
+	assert.Equal(t, float64(2), testutil.ToFloat64(upstreamInFlightGauge.WithLabelValues("1337", "p2c-a")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(upstreamInFlightGauge.WithLabelValues("1", "p2c-a")))
+}
+
+func TestQuorumProxyHandle(t *testing.T) {
+	results := make([]atomic.Value, 3)
+	var urls []interface{}
+
+	for i := range results {
+		result := &results[i]
+		server := newTestUpstreamServer(func(data *RequestData) interface{} {
+			if data.Method == "eth_call" {
+				return result.Load()
+			}
+			return "0x1"
+		})
+		defer server.Close()
+
+		urls = append(urls, server.URL)
+	}
+
+	defer closeTestConfig()
+	build := func(quorum string) {
+		config := NewConfig()
+		err := json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {"upstreams": [{"url": "%s", "name": "q0"}, {"url": "%s", "name": "q1"}, {"url": "%s", "name": "q2"}], "strategy": "QUORUM"%s}}`, append(urls, quorum)...)), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = BuildRunningConfigFromConfig(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	call := func(values ...string) ([]byte, error) {
+		for i, value := range values {
+			results[i].Store(value)
+		}
+
+		req, err := newRequest(1337, []byte(`{"params": [{"to": "0x0000000000000000000000000000000000000001", "data": "0x"}, "latest"], "method": "eth_call", "id": 1, "jsonrpc": "2.0"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return getRunningConfig().Configs[1337].Strategy.handle(req)
+	}
+
+	build("")
+	assert.IsType(t, &QuorumProxy{}, getRunningConfig().Configs[1337].Strategy)
+
+	// the hex strings are compared in lower case
+	bts, err := call("0xAB", "0xab", "0xcd")
+	assert.Nil(t, err)
+	assert.Contains(t, strings.ToLower(string(bts)), `"result":"0xab"`)
+
+	_, err = call("0x1", "0x2", "0x3")
+	assert.Equal(t, QuorumNotReachedError, err)
+
+	// all the upstreams must agree
+	build(`, "quorum": {"threshold": 3}`)
+
+	_, err = call("0x1", "0x1", "0x2")
+	assert.Equal(t, QuorumNotReachedError, err)
+
+	bts, err = call("0x2", "0x2", "0x2")
+	assert.Nil(t, err)
+	assert.Contains(t, string(bts), `"result":"0x2"`)
+
+	// the quorum can't be larger than the upstreams
+	config := NewConfig()
+	err = json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {"upstreams": ["%s", "%s"], "strategy": "QUORUM", "quorum": {"size": 3}}}`, urls[0], urls[1])), config)
+	assert.Nil(t, err)
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	assert.NotNil(t, err)
+}
+
+func TestHedgedProxyHandle(t *testing.T) {
+	var primaryDelay, primaryCancelled, secondaryHits int64
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data RequestData
+		_ = json.NewDecoder(r.Body).Decode(&data)
+
+		if data.Method == "eth_gasPrice" {
+			select {
+			case <-time.After(time.Duration(atomic.LoadInt64(&primaryDelay))):
+			case <-r.Context().Done():
+				atomic.AddInt64(&primaryCancelled, 1)
+				return
+			}
+		}
+
+		bts, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": data.ID, "result": "0x1"})
+		_, _ = w.Write(bts)
+	}))
+	defer primary.Close()
+
+	secondary := newTestUpstreamServer(func(data *RequestData) interface{} {
+		if data.Method == "eth_gasPrice" {
+			atomic.AddInt64(&secondaryHits, 1)
+		}
+		return "0x2"
+	})
+	defer secondary.Close()
+
+	config := NewConfig()
+	err := json.Unmarshal([]byte(fmt.Sprintf(`{"1337": {"upstreams": [{"url": "%s", "tier": 1}, {"url": "%s"}], "strategy": "HEDGED", "hedge": {"delay": "50ms"}}}`, secondary.URL, primary.URL)), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer closeTestConfig()
+	_, err = BuildRunningConfigFromConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Eventually(t, func() bool {
+		cfg := getRunningConfig().Configs[1337]
+		cfg.updateLocker.RLock()
+		defer cfg.updateLocker.RUnlock()
+
+		return cfg.Upstreams[0].isAlive() && cfg.Upstreams[1].isAlive()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	send := func() []byte {
+		req, err := newRequest(1337, []byte(`{"params": [], "method": "eth_gasPrice", "id": 1, "jsonrpc": "2.0"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bts, err := getRunningConfig().Configs[1337].Strategy.handle(req)
+		assert.Nil(t, err)
+		return bts
+	}
+
+	sent := testutil.ToFloat64(counter.WithLabelValues("hedge_sent_1337"))
+	won := testutil.ToFloat64(counter.WithLabelValues("hedge_won_1337"))
+
+	// the preferred upstream answers in time
+	assert.Contains(t, string(send()), `"result":"0x1"`)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&secondaryHits))
+	assert.Equal(t, sent, testutil.ToFloat64(counter.WithLabelValues("hedge_sent_1337")))
+
+	// the stalled request is hedged and cancelled
+	atomic.StoreInt64(&primaryDelay, int64(5*time.Second))
+	startTime := time.Now()
+	assert.Contains(t, string(send()), `"result":"0x2"`)
+	assert.True(t, time.Since(startTime) < time.Second)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&secondaryHits))
+	assert.Equal(t, sent+1, testutil.ToFloat64(counter.WithLabelValues("hedge_sent_1337")))
+	assert.Equal(t, won+1, testutil.ToFloat64(counter.WithLabelValues("hedge_won_1337")))
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&primaryCancelled) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
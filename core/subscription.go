@@ -0,0 +1,592 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/sirupsen/logrus"
+)
+
+var NotificationsNotSupportedError = fmt.Errorf("notifications not supported")
+var SubscriptionNotSupportedError = fmt.Errorf("subscriptions need a websocket upstream")
+
+// subscriptionNotification is the params of an eth_subscription message
+type subscriptionNotification struct {
+	Subscription string          `json:"subscription"`
+	Result       json.RawMessage `json:"result"`
+}
+
+// upstreamSubscription is a subscription opened on the upstream, shared by all the
+// client subscriptions with the same params.
+type upstreamSubscription struct {
+	key     string
+	params  []interface{}
+	id      string // the subscription id given by the upstream
+	clients map[string]*clientSubscription
+}
+
+type clientSubscription struct {
+	id       string // the subscription id given to the client
+	conn     *wsClientConn
+	upstream *upstreamSubscription
+}
+
+// subscriptionRpcError is an error answered by the upstream, the upstream itself works.
+// It's forwarded to the client as it is.
+type subscriptionRpcError struct {
+	*JsonRpcError
+}
+
+func (e subscriptionRpcError) Error() string {
+	return e.Message
+}
+
+// subscriptionManager multiplexes the eth_subscribe calls of all the websocket
+// clients of a chain onto one websocket upstream, and moves them to another
+// websocket upstream of the chain when it fails.
+type subscriptionManager struct {
+	ctx       context.Context
+	chainId   uint64
+	chain     *RunningChainConfig
+	upstreams []*WsUpstream
+
+	// subscribeLocker serializes the calls to the upstream, so that the same params
+	// are never subscribed twice
+	subscribeLocker sync.Mutex
+
+	locker        sync.Mutex
+	upstream      *WsUpstream                      // the upstream holding the subscriptions
+	waiting       bool                             // the subscriptions wait for a ws upstream to be back
+	byKey         map[string]*upstreamSubscription // params => upstream subscription
+	byUpstreamId  map[string]*upstreamSubscription // upstream subscription id => upstream subscription
+	subscriptions map[string]*clientSubscription   // client subscription id => client subscription
+}
+
+// newSubscriptionManager returns nil if the chain has no websocket upstream
+func newSubscriptionManager(ctx context.Context, chainId uint64, chain *RunningChainConfig) *subscriptionManager {
+	m := &subscriptionManager{
+		ctx:           ctx,
+		chainId:       chainId,
+		chain:         chain,
+		byKey:         make(map[string]*upstreamSubscription),
+		byUpstreamId:  make(map[string]*upstreamSubscription),
+		subscriptions: make(map[string]*clientSubscription),
+	}
+
+	for _, up := range chain.Upstreams {
+		if u, ok := up.(*WsUpstream); ok {
+			m.upstreams = append(m.upstreams, u)
+		}
+	}
+
+	if len(m.upstreams) == 0 {
+		return nil
+	}
+
+	// the chain is locked while it is built
+	candidates := m.candidatesLocked(nil)
+	if len(candidates) == 0 {
+		candidates = m.upstreams
+	}
+	m.upstream = candidates[0]
+
+	// the upstream is closed with the running config, clients have to subscribe again
+	runInBackground(ctx, func() {
+		<-ctx.Done()
+		m.closeAll()
+	})
+
+	return m
+}
+
+// listen makes the manager the listener of its upstreams, once its chain is published
+func (m *subscriptionManager) listen() {
+	for _, u := range m.upstreams {
+		u.setListener(m)
+	}
+}
+
+// takeOver moves the subscriptions of the old manager of a rebuilt chain, they stay on
+// their upstream if it's kept, the clients don't notice
+func (m *subscriptionManager) takeOver(old *subscriptionManager) {
+	old.subscribeLocker.Lock()
+	defer old.subscribeLocker.Unlock()
+
+	m.subscribeLocker.Lock()
+	defer m.subscribeLocker.Unlock()
+
+	old.locker.Lock()
+	upstream, waiting := old.upstream, old.waiting
+	byKey, byUpstreamId, subscriptions := old.byKey, old.byUpstreamId, old.subscriptions
+	old.byKey = make(map[string]*upstreamSubscription)
+	old.byUpstreamId = make(map[string]*upstreamSubscription)
+	old.subscriptions = make(map[string]*clientSubscription)
+	old.locker.Unlock()
+
+	if len(byKey) == 0 {
+		return
+	}
+
+	m.locker.Lock()
+	m.byKey, m.byUpstreamId, m.subscriptions = byKey, byUpstreamId, subscriptions
+	m.locker.Unlock()
+
+	for _, clientSub := range subscriptions {
+		clientSub.conn.moveSubscriptionManager(old, m)
+	}
+
+	for _, u := range m.upstreams {
+		if u == upstream {
+			m.locker.Lock()
+			m.upstream, m.waiting = upstream, waiting
+			m.locker.Unlock()
+			return
+		}
+	}
+
+	if m.failover(upstream) == nil {
+		m.locker.Lock()
+		m.waiting = true
+		m.locker.Unlock()
+	}
+}
+
+// candidates are the enabled ws upstreams but the excluded one, the available ones first
+func (m *subscriptionManager) candidates(exclude *WsUpstream) []*WsUpstream {
+	m.chain.updateLocker.RLock()
+	defer m.chain.updateLocker.RUnlock()
+
+	return m.candidatesLocked(exclude)
+}
+
+func (m *subscriptionManager) candidatesLocked(exclude *WsUpstream) []*WsUpstream {
+	var available, others []*WsUpstream
+
+	for _, u := range m.upstreams {
+		if u == exclude || u.disabled {
+			continue
+		}
+
+		if isAvailable(u) {
+			available = append(available, u)
+		} else {
+			others = append(others, u)
+		}
+	}
+
+	return append(available, others...)
+}
+
+func (m *subscriptionManager) getUpstream() *WsUpstream {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	return m.upstream
+}
+
+func (m *subscriptionManager) call(upstream *WsUpstream, method string, params []interface{}) (json.RawMessage, error) {
+	bts, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  method,
+		"params":  params,
+	})
+
+	req, err := parseRequest(m.chainId, bts)
+	if err != nil {
+		return nil, err
+	}
+
+	resBts, err := upstream.handle(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var res jsonRpcRawResponse
+
+	if err := json.Unmarshal(resBts, &res); err != nil {
+		return nil, err
+	}
+
+	if res.Error != nil {
+		return nil, subscriptionRpcError{res.Error}
+	}
+
+	return res.Result, nil
+}
+
+func (m *subscriptionManager) subscribeUpstream(upstream *WsUpstream, params []interface{}) (string, error) {
+	result, err := m.call(upstream, "eth_subscribe", params)
+	if err != nil {
+		return "", err
+	}
+
+	var id string
+	if err := json.Unmarshal(result, &id); err != nil {
+		return "", fmt.Errorf("bad subscription id %s", string(result))
+	}
+
+	return id, nil
+}
+
+func (m *subscriptionManager) unsubscribeUpstream(id string) {
+	upstream := m.getUpstream()
+
+	if _, err := m.call(upstream, "eth_unsubscribe", []interface{}{id}); err != nil {
+		logrus.Warnf("unsubscribe %s from ws upstream %s failed: %v", id, upstream.name, err)
+	}
+}
+
+// subscribe returns the new subscription id of the client
+func (m *subscriptionManager) subscribe(conn *wsClientConn, params []interface{}) (string, error) {
+	if len(params) == 0 {
+		return "", InvalidRequestError
+	}
+
+	keyBts, err := json.Marshal(params)
+	if err != nil {
+		return "", InvalidRequestError
+	}
+	key := string(keyBts)
+
+	m.subscribeLocker.Lock()
+	defer m.subscribeLocker.Unlock()
+
+	m.locker.Lock()
+	sub, exist := m.byKey[key]
+	m.locker.Unlock()
+
+	if !exist {
+		upstream := m.getUpstream()
+
+		m.locker.Lock()
+		idle := len(m.byKey) == 0
+		m.locker.Unlock()
+
+		// nothing to move, the subscriptions start on the best upstream
+		if idle {
+			if candidates := m.candidates(nil); len(candidates) > 0 && candidates[0] != upstream {
+				upstream = candidates[0]
+				m.setUpstream(upstream)
+			}
+		}
+
+		upstreamId, err := m.subscribeUpstream(upstream, params)
+
+		// the upstream failed, the subscriptions move to another one
+		if _, ok := err.(subscriptionRpcError); err != nil && !ok {
+			logrus.Warnf("subscribe to ws upstream %s failed: %v", upstream.name, err)
+
+			if next := m.failover(upstream); next != nil {
+				upstreamId, err = m.subscribeUpstream(next, params)
+			}
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		sub = &upstreamSubscription{
+			key:     key,
+			params:  params,
+			id:      upstreamId,
+			clients: make(map[string]*clientSubscription),
+		}
+
+		Count("upstream_subscription")
+	}
+
+	clientSub := &clientSubscription{
+		id:       newSubscriptionId(),
+		conn:     conn,
+		upstream: sub,
+	}
+
+	m.locker.Lock()
+	m.byKey[key] = sub
+	m.byUpstreamId[sub.id] = sub
+	sub.clients[clientSub.id] = clientSub
+	m.subscriptions[clientSub.id] = clientSub
+	m.locker.Unlock()
+
+	conn.addSubscriptionManager(m)
+
+	Count("subscription")
+	logrus.Infof("ws client subscribed %s on chain %d: %s", clientSub.id, m.chainId, key)
+
+	return clientSub.id, nil
+}
+
+// unsubscribe returns false if the subscription is not found or belongs to another client
+func (m *subscriptionManager) unsubscribe(conn *wsClientConn, id string) bool {
+	m.subscribeLocker.Lock()
+	defer m.subscribeLocker.Unlock()
+
+	m.locker.Lock()
+	clientSub, exist := m.subscriptions[id]
+	if !exist || clientSub.conn != conn {
+		m.locker.Unlock()
+		return false
+	}
+
+	idle := m.removeLocked(clientSub)
+	m.locker.Unlock()
+
+	if idle != nil {
+		m.unsubscribeUpstream(idle.id)
+	}
+
+	return true
+}
+
+// removeConn drops all the subscriptions of a disconnected client
+func (m *subscriptionManager) removeConn(conn *wsClientConn) {
+	m.subscribeLocker.Lock()
+	defer m.subscribeLocker.Unlock()
+
+	var idles []*upstreamSubscription
+
+	m.locker.Lock()
+	for _, clientSub := range m.subscriptions {
+		if clientSub.conn == conn {
+			if idle := m.removeLocked(clientSub); idle != nil {
+				idles = append(idles, idle)
+			}
+		}
+	}
+	m.locker.Unlock()
+
+	for _, idle := range idles {
+		m.unsubscribeUpstream(idle.id)
+	}
+}
+
+// removeLocked returns the upstream subscription if it has no client left
+func (m *subscriptionManager) removeLocked(clientSub *clientSubscription) *upstreamSubscription {
+	sub := clientSub.upstream
+
+	delete(m.subscriptions, clientSub.id)
+	delete(sub.clients, clientSub.id)
+
+	if len(sub.clients) > 0 {
+		return nil
+	}
+
+	delete(m.byKey, sub.key)
+	delete(m.byUpstreamId, sub.id)
+
+	return sub
+}
+
+// closeAll drops every subscription and closes the client connections, so that
+// clients notice the lost subscriptions and subscribe again.
+func (m *subscriptionManager) closeAll() {
+	m.locker.Lock()
+	subscriptions := m.subscriptions
+	m.byKey = make(map[string]*upstreamSubscription)
+	m.byUpstreamId = make(map[string]*upstreamSubscription)
+	m.subscriptions = make(map[string]*clientSubscription)
+	m.locker.Unlock()
+
+	for _, clientSub := range subscriptions {
+		_ = clientSub.conn.close()
+	}
+}
+
+// onNotification is called by the upstreams for every eth_subscription message,
+// the ones of a previous upstream are dropped
+func (m *subscriptionManager) onNotification(upstream *WsUpstream, notification *subscriptionNotification) {
+	m.locker.Lock()
+	sub, exist := m.byUpstreamId[notification.Subscription]
+	exist = exist && upstream == m.upstream
+
+	var clients []*clientSubscription
+	if exist {
+		for _, clientSub := range sub.clients {
+			clients = append(clients, clientSub)
+		}
+	}
+	m.locker.Unlock()
+
+	for _, clientSub := range clients {
+		bts, _ := json.Marshal(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  "eth_subscription",
+			"params": &subscriptionNotification{
+				Subscription: clientSub.id,
+				Result:       notification.Result,
+			},
+		})
+
+		if err := clientSub.conn.writeText(bts); err != nil {
+			logrus.Debugf("write notification to ws client failed %v", err)
+		}
+	}
+}
+
+// onReconnected subscribes again, the upstream subscriptions are lost with the old connection
+func (m *subscriptionManager) onReconnected(upstream *WsUpstream) {
+	m.subscribeLocker.Lock()
+	defer m.subscribeLocker.Unlock()
+
+	m.locker.Lock()
+	resubscribe := upstream == m.upstream || m.waiting
+	m.locker.Unlock()
+
+	if resubscribe {
+		m.moveTo(upstream)
+	}
+}
+
+// onDisconnected moves the subscriptions to another ws upstream, or they wait for one to be back
+func (m *subscriptionManager) onDisconnected(upstream *WsUpstream) {
+	if m.ctx.Err() != nil {
+		return
+	}
+
+	m.subscribeLocker.Lock()
+	defer m.subscribeLocker.Unlock()
+
+	if m.getUpstream() != upstream {
+		return
+	}
+
+	if m.failover(upstream) == nil {
+		m.locker.Lock()
+		m.waiting = len(m.byKey) > 0
+		m.locker.Unlock()
+	}
+}
+
+// failover moves the subscriptions from the failed upstream to the first candidate
+// taking them, it returns nil if no other upstream could, subscribeLocker must be held
+func (m *subscriptionManager) failover(failed *WsUpstream) *WsUpstream {
+	for _, upstream := range m.candidates(failed) {
+		if m.moveTo(upstream) {
+			logrus.Warnf("ws subscriptions of chain %d moved from upstream %s to %s", m.chainId, failed.name, upstream.name)
+			Count("subscription_failover")
+			return upstream
+		}
+	}
+
+	return nil
+}
+
+func (m *subscriptionManager) setUpstream(upstream *WsUpstream) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	m.upstream = upstream
+	m.waiting = false
+}
+
+// moveTo subscribes everything again on the upstream, it returns false and changes
+// nothing if the upstream fails, subscribeLocker must be held
+func (m *subscriptionManager) moveTo(upstream *WsUpstream) bool {
+	m.locker.Lock()
+	var subs []*upstreamSubscription
+	for _, sub := range m.byKey {
+		subs = append(subs, sub)
+	}
+	m.locker.Unlock()
+
+	ids := make(map[*upstreamSubscription]string, len(subs))
+	var errs []error
+
+	for i, sub := range subs {
+		upstreamId, err := m.subscribeUpstream(upstream, sub.params)
+
+		if _, ok := err.(subscriptionRpcError); err != nil && !ok && i == 0 {
+			logrus.Errorf("resubscribe to ws upstream %s failed: %v", upstream.name, err)
+			return false
+		}
+
+		ids[sub] = upstreamId
+		errs = append(errs, err)
+	}
+
+	var conns []*wsClientConn
+
+	m.locker.Lock()
+	m.upstream = upstream
+	m.waiting = false
+	m.byUpstreamId = make(map[string]*upstreamSubscription)
+
+	for i, sub := range subs {
+		if errs[i] == nil {
+			sub.id = ids[sub]
+			m.byUpstreamId[sub.id] = sub
+			continue
+		}
+
+		logrus.Errorf("resubscribe %s to ws upstream %s failed: %v", sub.key, upstream.name, errs[i])
+
+		for _, clientSub := range sub.clients {
+			m.removeLocked(clientSub)
+			conns = append(conns, clientSub.conn)
+		}
+	}
+	m.locker.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.close()
+	}
+
+	return true
+}
+
+func newSubscriptionId() string {
+	bts := make([]byte, 16)
+	_, _ = rand.Read(bts)
+
+	return hexutil.Encode(bts)
+}
+
+func isSubscriptionRequest(method string) bool {
+	return method == "eth_subscribe" || method == "eth_unsubscribe"
+}
+
+// handleSubscriptionRequest serves eth_subscribe and eth_unsubscribe of websocket clients
+func handleSubscriptionRequest(req *Request) ([]byte, error) {
+	conn := req.client.conn
+	if conn == nil {
+		return nil, NotificationsNotSupportedError
+	}
+
+	manager := req.getChain().subscriptions
+	if manager == nil {
+		return nil, SubscriptionNotSupportedError
+	}
+
+	var result interface{}
+
+	if req.data.Method == "eth_subscribe" {
+		id, err := manager.subscribe(conn, req.data.Params)
+		if rpcErr, ok := err.(subscriptionRpcError); ok {
+			bts, _ := json.Marshal(&JsonRpcResponse{JsonRpc: "2.0", ID: req.data.ID, Err: rpcErr.JsonRpcError})
+			return bts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = id
+	} else {
+		if len(req.data.Params) == 0 {
+			return nil, InvalidRequestError
+		}
+
+		id, ok := req.data.Params[0].(string)
+		if !ok {
+			return nil, InvalidRequestError
+		}
+		result = manager.unsubscribe(conn, id)
+	}
+
+	resultBts, _ := json.Marshal(result)
+
+	return getResultResponseBytes(req.data.ID, resultBts), nil
+}
@@ -0,0 +1,304 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// testWsNode is a fake websocket node which records the subscription calls
+type testWsNode struct {
+	*httptest.Server
+
+	locker  sync.Mutex
+	conn    *websocket.Conn
+	calls   []string
+	counter int
+}
+
+func newTestWsNode() *testWsNode {
+	node := &testWsNode{}
+
+	node.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		node.locker.Lock()
+		node.conn = conn
+		node.locker.Unlock()
+
+		for {
+			_, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var data RequestData
+			_ = json.Unmarshal(p, &data)
+
+			var result interface{} = "0x1"
+			res := map[string]interface{}{"jsonrpc": "2.0", "id": data.ID}
+
+			node.locker.Lock()
+			switch {
+			case data.Method == "eth_subscribe" && len(data.Params) > 0 && data.Params[0] == "unknown":
+				res["error"] = map[string]interface{}{"code": -32602, "message": "unsupported subscription type"}
+			case data.Method == "eth_subscribe":
+				node.counter++
+				node.calls = append(node.calls, data.Method)
+				result = "0xup" + string(rune('0'+node.counter))
+			case data.Method == "eth_unsubscribe":
+				node.calls = append(node.calls, data.Method)
+				result = true
+			}
+
+			if res["error"] == nil {
+				res["result"] = result
+			}
+
+			bts, _ := json.Marshal(res)
+			_ = conn.WriteMessage(websocket.TextMessage, bts)
+			node.locker.Unlock()
+		}
+	}))
+
+	return node
+}
+
+func (n *testWsNode) notify(subscription string, result string) {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	bts, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "eth_subscription",
+		"params":  map[string]interface{}{"subscription": subscription, "result": result},
+	})
+	_ = n.conn.WriteMessage(websocket.TextMessage, bts)
+}
+
+// drop closes the connection of the gateway, as a failing node would
+func (n *testWsNode) drop() {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	_ = n.conn.Close()
+}
+
+func (n *testWsNode) getCalls() []string {
+	n.locker.Lock()
+	defer n.locker.Unlock()
+
+	return append([]string{}, n.calls...)
+}
+
+func readTestWsMessage(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var msg map[string]interface{}
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+func TestSubscription(t *testing.T) {
+	node := newTestWsNode()
+	defer node.Close()
+
+	config := &Config{
+		1337: ChainConfig{
+			Upstreams: []UpstreamConfig{{Url: "ws" + strings.TrimPrefix(node.URL, "http")}},
+			Strategy:  "NAIVE",
+		},
+	}
+
+	defer closeTestConfig()
+	_, err := BuildRunningConfigFromConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := httptest.NewServer(&Server{})
+	defer gateway.Close()
+
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/ws/1337", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	subscribe := func(conn *websocket.Conn) string {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "id": 7, "method": "eth_subscribe", "params": ["newHeads"]}`))
+		res := readTestWsMessage(t, conn)
+		assert.Equal(t, float64(7), res["id"])
+		return res["result"].(string)
+	}
+
+	client1 := dial()
+	defer client1.Close()
+	client2 := dial()
+	defer client2.Close()
+
+	id1 := subscribe(client1)
+	id2 := subscribe(client2)
+	assert.NotEqual(t, id1, id2)
+
+	// both clients share one upstream subscription
+	assert.Equal(t, []string{"eth_subscribe"}, node.getCalls())
+
+	node.notify("0xup1", "head")
+
+	for conn, id := range map[*websocket.Conn]string{client1: id1, client2: id2} {
+		msg := readTestWsMessage(t, conn)
+		assert.Equal(t, "eth_subscription", msg["method"])
+		assert.Equal(t, id, msg["params"].(map[string]interface{})["subscription"])
+		assert.Equal(t, "head", msg["params"].(map[string]interface{})["result"])
+	}
+
+	// client2 can't cancel the subscription of client1
+	_ = client2.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "id": 8, "method": "eth_unsubscribe", "params": ["`+id1+`"]}`))
+	assert.Equal(t, false, readTestWsMessage(t, client2)["result"])
+
+	_ = client1.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "id": 8, "method": "eth_unsubscribe", "params": ["`+id1+`"]}`))
+	assert.Equal(t, true, readTestWsMessage(t, client1)["result"])
+	assert.Equal(t, []string{"eth_subscribe"}, node.getCalls())
+
+	// the upstream subscription is cancelled with its last client
+	_ = client2.Close()
+
+	assert.Eventually(t, func() bool {
+		return len(node.getCalls()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"eth_subscribe", "eth_unsubscribe"}, node.getCalls())
+
+	// http clients can't subscribe
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/http/1337", strings.NewReader(`{"jsonrpc": "2.0", "id": 1, "method": "eth_subscribe", "params": ["newHeads"]}`))
+	(&Server{}).ServeHTTP(recorder, req)
+	assert.Contains(t, recorder.Body.String(), NotificationsNotSupportedError.Error())
+
+	// the rejection of the node is forwarded
+	_ = client1.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "id": 9, "method": "eth_subscribe", "params": ["unknown"]}`))
+	res := readTestWsMessage(t, client1)
+	assert.Equal(t, float64(9), res["id"])
+	assert.Equal(t, map[string]interface{}{"code": float64(-32602), "message": "unsupported subscription type"}, res["error"])
+}
+
+func TestSubscriptionFailover(t *testing.T) {
+	node1 := newTestWsNode()
+	defer node1.Close()
+	node2 := newTestWsNode()
+	defer node2.Close()
+
+	config := &Config{
+		1337: ChainConfig{
+			Upstreams: []UpstreamConfig{
+				{Url: "ws" + strings.TrimPrefix(node1.URL, "http"), Name: "node1"},
+				{Url: "ws" + strings.TrimPrefix(node2.URL, "http"), Name: "node2"},
+			},
+			Strategy: "FALLBACK",
+		},
+	}
+
+	defer closeTestConfig()
+	_, err := BuildRunningConfigFromConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := httptest.NewServer(&Server{})
+	defer gateway.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/ws/1337", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_ = client.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "id": 7, "method": "eth_subscribe", "params": ["newHeads"]}`))
+	id := readTestWsMessage(t, client)["result"].(string)
+
+	assert.Equal(t, []string{"eth_subscribe"}, node1.getCalls())
+	assert.Empty(t, node2.getCalls())
+
+	// the subscription moves to the other upstream when the node fails
+	node1.drop()
+
+	assert.Eventually(t, func() bool {
+		return len(node2.getCalls()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	node2.notify("0xup1", "head")
+
+	msg := readTestWsMessage(t, client)
+	assert.Equal(t, id, msg["params"].(map[string]interface{})["subscription"])
+	assert.Equal(t, "head", msg["params"].(map[string]interface{})["result"])
+
+	// a disabled upstream gets no subscription
+	manager := getRunningConfig().Configs[1337].subscriptions
+	getRunningConfig().Configs[1337].updateLocker.Lock()
+	getRunningConfig().Configs[1337].getUpstream("node2").getInfo().disabled = true
+	getRunningConfig().Configs[1337].updateLocker.Unlock()
+
+	assert.Equal(t, []*WsUpstream{manager.upstreams[0]}, manager.candidates(nil))
+}
+
+func TestSubscriptionKeptOnRebuild(t *testing.T) {
+	node1 := newTestWsNode()
+	defer node1.Close()
+	node2 := newTestWsNode()
+	defer node2.Close()
+
+	chainCfg := ChainConfig{
+		Upstreams: []UpstreamConfig{
+			{Url: "ws" + strings.TrimPrefix(node1.URL, "http"), Name: "node1"},
+			{Url: "ws" + strings.TrimPrefix(node2.URL, "http"), Name: "node2"},
+		},
+		Strategy: "FALLBACK",
+	}
+
+	defer closeTestConfig()
+	_, err := BuildRunningConfigFromConfig(context.Background(), &Config{1337: chainCfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := httptest.NewServer(&Server{})
+	defer gateway.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/ws/1337", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_ = client.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc": "2.0", "id": 7, "method": "eth_subscribe", "params": ["newHeads"]}`))
+	id := readTestWsMessage(t, client)["result"].(string)
+
+	// the upstreams are kept, the subscription stays on its upstream
+	chainCfg.Strategy = "RACE"
+	assert.Nil(t, getRunningConfig().rebuildChain(1337, chainCfg))
+
+	node1.notify("0xup1", "head")
+
+	msg := readTestWsMessage(t, client)
+	assert.Equal(t, id, msg["params"].(map[string]interface{})["subscription"])
+	assert.Equal(t, "head", msg["params"].(map[string]interface{})["result"])
+	assert.Equal(t, []string{"eth_subscribe"}, node1.getCalls())
+	assert.Empty(t, node2.getCalls())
+}
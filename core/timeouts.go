@@ -0,0 +1,166 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Duration is a time.Duration read from a duration string, e.g. "500ms", "5s" or "2m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(bts []byte) error {
+	var s string
+	if err := json.Unmarshal(bts, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"5s\", got %s", string(bts))
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// TimeoutsConfig is set globally and can be overridden per chain,
+// a nil field keeps the value of the upper level.
+type TimeoutsConfig struct {
+	// HealthCheckInterval is how often the upstreams are checked
+	HealthCheckInterval *Duration `json:"healthCheckInterval"`
+	// HealthCheckChainDelay spreads the health checks of the chains, global only
+	HealthCheckChainDelay *Duration `json:"healthCheckChainDelay"`
+	// OldTriePollInterval is how often the block number of the oldTrieUrl is updated
+	OldTriePollInterval *Duration `json:"oldTriePollInterval"`
+	// WsQueueTimeout is how long a request waits for the ws upstream connection
+	WsQueueTimeout *Duration `json:"wsQueueTimeout"`
+	// WsResponseTimeout is how long a request waits for the ws upstream response
+	WsResponseTimeout *Duration `json:"wsResponseTimeout"`
+	// WsReconnectDelay is the wait before dialing a ws upstream or the oldTrieUrl again
+	WsReconnectDelay *Duration `json:"wsReconnectDelay"`
+	// RequestTimeout limits every http upstream request
+	RequestTimeout *Duration `json:"requestTimeout"`
+	// RaceTimeout is how long the RACE strategy waits for a successful response
+	RaceTimeout *Duration `json:"raceTimeout"`
+	// ReorgCheckInterval is how often the latest block is polled for reorgs
+	ReorgCheckInterval *Duration `json:"reorgCheckInterval"`
+	// LagCheckInterval is how often the heights of the upstreams are polled when maxLag is set
+	LagCheckInterval *Duration `json:"lagCheckInterval"`
+	// HealthCacheTTL is how long the /health response is cached, global only
+	HealthCacheTTL *Duration `json:"healthCacheTTL"`
+	// ConfigPollInterval is how often the config file is checked for changes, global only
+	ConfigPollInterval *Duration `json:"configPollInterval"`
+}
+
+type Timeouts struct {
+	HealthCheckInterval   time.Duration
+	HealthCheckChainDelay time.Duration
+	OldTriePollInterval   time.Duration
+	WsQueueTimeout        time.Duration
+	WsResponseTimeout     time.Duration
+	WsReconnectDelay      time.Duration
+	RequestTimeout        time.Duration
+	RaceTimeout           time.Duration
+	ReorgCheckInterval    time.Duration
+	LagCheckInterval      time.Duration
+	HealthCacheTTL        time.Duration
+	ConfigPollInterval    time.Duration
+}
+
+var defaultTimeouts = Timeouts{
+	HealthCheckInterval:   2 * time.Minute,
+	HealthCheckChainDelay: 10 * time.Second,
+	OldTriePollInterval:   30 * time.Second,
+	WsQueueTimeout:        5 * time.Second,
+	WsResponseTimeout:     5 * time.Second,
+	WsReconnectDelay:      5 * time.Second,
+	RequestTimeout:        10 * time.Second,
+	RaceTimeout:           10 * time.Second,
+	ReorgCheckInterval:    5 * time.Second,
+	LagCheckInterval:      10 * time.Second,
+	HealthCacheTTL:        time.Minute,
+	ConfigPollInterval:    3 * time.Second,
+}
+
+// merge overrides the base timeouts with the configured ones
+func (c *TimeoutsConfig) merge(base *Timeouts) (*Timeouts, error) {
+	timeouts := *base
+
+	if c == nil {
+		return &timeouts, nil
+	}
+
+	fields := []struct {
+		name     string
+		value    *Duration
+		target   *time.Duration
+		zeroable bool
+	}{
+		{"healthCheckInterval", c.HealthCheckInterval, &timeouts.HealthCheckInterval, false},
+		{"healthCheckChainDelay", c.HealthCheckChainDelay, &timeouts.HealthCheckChainDelay, true},
+		{"oldTriePollInterval", c.OldTriePollInterval, &timeouts.OldTriePollInterval, false},
+		{"wsQueueTimeout", c.WsQueueTimeout, &timeouts.WsQueueTimeout, false},
+		{"wsResponseTimeout", c.WsResponseTimeout, &timeouts.WsResponseTimeout, false},
+		{"wsReconnectDelay", c.WsReconnectDelay, &timeouts.WsReconnectDelay, false},
+		{"requestTimeout", c.RequestTimeout, &timeouts.RequestTimeout, false},
+		{"raceTimeout", c.RaceTimeout, &timeouts.RaceTimeout, false},
+		{"reorgCheckInterval", c.ReorgCheckInterval, &timeouts.ReorgCheckInterval, false},
+		{"lagCheckInterval", c.LagCheckInterval, &timeouts.LagCheckInterval, false},
+		{"healthCacheTTL", c.HealthCacheTTL, &timeouts.HealthCacheTTL, true},
+		{"configPollInterval", c.ConfigPollInterval, &timeouts.ConfigPollInterval, false},
+	}
+
+	for _, field := range fields {
+		if field.value == nil {
+			continue
+		}
+
+		v := time.Duration(*field.value)
+
+		if v < 0 || (v == 0 && !field.zeroable) {
+			return nil, fmt.Errorf("timeouts: %s should be positive, got %s", field.name, v)
+		}
+
+		*field.target = v
+	}
+
+	return &timeouts, nil
+}
+
+// validateChainTimeouts rejects the timeouts which only make sense globally
+func validateChainTimeouts(c *TimeoutsConfig) error {
+	if c == nil {
+		return nil
+	}
+
+	if c.HealthCheckChainDelay != nil || c.HealthCacheTTL != nil || c.ConfigPollInterval != nil {
+		return fmt.Errorf("timeouts: healthCheckChainDelay, healthCacheTTL and configPollInterval can only be set globally")
+	}
+
+	return nil
+}
+
+func getGlobalTimeouts() *Timeouts {
+	if rcfg := getRunningConfig(); rcfg != nil && rcfg.timeouts != nil {
+		return rcfg.timeouts
+	}
+
+	return &defaultTimeouts
+}
+
+// getTimeouts returns the timeouts of the chain in the running config, or the defaults
+func getTimeouts(chainId uint64) *Timeouts {
+	if rcfg := getRunningConfig(); rcfg != nil {
+		if cfg, ok := rcfg.Configs[chainId]; ok && cfg.timeouts != nil {
+			return cfg.timeouts
+		}
+	}
+
+	return getGlobalTimeouts()
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutsConfigMerge(t *testing.T) {
+	var cfg TimeoutsConfig
+	err := json.Unmarshal([]byte(`{"healthCheckInterval": "30s", "raceTimeout": "1500ms"}`), &cfg)
+	assert.Nil(t, err)
+
+	timeouts, err := cfg.merge(&defaultTimeouts)
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, timeouts.HealthCheckInterval)
+	assert.Equal(t, 1500*time.Millisecond, timeouts.RaceTimeout)
+	assert.Equal(t, defaultTimeouts.RequestTimeout, timeouts.RequestTimeout)
+
+	var nilCfg *TimeoutsConfig
+	timeouts, err = nilCfg.merge(&defaultTimeouts)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultTimeouts, *timeouts)
+
+	err = json.Unmarshal([]byte(`{"requestTimeout": 10}`), &cfg)
+	assert.NotNil(t, err)
+
+	err = json.Unmarshal([]byte(`{"requestTimeout": "10 seconds"}`), &cfg)
+	assert.NotNil(t, err)
+
+	cfg = TimeoutsConfig{}
+	_ = json.Unmarshal([]byte(`{"requestTimeout": "0s"}`), &cfg)
+	_, err = cfg.merge(&defaultTimeouts)
+	assert.NotNil(t, err)
+
+	cfg = TimeoutsConfig{}
+	_ = json.Unmarshal([]byte(`{"healthCheckChainDelay": "0s"}`), &cfg)
+	_, err = cfg.merge(&defaultTimeouts)
+	assert.Nil(t, err)
+	assert.NotNil(t, validateChainTimeouts(&cfg))
+}
+
+func TestNewRunningConfigTimeouts(t *testing.T) {
+	var testConfigStr = `{
+		"timeouts": {
+			"requestTimeout": "3s",
+			"configPollInterval": "10s"
+		},
+		"1337": {
+			"upstreams": ["http://127.0.0.1:1"],
+			"strategy": "NAIVE",
+			"timeouts": {
+				"requestTimeout": "1s"
+			}
+		},
+		"1338": {
+			"upstreams": ["http://127.0.0.1:1"],
+			"strategy": "NAIVE"
+		}
+	}`
+
+	config := NewConfig()
+	globalConfig := NewGlobalConfig()
+
+	assert.Nil(t, json.Unmarshal([]byte(testConfigStr), config))
+	assert.Nil(t, json.Unmarshal([]byte(testConfigStr), globalConfig))
+
+	defer closeTestConfig()
+	_, err := BuildRunningConfigFromConfigs(context.Background(), config, globalConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 10*time.Second, getGlobalTimeouts().ConfigPollInterval)
+	assert.Equal(t, time.Second, getTimeouts(1337).RequestTimeout)
+	assert.Equal(t, 3*time.Second, getTimeouts(1338).RequestTimeout)
+	assert.Equal(t, defaultTimeouts.RaceTimeout, getTimeouts(1338).RaceTimeout)
+	// unknown chains use the global timeouts
+	assert.Equal(t, 3*time.Second, getTimeouts(1).RequestTimeout)
+
+	// global only timeouts can't be set per chain
+	(*config)[1337] = ChainConfig{
+		Upstreams: []UpstreamConfig{{Url: "http://127.0.0.1:1"}},
+		Strategy:  "NAIVE",
+		Timeouts:  &TimeoutsConfig{HealthCacheTTL: new(Duration)},
+	}
+
+	_, err = BuildRunningConfigFromConfigs(context.Background(), config, globalConfig)
+	assert.NotNil(t, err)
+}
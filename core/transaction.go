@@ -0,0 +1,230 @@
+package core
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// transaction envelope types, see EIP-2718
+const (
+	LegacyTxType     = 0x00
+	AccessListTxType = 0x01 // EIP-2930
+	DynamicFeeTxType = 0x02 // EIP-1559
+	BlobTxType       = 0x03 // EIP-4844
+	SetCodeTxType    = 0x04 // EIP-7702
+)
+
+// field layout of every envelope payload, signature fields always come last
+var txLayouts = map[byte]struct {
+	fields        int
+	toIndex       int
+	authListIndex int
+}{
+	// nonce, gasPrice, gasLimit, to, value, data, v, r, s
+	LegacyTxType: {9, 3, -1},
+	// chainId, nonce, gasPrice, gasLimit, to, value, data, accessList, yParity, r, s
+	AccessListTxType: {11, 4, -1},
+	// chainId, nonce, maxPriorityFeePerGas, maxFeePerGas, gasLimit, to, value, data, accessList, yParity, r, s
+	DynamicFeeTxType: {12, 5, -1},
+	// chainId, nonce, maxPriorityFeePerGas, maxFeePerGas, gasLimit, to, value, data, accessList,
+	// maxFeePerBlobGas, blobVersionedHashes, yParity, r, s
+	BlobTxType: {14, 5, -1},
+	// chainId, nonce, maxPriorityFeePerGas, maxFeePerGas, gasLimit, destination, value, data, accessList,
+	// authorizationList, yParity, r, s
+	SetCodeTxType: {13, 5, 9},
+}
+
+// authorization tuple fields: chainId, address, nonce, yParity, r, s
+const authorizationFields = 6
+
+type RawTransaction struct {
+	Type byte
+	// To is nil for contract creation
+	To []byte
+	// Authorizations holds the delegation target of every EIP-7702 authorization
+	Authorizations [][]byte
+
+	// fields is the decoded envelope payload, without the blob sidecar
+	fields []interface{}
+}
+
+func (tx *RawTransaction) isContractCreation() bool {
+	return len(tx.To) == 0
+}
+
+// decodeRawTransaction decodes the hex param of eth_sendRawTransaction.
+// Legacy transactions are a plain rlp list, typed ones are `type || rlp(payload)`.
+// Blob transactions may be sent in their network form `type || rlp([payload, sidecar...])`.
+func decodeRawTransaction(data string) (*RawTransaction, error) {
+	bts, err := hexutil.Decode(data)
+
+	if err != nil || len(bts) == 0 {
+		return nil, DecodeError
+	}
+
+	tx := &RawTransaction{}
+
+	if bts[0] >= 0xc0 {
+		tx.Type = LegacyTxType
+	} else if bts[0] <= 0x7f {
+		tx.Type = bts[0]
+		bts = bts[1:]
+	} else {
+		return nil, DecodeError
+	}
+
+	layout, ok := txLayouts[tx.Type]
+	if !ok {
+		return nil, DecodeError
+	}
+
+	if err := rlp.DecodeBytes(bts, &tx.fields); err != nil {
+		return nil, DecodeError
+	}
+
+	// blob network wrapper, the payload is the first element
+	if tx.Type == BlobTxType && len(tx.fields) > 0 {
+		if payload, ok := tx.fields[0].([]interface{}); ok {
+			tx.fields = payload
+		}
+	}
+
+	if len(tx.fields) != layout.fields {
+		return nil, DecodeError
+	}
+
+	to, ok := tx.fields[layout.toIndex].([]byte)
+	if !ok || (len(to) != 0 && len(to) != 20) {
+		return nil, DecodeError
+	}
+
+	if len(to) != 0 {
+		tx.To = to
+	} else if tx.Type == BlobTxType || tx.Type == SetCodeTxType {
+		// blob and set code transactions can't create contracts
+		return nil, DecodeError
+	}
+
+	if layout.authListIndex >= 0 {
+		authList, ok := tx.fields[layout.authListIndex].([]interface{})
+		if !ok || len(authList) == 0 {
+			return nil, DecodeError
+		}
+
+		for _, item := range authList {
+			auth, ok := item.([]interface{})
+			if !ok || len(auth) != authorizationFields {
+				return nil, DecodeError
+			}
+
+			address, ok := auth[1].([]byte)
+			if !ok || len(address) != 20 {
+				return nil, DecodeError
+			}
+
+			tx.Authorizations = append(tx.Authorizations, address)
+		}
+	}
+
+	return tx, nil
+}
+
+// sender recovers the signer address. chainId is the id of the chain the gateway
+// serves, it is part of the signing hash of EIP-155 and typed transactions.
+func (tx *RawTransaction) sender(chainId uint64) ([]byte, error) {
+	n := len(tx.fields)
+	if n < 3 {
+		return nil, DecodeError
+	}
+
+	v, ok1 := tx.fields[n-3].([]byte)
+	r, ok2 := tx.fields[n-2].([]byte)
+	s, ok3 := tx.fields[n-1].([]byte)
+	if !ok1 || !ok2 || !ok3 || len(r) > 32 || len(s) > 32 {
+		return nil, DecodeError
+	}
+
+	var signingPayload []byte
+	var recoveryId *big.Int
+	var err error
+
+	if tx.Type == LegacyTxType {
+		vInt := new(big.Int).SetBytes(v)
+		unsigned := tx.fields[:n-3]
+
+		if vInt.Cmp(big.NewInt(27)) == 0 || vInt.Cmp(big.NewInt(28)) == 0 {
+			// pre EIP-155, no replay protection
+			recoveryId = vInt.Sub(vInt, big.NewInt(27))
+		} else {
+			// v = chainId * 2 + 35 + recoveryId
+			chainIdMul := new(big.Int).SetUint64(chainId * 2)
+			recoveryId = vInt.Sub(vInt, big.NewInt(35))
+			recoveryId.Sub(recoveryId, chainIdMul)
+
+			if recoveryId.Sign() < 0 || recoveryId.Cmp(big.NewInt(1)) > 0 {
+				return nil, DeniedChainId
+			}
+
+			unsigned = append(append([]interface{}{}, unsigned...), new(big.Int).SetUint64(chainId), uint(0), uint(0))
+		}
+
+		signingPayload, err = rlp.EncodeToBytes(unsigned)
+	} else {
+		txChainId, ok := tx.fields[0].([]byte)
+		if !ok {
+			return nil, DecodeError
+		}
+
+		if new(big.Int).SetBytes(txChainId).Cmp(new(big.Int).SetUint64(chainId)) != 0 {
+			return nil, DeniedChainId
+		}
+
+		recoveryId = new(big.Int).SetBytes(v)
+
+		var payload []byte
+		payload, err = rlp.EncodeToBytes(tx.fields[:n-3])
+		signingPayload = append([]byte{tx.Type}, payload...)
+	}
+
+	if err != nil {
+		return nil, DecodeError
+	}
+
+	rInt, sInt := new(big.Int).SetBytes(r), new(big.Int).SetBytes(s)
+	if !recoveryId.IsUint64() || !crypto.ValidateSignatureValues(byte(recoveryId.Uint64()), rInt, sInt, true) {
+		return nil, DecodeError
+	}
+
+	sig := make([]byte, 65)
+	copy(sig[32-len(r):32], r)
+	copy(sig[64-len(s):64], s)
+	sig[64] = byte(recoveryId.Uint64())
+
+	pub, err := crypto.SigToPub(crypto.Keccak256(signingPayload), sig)
+	if err != nil {
+		return nil, DecodeError
+	}
+
+	return crypto.PubkeyToAddress(*pub).Bytes(), nil
+}
+
+// hash is the transaction hash, the blob sidecar is not part of it
+func (tx *RawTransaction) hash() ([]byte, error) {
+	payload, err := rlp.EncodeToBytes(tx.fields)
+	if err != nil {
+		return nil, DecodeError
+	}
+
+	if tx.Type != LegacyTxType {
+		payload = append([]byte{tx.Type}, payload...)
+	}
+
+	return crypto.Keccak256(payload), nil
+}
+
+func isZeroAddress(address []byte) bool {
+	return new(big.Int).SetBytes(address).Sign() == 0
+}
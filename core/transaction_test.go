@@ -0,0 +1,194 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/stretchr/testify/assert"
+)
+
+var testTxTo = hexutil.MustDecode("0x06898143df04616a8a8f9614deb3b99ba12b3096")
+var testTxOther = hexutil.MustDecode("0xc2c57336e01695d34f8012f6c0d250bab2dd38dd")
+
+// encodeTestTransaction builds a raw transaction with a dummy signature
+func encodeTestTransaction(t *testing.T, txType byte, to []byte, extra ...interface{}) string {
+	var fields []interface{}
+
+	switch txType {
+	case LegacyTxType:
+		fields = []interface{}{uint(1), uint(2), uint(21000), to, uint(0), []byte{}, uint(37), uint(1), uint(1)}
+	case AccessListTxType:
+		fields = []interface{}{uint(1337), uint(1), uint(2), uint(21000), to, uint(0), []byte{}, []interface{}{}, uint(0), uint(1), uint(1)}
+	case DynamicFeeTxType:
+		fields = []interface{}{uint(1337), uint(1), uint(2), uint(3), uint(21000), to, uint(0), []byte{}, []interface{}{}, uint(0), uint(1), uint(1)}
+	case BlobTxType:
+		fields = []interface{}{uint(1337), uint(1), uint(2), uint(3), uint(21000), to, uint(0), []byte{}, []interface{}{},
+			uint(4), []interface{}{make([]byte, 32)}, uint(0), uint(1), uint(1)}
+	case SetCodeTxType:
+		fields = []interface{}{uint(1337), uint(1), uint(2), uint(3), uint(21000), to, uint(0), []byte{}, []interface{}{},
+			extra, uint(0), uint(1), uint(1)}
+	}
+
+	var payload interface{} = fields
+	if txType == BlobTxType && len(extra) > 0 {
+		// network form with blobs, commitments and proofs
+		payload = append([]interface{}{fields}, extra...)
+	}
+
+	bts, err := rlp.EncodeToBytes(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if txType != LegacyTxType {
+		bts = append([]byte{txType}, bts...)
+	}
+
+	return hexutil.Encode(bts)
+}
+
+func testAuthorization(address []byte) []interface{} {
+	return []interface{}{uint(1337), address, uint(0), uint(0), uint(1), uint(1)}
+}
+
+func TestDecodeRawTransaction(t *testing.T) {
+	for _, txType := range []byte{LegacyTxType, AccessListTxType, DynamicFeeTxType, BlobTxType} {
+		tx, err := decodeRawTransaction(encodeTestTransaction(t, txType, testTxTo))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, txType, tx.Type)
+		assert.Equal(t, testTxTo, tx.To)
+	}
+
+	tx, err := decodeRawTransaction(encodeTestTransaction(t, BlobTxType, testTxTo, []interface{}{}, []interface{}{}, []interface{}{}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, testTxTo, tx.To)
+
+	tx, err = decodeRawTransaction(encodeTestTransaction(t, SetCodeTxType, testTxTo, testAuthorization(testTxOther)))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, testTxTo, tx.To)
+	assert.Equal(t, [][]byte{testTxOther}, tx.Authorizations)
+
+	tx, err = decodeRawTransaction(encodeTestTransaction(t, DynamicFeeTxType, []byte{}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, tx.isContractCreation())
+
+	_, err = decodeRawTransaction(encodeTestTransaction(t, BlobTxType, []byte{}))
+	assert.Equal(t, DecodeError, err)
+
+	_, err = decodeRawTransaction(encodeTestTransaction(t, SetCodeTxType, testTxTo))
+	assert.Equal(t, DecodeError, err)
+
+	_, err = decodeRawTransaction("0x05c0")
+	assert.Equal(t, DecodeError, err)
+
+	_, err = decodeRawTransaction("0x")
+	assert.Equal(t, DecodeError, err)
+}
+
+var testTxKey, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+
+func signTestLegacyTransaction(t *testing.T, key *ecdsa.PrivateKey, chainId uint64, to []byte) string {
+	// EIP-155 signing hash covers chainId, 0, 0 in place of v, r, s
+	unsigned := []interface{}{uint(1), uint(2), uint(21000), to, uint(0), []byte{}}
+
+	payload, err := rlp.EncodeToBytes(append(unsigned, chainId, uint(0), uint(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := crypto.Sign(crypto.Keccak256(payload), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := chainId*2 + 35 + uint64(sig[64])
+	signed := append(unsigned, v, new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:64]))
+
+	bts, err := rlp.EncodeToBytes(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hexutil.Encode(bts)
+}
+
+func signTestDynamicFeeTransaction(t *testing.T, key *ecdsa.PrivateKey, chainId uint64, to []byte) string {
+	unsigned := []interface{}{chainId, uint(1), uint(2), uint(3), uint(21000), to, uint(0), []byte{}, []interface{}{}}
+
+	payload, err := rlp.EncodeToBytes(unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := crypto.Sign(crypto.Keccak256(append([]byte{DynamicFeeTxType}, payload...)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := append(unsigned, uint(sig[64]), new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:64]))
+
+	bts, err := rlp.EncodeToBytes(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hexutil.Encode(append([]byte{DynamicFeeTxType}, bts...))
+}
+
+func TestRawTransactionSender(t *testing.T) {
+	expected := crypto.PubkeyToAddress(testTxKey.PublicKey).Bytes()
+
+	tx, err := decodeRawTransaction(signTestLegacyTransaction(t, testTxKey, 1337, testTxTo))
+	assert.Equal(t, nil, err)
+
+	sender, err := tx.sender(1337)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expected, sender)
+
+	_, err = tx.sender(1)
+	assert.Equal(t, DeniedChainId, err)
+
+	tx, err = decodeRawTransaction(signTestDynamicFeeTransaction(t, testTxKey, 1337, testTxTo))
+	assert.Equal(t, nil, err)
+
+	sender, err = tx.sender(1337)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expected, sender)
+
+	_, err = tx.sender(1)
+	assert.Equal(t, DeniedChainId, err)
+
+	// the ropsten transaction used in TestIsValidCall
+	tx, err = decodeRawTransaction("0xf9018b14850306dc420083025db89406898143df04616a8a8f9614deb3b99ba12b309680b901248059cf3b000000000000000000000000000000000000000000000000000000000000002000000000000000000000000000000000000000000000000000000000000000010000000000000000000000000000000000000000000000000000000000000020000000000000000000000000000000000000000000000000000000000000000400000000000000000000000000000000000000000000000000000000000000400000000000000000000000000000000000000000000000000000000000000060000000000000000000000000000000000000000000000000000000000000000300000000000000000000000060fa59b6a32c08023c5e0002d6ddebdf4cb2c294000000000000000000000000000000000000000000000000000000002a45d6a02aa0a400038e05162401a612414b0129b7a0fab2824fdb7d365a4e9c34309b633aa5a02cd68de2b4146542a4fed0d918d011617e75d84f024dee4b0028dff56e1f9b31")
+	assert.Equal(t, nil, err)
+
+	_, err = tx.sender(3)
+	assert.Equal(t, nil, err)
+
+	_, err = tx.sender(1337)
+	assert.Equal(t, DeniedChainId, err)
+}
+
+func TestRawTransactionHash(t *testing.T) {
+	for _, txType := range []byte{LegacyTxType, DynamicFeeTxType} {
+		raw := encodeTestTransaction(t, txType, testTxTo)
+		tx, err := decodeRawTransaction(raw)
+		assert.Nil(t, err)
+
+		hash, err := tx.hash()
+		assert.Nil(t, err)
+		assert.Equal(t, crypto.Keccak256(hexutil.MustDecode(raw)), hash)
+	}
+
+	// the blob sidecar is not hashed
+	plain, _ := decodeRawTransaction(encodeTestTransaction(t, BlobTxType, testTxTo))
+	wrapped, _ := decodeRawTransaction(encodeTestTransaction(t, BlobTxType, testTxTo, []interface{}{}, []interface{}{}, []interface{}{}))
+
+	plainHash, _ := plain.hash()
+	wrappedHash, _ := wrapped.hash()
+	assert.Equal(t, plainHash, wrappedHash)
+}
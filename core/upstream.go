@@ -18,16 +18,257 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+var MethodNotSupportedError = fmt.Errorf("method not supported by upstream")
+var UpstreamBusyError = fmt.Errorf("upstream max concurrency reached")
+
 // the handle function will execute concurrently
 type Upstream interface {
 	handle(*Request) ([]byte, error)
 	updateBlockNumber()
 	getRpcUrl() string
+	getName() string
+	getInfo() *upstreamInfo
 	getBlockNumber() uint64
 	isAlive() bool
 	getLatancy() int64
 }
 
+// UpstreamConfig is either a plain url string or an object
+type UpstreamConfig struct {
+	Url  string `json:"url"`
+	Name string `json:"name,omitempty"`
+	// Weight is the share of traffic of the upstream, default 1
+	Weight int `json:"weight,omitempty"`
+	// Tier orders the upstreams, lower tiers are used first
+	Tier    int               `json:"tier,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// MaxConcurrency limits the in-flight requests, 0 means no limit
+	MaxConcurrency int `json:"maxConcurrency,omitempty"`
+	// Methods is the list of supported methods, empty means all methods
+	Methods []string `json:"methods,omitempty"`
+	// Archive upstreams serve archive data themselves instead of the oldTrieUrl
+	Archive bool `json:"archive,omitempty"`
+	// Disabled upstreams are kept out of the routes
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+func (c *UpstreamConfig) UnmarshalJSON(bts []byte) error {
+	var urlString string
+	if err := json.Unmarshal(bts, &urlString); err == nil {
+		*c = UpstreamConfig{Url: urlString}
+		return nil
+	}
+
+	type plainUpstreamConfig UpstreamConfig
+
+	var cfg plainUpstreamConfig
+	if err := json.Unmarshal(bts, &cfg); err != nil {
+		return err
+	}
+
+	*c = UpstreamConfig(cfg)
+
+	return nil
+}
+
+func (c *UpstreamConfig) validate() error {
+	if c.Url == "" {
+		return fmt.Errorf("upstream %s: blank url", c.Name)
+	}
+
+	u, err := url.Parse(c.Url)
+	if err != nil {
+		return fmt.Errorf("upstream %s: invalid url", c.Name)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ws" && u.Scheme != "wss" {
+		return fmt.Errorf("upstream %s: unsupported scheme %s, use http, https, ws or wss", c.Name, u.Scheme)
+	}
+
+	if c.Weight < 0 || c.Tier < 0 || c.MaxConcurrency < 0 {
+		return fmt.Errorf("upstream %s: weight, tier and maxConcurrency can't be negative", c.Name)
+	}
+
+	return nil
+}
+
+// upstreamInfo holds the configured attributes shared by http and ws upstreams
+type upstreamInfo struct {
+	chainId        uint64
+	name           string
+	weight         int
+	tier           int
+	headers        http.Header
+	maxConcurrency int64
+	methods        map[string]bool
+	archive        bool
+
+	nextID   int64 // id of the last upstream request
+	inFlight int64
+	stats    *latencyStats
+	breaker  *circuitBreaker // nil when disabled
+
+	knownBlock uint64 // see getKnownBlock
+
+	// lag behind the chain head, guarded by the updateLocker of the chain
+	lagBlocks uint64
+	lagTime   time.Duration
+	lagging   bool
+
+	disabled bool // guarded by the updateLocker of the chain
+
+	stop context.CancelFunc // stops the goroutines of the upstream, nil when it's not built by a running config
+}
+
+func newUpstreamInfo(chainId uint64, cfg UpstreamConfig, u *url.URL) upstreamInfo {
+	info := upstreamInfo{
+		chainId:        chainId,
+		name:           cfg.Name,
+		weight:         cfg.Weight,
+		tier:           cfg.Tier,
+		headers:        http.Header{},
+		maxConcurrency: int64(cfg.MaxConcurrency),
+		methods:        make(map[string]bool),
+		archive:        cfg.Archive,
+		disabled:       cfg.Disabled,
+		nextID:         time.Now().Unix(),
+		stats:          &latencyStats{},
+	}
+
+	// the url is kept out of logs and metrics, it may carry credentials
+	if info.name == "" {
+		info.name = u.Host
+	}
+
+	if info.weight == 0 {
+		info.weight = 1
+	}
+
+	for key, value := range cfg.Headers {
+		info.headers.Set(key, value)
+	}
+
+	for _, method := range cfg.Methods {
+		info.methods[method] = true
+	}
+
+	return info
+}
+
+// getState tells whether the upstream gets traffic, a disabled upstream is draining until its requests are finished
+func (i *upstreamInfo) getState() string {
+	if !i.disabled {
+		return "enabled"
+	}
+
+	if i.getInFlight() > 0 {
+		return "draining"
+	}
+
+	return "disabled"
+}
+
+func (i *upstreamInfo) close() {
+	if i.stop != nil {
+		i.stop()
+	}
+}
+
+func (i *upstreamInfo) getName() string {
+	return i.name
+}
+
+func (i *upstreamInfo) getInfo() *upstreamInfo {
+	return i
+}
+
+func (i *upstreamInfo) getInFlight() int64 {
+	return atomic.LoadInt64(&i.inFlight)
+}
+
+func (i *upstreamInfo) supportsMethod(method string) bool {
+	return len(i.methods) == 0 || i.methods[method]
+}
+
+// answerFailed tells whether an answer counts against the upstream, node errors like rate limits do,
+// reverts are valid answers
+func answerFailed(request *Request, bts []byte, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	// most answers are results, they aren't parsed again
+	if !bytes.Contains(bts, []byte(`"error"`)) {
+		return false
+	}
+
+	var policy *failoverPolicy
+	if chain := request.getChain(); chain != nil {
+		policy = chain.failover
+	}
+
+	class := policy.classify(bts, nil)
+
+	return class == transportError || class == nodeError
+}
+
+// serve applies the method list and the concurrency limit to client requests,
+// and records the upstream metrics.
+func (i *upstreamInfo) serve(request *Request, send func(*Request) ([]byte, error)) ([]byte, error) {
+	if !i.supportsMethod(request.data.Method) {
+		return nil, MethodNotSupportedError
+	}
+
+	n := atomic.AddInt64(&i.inFlight, 1)
+	if i.maxConcurrency > 0 && n > i.maxConcurrency {
+		atomic.AddInt64(&i.inFlight, -1)
+		CountUpstream(i.chainId, i.name, "busy")
+		return nil, UpstreamBusyError
+	}
+
+	if !i.breaker.allow() {
+		atomic.AddInt64(&i.inFlight, -1)
+		CountUpstream(i.chainId, i.name, "breaker_rejected")
+		return nil, CircuitOpenError
+	}
+
+	ValueUpstreamInFlight(i.chainId, i.name, n)
+
+	defer func() {
+		ValueUpstreamInFlight(i.chainId, i.name, atomic.AddInt64(&i.inFlight, -1))
+	}()
+
+	logrus.Debugf("%v handled by %v", request.data.Method, i.name)
+
+	startTime := time.Now()
+	bts, err := send(request)
+	duration := time.Since(startTime)
+
+	// a cancelled request says nothing about the upstream
+	if err != nil && request.getContext().Err() != nil {
+		i.breaker.release()
+		CountUpstream(i.chainId, i.name, "cancelled")
+		return nil, err
+	}
+
+	failed := answerFailed(request, bts, err)
+	i.breaker.record(failed)
+	i.stats.observe(duration, failed)
+
+	if err == nil {
+		i.observeResponse(request, bts)
+	}
+
+	CountUpstream(i.chainId, i.name, "request")
+	TimeUpstream(i.chainId, i.name, float64(duration.Nanoseconds()/1000000))
+
+	if err != nil {
+		CountUpstream(i.chainId, i.name, "error")
+	}
+
+	return bts, err
+}
+
 type wsProxyRequest struct {
 	*Request
 	id       int64
@@ -35,26 +276,41 @@ type wsProxyRequest struct {
 }
 
 type wsProxyResponse struct {
-	ID int64 `json:"id"`
+	ID     int64                     `json:"id"`
+	Method string                    `json:"method"`
+	Params *subscriptionNotification `json:"params"`
+}
+
+// subscriptionListener receives the subscription events of a ws upstream
+type subscriptionListener interface {
+	onNotification(*WsUpstream, *subscriptionNotification)
+	onReconnected(*WsUpstream)
+	onDisconnected(*WsUpstream)
 }
 
 type WsUpstream struct {
+	upstreamInfo
+
 	chainId      uint64
 	url          string
 	requestQueue chan *wsProxyRequest
-	nextID       int64     // proxy request id
 	requests     *sync.Map // proxy request id => proxy request
-	blockNumber  int
+	blockNumber  int64     // atomic, like latency
 	latency      int64
+
+	listenerLocker sync.Mutex
+	listener       subscriptionListener
 }
 
 type HttpUpstream struct {
+	upstreamInfo
+
 	ctx         context.Context
 	chainId     uint64
 	url         string
 	oldTrieUrl  string
-	blockNumber int
-	latency     int64
+	blockNumber int64 // atomic, the old trie poller sets it too
+	latency     int64 // atomic, a kept upstream is read by the old and the new chain
 }
 
 type BlockNumberResponseData struct {
@@ -63,7 +319,8 @@ type BlockNumberResponseData struct {
 	Result  string `json:"result"`
 }
 
-func newUpstream(ctx context.Context, chainId uint64, urlString string, oldTrieUrlString string) Upstream {
+func newUpstream(ctx context.Context, chainId uint64, cfg UpstreamConfig, oldTrieUrlString string) Upstream {
+	urlString := cfg.Url
 	u, err := url.Parse(urlString)
 
 	if err != nil {
@@ -72,7 +329,7 @@ func newUpstream(ctx context.Context, chainId uint64, urlString string, oldTrieU
 
 	ou := u
 
-	if urlString != oldTrieUrlString {
+	if urlString != oldTrieUrlString && !cfg.Archive {
 		ou, err = url.Parse(oldTrieUrlString)
 
 		if err != nil {
@@ -81,11 +338,12 @@ func newUpstream(ctx context.Context, chainId uint64, urlString string, oldTrieU
 	}
 
 	var up Upstream
+	info := newUpstreamInfo(chainId, cfg, u)
 
 	if u.Scheme == "http" || u.Scheme == "https" {
-		up = newHttpUpstream(ctx, chainId, u, ou)
+		up = newHttpUpstream(ctx, chainId, u, ou, info)
 	} else if u.Scheme == "ws" || u.Scheme == "wss" {
-		up = newWsStream(ctx, chainId, u)
+		up = newWsStream(ctx, chainId, u, info)
 	} else {
 		panic(fmt.Errorf("unsuportted url schema %s", u.Scheme))
 	}
@@ -94,52 +352,60 @@ func newUpstream(ctx context.Context, chainId uint64, urlString string, oldTrieU
 }
 
 func (u *HttpUpstream) handle(request *Request) ([]byte, error) {
-	logrus.Debugf("%v handled by %v", request.data.Method, u.url)
+	return u.serve(request, u.send)
+}
 
+func (u *HttpUpstream) send(request *Request) ([]byte, error) {
 	ul := u.url
 
-	if request.isOldTrieRequest(u.blockNumber) {
+	if request.isOldTrieRequest(int(atomic.LoadInt64(&u.blockNumber))) {
 		ul = u.oldTrieUrl
 	}
 
-	upstreamReq, _ := http.NewRequest("POST", ul, bytes.NewReader(request.reqBytes))
+	id := atomic.AddInt64(&u.nextID, 1)
+	body, err := request.upstreamBody(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(request.getContext(), getTimeouts(u.chainId).RequestTimeout)
+	defer cancel()
+
+	upstreamReq, _ := http.NewRequest("POST", ul, bytes.NewReader(body))
+	upstreamReq = upstreamReq.WithContext(ctx)
+	for key := range u.headers {
+		upstreamReq.Header.Set(key, u.headers.Get(key))
+	}
 	upstreamReq.Header.Set("Content-Type", "application/json")
 
 	res, err := httpClient.Do(upstreamReq)
 
 	if err != nil {
-		logrus.Errorf("http upstream client do request error: %+v", err)
+		// the url may hold the api key of the provider, the upstream is named instead
+		if urlErr, ok := err.(*url.Error); ok {
+			err = &url.Error{Op: urlErr.Op, URL: u.name, Err: urlErr.Err}
+		}
+
+		logrus.Errorf("http upstream %s client do request error: %+v", u.name, err)
 		return nil, err
 	}
+	defer res.Body.Close()
 
 	bts, err := ioutil.ReadAll(res.Body)
 
 	if err != nil {
-		logrus.Errorf("http upstream io readall error: %+v", err)
+		logrus.Errorf("http upstream %s io readall error: %+v", u.name, err)
 		return nil, err
 	}
 
-	resp := &JsonRpcResponse{}
-	err = json.Unmarshal(bts, resp)
-	if err != nil {
-		logrus.Warnf("failed to unmarshal json rpc resp: %v", err)
-		return nil, fmt.Errorf("failed to unmarshal json rpc resp: %v", err)
-	}
-	if resp.ID != request.data.ID {
-		logrus.Warnf("not match request's ID, reqId=%v, respId=%v", request.data.ID, resp.ID)
-		return nil, fmt.Errorf("not match request's ID, reqId=%v, respId=%v", request.data.ID, resp.ID)
-	}
-
-	// logrus.Infof("req: %+v, resp: %+v", *request.data, *resp)
-
-	return bts, nil
+	return request.clientResponse(bts, id)
 }
 
 func (u *HttpUpstream) updateBlockNumber() {
 	req := getBlockNumberRequest(u.chainId)
 	var latency int64
 	startTime := time.Now()
-	bts, err := u.handle(req)
+	bts, err := u.send(req)
 	endTime := time.Now()
 	if err != nil {
 		latency = math.MaxInt64
@@ -150,20 +416,20 @@ func (u *HttpUpstream) updateBlockNumber() {
 	_ = json.Unmarshal(bts, &res)
 
 	blockNumber, _ := strconv.ParseInt(res.Result, 0, 64)
-	u.blockNumber = int(blockNumber)
-	u.latency = latency
+	atomic.StoreInt64(&u.blockNumber, blockNumber)
+	atomic.StoreInt64(&u.latency, latency)
 }
 
 func (u *HttpUpstream) isAlive() bool {
-	return u.latency != math.MaxInt64
+	return atomic.LoadInt64(&u.latency) != math.MaxInt64
 }
 
 func (u *HttpUpstream) getBlockNumber() uint64 {
-	return uint64(u.blockNumber)
+	return uint64(atomic.LoadInt64(&u.blockNumber))
 }
 
 func (u *HttpUpstream) getLatancy() int64 {
-	return u.latency
+	return atomic.LoadInt64(&u.latency)
 }
 
 func (u *HttpUpstream) getRpcUrl() string {
@@ -171,38 +437,36 @@ func (u *HttpUpstream) getRpcUrl() string {
 }
 
 func (u *WsUpstream) handle(request *Request) ([]byte, error) {
-	logrus.Debugf("%v handled by %v", request.data.Method, u.url)
+	return u.serve(request, u.send)
+}
 
+func (u *WsUpstream) send(request *Request) ([]byte, error) {
 	proxyRequest := &wsProxyRequest{
 		request,
 		atomic.AddInt64(&u.nextID, 1),
-		make(chan []byte),
+		make(chan []byte, 1),
 	}
 
 	u.requests.Store(proxyRequest.id, proxyRequest)
 	defer u.requests.Delete(proxyRequest.id)
 
+	timeouts := getTimeouts(u.chainId)
+
 	select {
 	case u.requestQueue <- proxyRequest:
-	case <-time.After(5 * time.Second): // TODO use a configurable timeout
+	case <-time.After(timeouts.WsQueueTimeout):
 		return nil, TimeoutError
+	case <-request.getContext().Done():
+		return nil, request.getContext().Err()
 	}
 
 	select {
 	case res := <-proxyRequest.resBytes:
-		resp := &JsonRpcResponse{}
-		err := json.Unmarshal(res, resp)
-		if err != nil {
-			logrus.Warnf("failed to unmarshal json rpc resp: %v", err)
-			return nil, fmt.Errorf("failed to unmarshal json rpc resp: %v", err)
-		}
-		if resp.ID != request.data.ID {
-			logrus.Warnf("not match request's ID, reqId=%v, respId=%v", request.data.ID, resp.ID)
-			return nil, fmt.Errorf("not match request's ID, reqId=%v, respId=%v", request.data.ID, resp.ID)
-		}
-		return res, nil
-	case <-time.After(5 * time.Second): // TODO use a configurable timeout
+		return request.clientResponse(res, proxyRequest.id)
+	case <-time.After(timeouts.WsResponseTimeout):
 		return nil, TimeoutError
+	case <-request.getContext().Done():
+		return nil, request.getContext().Err()
 	}
 }
 
@@ -210,7 +474,7 @@ func (u *WsUpstream) updateBlockNumber() {
 	req := getBlockNumberRequest(u.chainId)
 	var latency int64
 	startTime := time.Now()
-	bts, err := u.handle(req)
+	bts, err := u.send(req)
 	endTime := time.Now()
 	if err != nil {
 		latency = math.MaxInt64
@@ -221,60 +485,79 @@ func (u *WsUpstream) updateBlockNumber() {
 	_ = json.Unmarshal(bts, &res)
 
 	blockNumber, _ := strconv.ParseInt(res.Result, 0, 64)
-	u.blockNumber = int(blockNumber)
-	u.latency = latency
+	atomic.StoreInt64(&u.blockNumber, blockNumber)
+	atomic.StoreInt64(&u.latency, latency)
 }
 
 func (u *WsUpstream) getBlockNumber() uint64 {
-	return uint64(u.blockNumber)
+	return uint64(atomic.LoadInt64(&u.blockNumber))
 }
 
 func (u *WsUpstream) isAlive() bool {
-	return u.latency != math.MaxInt64
+	return atomic.LoadInt64(&u.latency) != math.MaxInt64
 }
 
 func (u *WsUpstream) getLatancy() int64 {
-	return u.latency
+	return atomic.LoadInt64(&u.latency)
 }
 
 func (u *WsUpstream) getRpcUrl() string {
 	return u.url
 }
 
+func (u *WsUpstream) setListener(listener subscriptionListener) {
+	u.listenerLocker.Lock()
+	defer u.listenerLocker.Unlock()
+
+	u.listener = listener
+}
+
+func (u *WsUpstream) getListener() subscriptionListener {
+	u.listenerLocker.Lock()
+	defer u.listenerLocker.Unlock()
+
+	return u.listener
+}
+
 func (u *WsUpstream) run(ctx context.Context) {
-	logrus.Debugf("ws %s run", u.url)
-	defer logrus.Debugf("ws %s run exit", u.url)
+	logrus.Debugf("ws %s run", u.name)
+	defer logrus.Debugf("ws %s run exit", u.name)
+
+	reconnected := false
 
 	for {
-		conn, _, err := websocket.DefaultDialer.Dial(u.url, nil)
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, u.url, u.headers)
 
 		if err != nil {
-			seconds := 5 // TODO configurable
-			logrus.Errorf("ws upstream %s %v, will retry after %d seconds", u.url, err, seconds)
+			delay := getTimeouts(u.chainId).WsReconnectDelay
+			logrus.Errorf("ws upstream %s %v, will retry after %s", u.name, err, delay)
 
 			select {
 			case <-ctx.Done():
 				// global stop
 				return
-			case <-time.After(time.Second * time.Duration(seconds)):
+			case <-time.After(delay):
 				continue
 			}
 
 		}
 
-		logrus.Infof("ws upstream %s connected", u.url)
-		u.runConn(ctx, conn)
+		logrus.Infof("ws upstream %s connected", u.name)
+		u.runConn(ctx, conn, reconnected)
+		reconnected = true
 
 		select {
 		case <-ctx.Done():
 			// global stop
 			return
+		case <-time.After(getTimeouts(u.chainId).WsReconnectDelay):
+			logrus.Warnf("ws upstream %s disconnected, reconnecting", u.name)
 		}
 	}
 }
 
 // return the connection context
-func (u *WsUpstream) runConn(ctx context.Context, conn *websocket.Conn) {
+func (u *WsUpstream) runConn(ctx context.Context, conn *websocket.Conn, reconnected bool) {
 	defer conn.Close()
 
 	// connContext is for current connection
@@ -282,7 +565,7 @@ func (u *WsUpstream) runConn(ctx context.Context, conn *websocket.Conn) {
 	connContext, done := context.WithCancel(ctx)
 
 	// request loop
-	go func() {
+	runInBackground(connContext, func() {
 		logrus.Debugf("conn request loop start")
 		defer logrus.Debugf("conn request loop stop")
 		defer done()
@@ -292,11 +575,14 @@ func (u *WsUpstream) runConn(ctx context.Context, conn *websocket.Conn) {
 				// if the conn is invalid, exit
 				return
 			case wsProxyRequest := <-u.requestQueue:
-				// use proxy ID
-				wsProxyRequest.Request.data.ID = wsProxyRequest.id
+				// use proxy ID, the request may be shared with other upstreams
+				bts, err := wsProxyRequest.upstreamBody(wsProxyRequest.id)
+				if err != nil {
+					logrus.Errorf("bad request to upstream %v", err)
+					continue
+				}
 
-				bts, _ := json.Marshal(wsProxyRequest.Request.data)
-				err := conn.WriteMessage(websocket.TextMessage, bts)
+				err = conn.WriteMessage(websocket.TextMessage, bts)
 
 				if err != nil {
 					logrus.Errorf("write request to upstream failed %v", err)
@@ -305,10 +591,10 @@ func (u *WsUpstream) runConn(ctx context.Context, conn *websocket.Conn) {
 			}
 
 		}
-	}()
+	})
 
 	// response loop
-	go func() {
+	runInBackground(connContext, func() {
 		logrus.Debugf("conn response loop start")
 		defer logrus.Debugf("conn response loop stop")
 		defer done()
@@ -329,67 +615,107 @@ func (u *WsUpstream) runConn(ctx context.Context, conn *websocket.Conn) {
 			var res wsProxyResponse
 			_ = json.Unmarshal(p, &res)
 
+			if res.Method == "eth_subscription" && res.Params != nil {
+				if listener := u.getListener(); listener != nil {
+					listener.onNotification(u, res.Params)
+				}
+				continue
+			}
+
 			if r, exist := u.requests.Load(res.ID); exist {
 				if req, ok := r.(*wsProxyRequest); ok {
-					req.resBytes <- p
+					// the sender may have given up already
+					select {
+					case req.resBytes <- p:
+					default:
+					}
 				}
 			}
 		}
-	}()
+	})
+
+	if reconnected {
+		if listener := u.getListener(); listener != nil {
+			runInBackground(ctx, func() {
+				listener.onReconnected(u)
+			})
+		}
+	}
 
 	<-connContext.Done()
+
+	if ctx.Err() == nil {
+		if listener := u.getListener(); listener != nil {
+			runInBackground(ctx, func() {
+				listener.onDisconnected(u)
+			})
+		}
+	}
 }
 
-func newHttpUpstream(ctx context.Context, chainId uint64, url *url.URL, oldTrieUrl *url.URL) *HttpUpstream {
+func newHttpUpstream(ctx context.Context, chainId uint64, url *url.URL, oldTrieUrl *url.URL, info upstreamInfo) *HttpUpstream {
 	up := &HttpUpstream{
-		ctx:        ctx,
-		chainId:    chainId,
-		url:        url.String(),
-		oldTrieUrl: oldTrieUrl.String(),
+		upstreamInfo: info,
+		ctx:          ctx,
+		chainId:      chainId,
+		url:          url.String(),
+		oldTrieUrl:   oldTrieUrl.String(),
 	}
 
 	if url != oldTrieUrl {
 		setBlockNumber := func() {
 			req := getBlockNumberRequest(chainId)
-			bts, _ := up.handle(req)
+			req.ctx = ctx
+			bts, _ := up.send(req)
 
 			var res BlockNumberResponseData
 			_ = json.Unmarshal(bts, &res)
 
 			blockNumber, _ := strconv.ParseInt(res.Result, 0, 64)
-			up.blockNumber = int(blockNumber)
+			atomic.StoreInt64(&up.blockNumber, blockNumber)
 
 		}
 
-		go func() {
-			time.Sleep(5 * time.Second)
-			setBlockNumber()
-		}()
+		// the old trie node may not be reachable yet, ask it again after the reconnect delay
+		runInBackground(ctx, func() {
+			select {
+			case <-time.After(getTimeouts(chainId).WsReconnectDelay):
+				setBlockNumber()
+			case <-ctx.Done():
+			}
+		})
 
-		logrus.Infof("start old trie http upstream, blockNumber: %d", up.blockNumber)
+		logrus.Infof("start old trie http upstream, blockNumber: %d", up.getBlockNumber())
 
-		go func() {
+		runInBackground(ctx, func() {
 			for {
 				setBlockNumber()
-				time.Sleep(30 * time.Second)
+
+				select {
+				case <-time.After(getTimeouts(chainId).OldTriePollInterval):
+				case <-ctx.Done():
+					return
+				}
 			}
-		}()
+		})
 	}
 
 	return up
 }
 
-func newWsStream(ctx context.Context, chainId uint64, url *url.URL) *WsUpstream {
+func newWsStream(ctx context.Context, chainId uint64, url *url.URL, info upstreamInfo) *WsUpstream {
 	upstream := &WsUpstream{
+		upstreamInfo: info,
 		chainId:      chainId,
 		url:          url.String(),
 		requestQueue: make(chan *wsProxyRequest),
-		nextID:       time.Now().Unix(),
 		requests:     &sync.Map{},
 	}
 
-	logrus.Infof("new upstream %s", url)
-	go upstream.run(ctx)
+	logrus.Infof("new upstream %s", upstream.name)
+	runInBackground(ctx, func() {
+		upstream.run(ctx)
+	})
 
 	return upstream
 }
@@ -2,8 +2,12 @@ package core
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,13 +17,13 @@ import (
 func TestNewUpstream(t *testing.T) {
 	chainId := uint64(1337)
 
-	upstream1 := newUpstream(context.Background(), chainId, "http://test1.com", "http://test2.com")
+	upstream1 := newUpstream(context.Background(), chainId, UpstreamConfig{Url: "http://test1.com"}, "http://test2.com")
 	assert.IsType(t, &HttpUpstream{}, upstream1)
 
-	upstream2 := newUpstream(context.Background(), chainId, "ws://test1.com", "ws://test2.com")
+	upstream2 := newUpstream(context.Background(), chainId, UpstreamConfig{Url: "ws://test1.com"}, "ws://test2.com")
 	assert.IsType(t, &WsUpstream{}, upstream2)
 
-	assert.Panics(t, func() { newUpstream(context.Background(), chainId, "xxx://test1.com", "xxx://test2.com") })
+	assert.Panics(t, func() { newUpstream(context.Background(), chainId, UpstreamConfig{Url: "xxx://test1.com"}, "xxx://test2.com") })
 }
 
 func TestNewHttpUpstream(t *testing.T) {
@@ -37,7 +41,7 @@ func TestNewHttpUpstream(t *testing.T) {
 
 	chainId := uint64(1337)
 
-	upstream1 := newHttpUpstream(context.Background(), chainId, url1, url2)
+	upstream1 := newHttpUpstream(context.Background(), chainId, url1, url2, upstreamInfo{})
 	assert.Equal(t, upstream1.url, "http://test1.com")
 	assert.Equal(t, upstream1.oldTrieUrl, "http://test2.com")
 }
@@ -55,11 +59,12 @@ func TestHttpHandle(t *testing.T) {
 		panic(err)
 	}
 
+	defer closeTestConfig()
 	initTestConfig(t)
 
 	chainId := uint64(1337)
 
-	upstream1 := newHttpUpstream(context.Background(), chainId, url1, url2)
+	upstream1 := newHttpUpstream(context.Background(), chainId, url1, url2, upstreamInfo{})
 
 	reqBodyBytes1 := []byte(fmt.Sprintf(`{"params": [], "method": "eth_blockNumber", "id": %d, "jsonrpc": "2.0"}`, time.Now().Unix()))
 	req1, err := newRequest(chainId, reqBodyBytes1)
@@ -86,7 +91,7 @@ func TestNewWsUpstream(t *testing.T) {
 
 	chainId := uint64(1337)
 
-	upstream1 := newWsStream(context.Background(), chainId, url1)
+	upstream1 := newWsStream(context.Background(), chainId, url1, upstreamInfo{})
 	assert.Equal(t, upstream1.url, "http://test1.com")
 }
 
@@ -98,9 +103,10 @@ func TestWsHandle(t *testing.T) {
 	}
 
 	chainId := uint64(1337)
+	defer closeTestConfig()
 	initTestConfig(t)
 
-	upstream1 := newWsStream(context.Background(), chainId, url1)
+	upstream1 := newWsStream(context.Background(), chainId, url1, upstreamInfo{})
 
 	reqBodyBytes1 := []byte(fmt.Sprintf(`{"params": [], "method": "eth_blockNumber", "id": %d, "jsonrpc": "2.0"}`, time.Now().Unix()))
 	req1, err := newRequest(chainId, reqBodyBytes1)
@@ -122,7 +128,7 @@ func TestWsHandle(t *testing.T) {
 		panic(err)
 	}
 
-	upstream2 := newWsStream(context.Background(), chainId, url2)
+	upstream2 := newWsStream(context.Background(), chainId, url2, upstreamInfo{})
 
 	reqBodyBytes2 := []byte(fmt.Sprintf(`{"params": [], "method": "eth_blockNumber", "id": %d, "jsonrpc": "2.0"}`, time.Now().Unix()))
 	req2, err := newRequest(chainId, reqBodyBytes2)
@@ -147,7 +153,7 @@ func TestWsRun(t *testing.T) {
 
 	chainId := uint64(1337)
 
-	upstream2 := newWsStream(context.Background(), chainId, url2)
+	upstream2 := newWsStream(context.Background(), chainId, url2, upstreamInfo{})
 
 	timeout := time.After(5 * time.Second)
 	done := make(chan bool)
@@ -163,3 +169,88 @@ func TestWsRun(t *testing.T) {
 		assert.True(t, true)
 	}
 }
+
+func TestHttpUpstreamAttributes(t *testing.T) {
+	var header string
+	var active, maxActive int64
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&active, 1)
+		if n > atomic.LoadInt64(&maxActive) {
+			atomic.StoreInt64(&maxActive, n)
+		}
+		defer atomic.AddInt64(&active, -1)
+
+		header = r.Header.Get("Authorization")
+		time.Sleep(100 * time.Millisecond)
+
+		var data RequestData
+		_ = json.NewDecoder(r.Body).Decode(&data)
+
+		bts, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": data.ID, "result": "0x1"})
+		_, _ = w.Write(bts)
+	}))
+	defer server.Close()
+
+	defer closeTestConfig()
+	initTestConfig(t)
+
+	upstream := newUpstream(context.Background(), 1337, UpstreamConfig{
+		Url:            server.URL,
+		Name:           "node-1",
+		Headers:        map[string]string{"Authorization": "Bearer token"},
+		MaxConcurrency: 1,
+		Methods:        []string{"eth_blockNumber"},
+	}, server.URL)
+
+	assert.Equal(t, "node-1", upstream.getName())
+
+	newTestRequest := func(method string) *Request {
+		req, err := parseRequest(1337, []byte(`{"params": [], "method": "`+method+`", "id": 1, "jsonrpc": "2.0"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	_, err := upstream.handle(newTestRequest("eth_chainId"))
+	assert.Equal(t, MethodNotSupportedError, err)
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := upstream.handle(newTestRequest("eth_blockNumber"))
+			errs <- err
+		}()
+	}
+
+	results := []error{<-errs, <-errs}
+	assert.Contains(t, results, nil)
+	assert.Contains(t, results, UpstreamBusyError)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&maxActive))
+	assert.Equal(t, "Bearer token", header)
+}
+
+func TestHttpUpstreamErrorHidesUrl(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	defer closeTestConfig()
+	initTestConfig(t)
+
+	upstream := newUpstream(context.Background(), 1337, UpstreamConfig{Url: server.URL + "/v3/secret-key", Name: "node-1"}, server.URL)
+
+	req, err := parseRequest(1337, []byte(`{"params": [], "method": "eth_blockNumber", "id": 1, "jsonrpc": "2.0"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the error names the upstream, it's still a network failure for the client
+	_, err = upstream.handle(req)
+	assert.NotNil(t, err)
+	assert.NotContains(t, err.Error(), "secret-key")
+	assert.Contains(t, err.Error(), "node-1")
+
+	gwErr, _ := toGatewayError(err)
+	assert.Equal(t, upstreamNetworkError, gwErr)
+}
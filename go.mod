@@ -3,6 +3,7 @@ module github.com/ivanzzeth/ethereum-jsonrpc-gateway
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/ethereum/go-ethereum v1.9.2
 	github.com/gorilla/websocket v1.4.0
 	github.com/hashicorp/golang-lru v1.0.2
@@ -11,4 +12,5 @@ require (
 	github.com/spf13/cobra v0.0.5
 	github.com/stretchr/testify v1.4.0
 	golang.org/x/sys v0.0.0-20200223170610-d5e6a3e2c0ae // indirect
+	gopkg.in/yaml.v2 v2.2.5
 )